@@ -0,0 +1,26 @@
+package wendy
+
+import (
+	"time"
+)
+
+// Clock is an interface that can be fulfilled to control how the Cluster tells the time, e.g., to test heartbeats, timeouts and retries without waiting for them. Network deadlines and proximity measurements always use the wall clock.
+//
+// Now returns the current time.
+//
+// After returns a channel that receives the current time once the duration has passed, like time.After.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock used until Cluster.SetClock is called. It uses the wall clock.
+type realClock struct{}
+
+func (c realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
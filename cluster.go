@@ -1,15 +1,20 @@
 package wendy
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math/big"
+	"math/rand"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,46 +44,135 @@ func (m StateMask) includeNS() bool {
 }
 
 type stateTables struct {
-	RoutingTable    *[32][16]*Node `json:"rt,omitempty"`
-	LeafSet         *[2][16]*Node  `json:"ls,omitempty"`
-	NeighborhoodSet *[32]*Node     `json:"ns,omitempty"`
-	EOL             bool           `json:"eol,omitempty"`
+	RoutingTable    *[IDDigits][IDBase]*Node `json:"rt,omitempty"`
+	LeafSet         *[2][]*Node              `json:"ls,omitempty"`
+	NeighborhoodSet *[32]*Node               `json:"ns,omitempty"`
+	EOL             bool                     `json:"eol,omitempty"`
 }
 
 type proximityCache struct {
-	cache  map[NodeID]int64
-	ticker <-chan time.Time
+	cache map[NodeID]int64
 	*sync.RWMutex
 }
 
+// proximityCacheLifetime is how often the proximity cache is emptied while the Cluster is listening.
+const proximityCacheLifetime = 1 * time.Hour
+
 func newProximityCache() *proximityCache {
 	return &proximityCache{
 		cache:   map[NodeID]int64{},
-		ticker:  time.Tick(1 * time.Hour),
 		RWMutex: new(sync.RWMutex),
 	}
 }
 
+// ClusterState is a snapshot of the current Node and its state tables, as returned by Cluster.State. It doesn't change when the Cluster does.
+type ClusterState struct {
+	Self            NodeStatus                     `json:"self"`
+	RoutingTable    [IDDigits][IDBase][]NodeStatus `json:"routing_table"`    // The Nodes in each row and column of the routing table, closest first
+	LeafSet         []NodeStatus                   `json:"leaf_set"`         // The Nodes in the leaf set, in ring order
+	NeighborhoodSet []NodeStatus                   `json:"neighborhood_set"` // The Nodes in the neighborhood set, closest first
+}
+
+// HealthStatus is a summary of how well the current Node is participating in the Cluster, as returned by Cluster.Health, e.g., for a health check endpoint. It doesn't change when the Cluster does.
+type HealthStatus struct {
+	Healthy          bool `json:"healthy"`           // Whether the Cluster is listening and knows of at least one Node in its leaf set
+	Listening        bool `json:"listening"`         // Whether Listen is running
+	LeafSetSize      int  `json:"leaf_set_size"`     // The number of Nodes in the leaf set
+	LeafSetCapacity  int  `json:"leaf_set_capacity"` // The number of Nodes the leaf set can hold
+	RoutingTableSize int  `json:"routing_table_size"`
+	RecentEvictions  int  `json:"recent_evictions"` // The number of Nodes removed from the state tables for failing to respond within the last healthEvictionWindow
+}
+
+// ConsistencyIssue is an anomaly in the current Node's state tables, as found by Cluster.CheckConsistency. Issues like these mean the current Node's idea of which keys it is responsible for may overlap with, or leave gaps between, its neighbors'.
+type ConsistencyIssue struct {
+	Kind   string `json:"kind"`   // One of the Consistency kinds
+	Node   NodeID `json:"node"`   // The Node the issue is about
+	Detail string `json:"detail"` // A human-readable description of the issue
+}
+
+// The kinds of ConsistencyIssue that Cluster.CheckConsistency reports.
+const (
+	ConsistencyLeafSetOrder     = "leaf set order"     // A Node is closer to the current Node than one before it on the same side of the leaf set
+	ConsistencyLeafSetSide      = "leaf set side"      // A Node is on the wrong side of the leaf set for its ID
+	ConsistencyLeafSetGap       = "leaf set gap"       // A Node comes after an empty slot in the leaf set
+	ConsistencyLeafSetDuplicate = "leaf set duplicate" // A Node is in the leaf set more than once
+	ConsistencyMissingLeaf      = "missing leaf"       // A Node is in another state table, and belongs in the leaf set, but isn't in it
+)
+
+// healthEvictionWindow is how far back Cluster.Health counts the Nodes that were removed for failing to respond.
+const healthEvictionWindow = 10 * time.Minute
+
+// defaultInboundWorkers and defaultInboundQueue are the number of goroutines that handle inbound connections, and the number of connections that may wait for one of them, unless SetInboundWorkers is used.
+const (
+	defaultInboundWorkers = 64
+	defaultInboundQueue   = 256
+)
+
+// defaultProximitySmoothing is the weight given to each new proximity sample, unless SetProximitySmoothing is used.
+const defaultProximitySmoothing = 0.25
+
+// defaultMaxHops is the number of hops a Message may take before it is dropped, unless SetMaxHops is used. Routing by prefix takes at most one hop per digit of a NodeID, so this leaves plenty of room for detours around failed Nodes.
+const defaultMaxHops = 64
+
 // Cluster holds the information about the state of the network. It is the main interface to the distributed network of Nodes.
 type Cluster struct {
 	self               *Node
 	table              *routingTable
 	leafset            *leafSet
 	neighborhoodset    *neighborhoodSet
-	kill               chan bool
+	kill               chan chan struct{}
 	lastStateUpdate    time.Time
 	applications       []Application
-	log                *log.Logger
+	log                Logger
 	logLevel           int
 	heartbeatFrequency int
+	heartbeatJitter    int
 	networkTimeout     int
 	credentials        Credentials
 	joined             bool
+	joinDone           chan error // receives the outcome of the join in progress, if any
+	joinErr            error      // why the current Node didn't join, if it didn't
 	lock               *sync.RWMutex
+	inserting          *sync.WaitGroup // counts the state tables being inserted outside the inbound workers; see handleClient
+	joinLock           *sync.Mutex     // serializes joins and announcements, so the state tables sent to one joining Node don't race with another being inserted
 	proximityCache     *proximityCache
+	measurer           ProximityMeasurer
+	failureThreshold   int
+	heartbeatFailures  map[NodeID]int
+	newLeavesDelay     time.Duration
+	newLeavesTimer     *time.Timer
+	metrics            Metrics
+	maxHops            int
+	retryPolicy        RetryPolicy
+	inboundWorkers     int
+	inboundQueue       int
+	shutdownTimeout    int
+	drainTimeout       time.Duration
+	clock              Clock
+	smoothing          float64
+	distanceMetric     DistanceMetric
+	compressAbove      int
+	requestID          uint64 // the last ID given to a request, set atomically
+	requests           map[uint64]chan []byte
+	transport          Transport
+	listening          int32         // set atomically, so Listen can return while a connection being handled holds the lock
+	ready              chan struct{} // closed by Listen once the current Node's port is bound; see Ready
+	readyOnce          *sync.Once
+	evictions          []time.Time
+}
+
+// newLeaves schedules an OnNewLeaves notification. Changes to the leafSet that happen less than the newLeaves delay apart are reported in a single notification, sent once the leafSet has settled.
+func (c *Cluster) newLeaves() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.newLeavesTimer != nil {
+		c.newLeavesTimer.Stop()
+	}
+	c.newLeavesTimer = time.AfterFunc(c.newLeavesDelay, c.sendNewLeaves)
 }
 
-func (c *Cluster) newLeaves(leaves []*Node) {
+func (c *Cluster) sendNewLeaves() {
+	leaves := c.leafset.list()
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	c.debug("Sending newLeaves notifications.")
@@ -92,6 +186,7 @@ func (c *Cluster) newLeaves(leaves []*Node) {
 func (c *Cluster) fanOutJoin(node Node) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
+	c.info("Node %s joined the cluster.", node)
 	for _, app := range c.applications {
 		c.debug("Announcing node join.")
 		app.OnNodeJoin(node)
@@ -99,12 +194,24 @@ func (c *Cluster) fanOutJoin(node Node) {
 	}
 }
 
-func (c *Cluster) forward(msg Message, id NodeID) bool {
+func (c *Cluster) fanOutExit(node Node) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	c.info("Node %s left the cluster.", node)
+	for _, app := range c.applications {
+		c.debug("Announcing node exit.")
+		app.OnNodeExit(node)
+		c.debug("Announced node exit.")
+	}
+}
+
+// forward asks each Application whether the Message should be forwarded to the Node with the specified ID. Applications may modify the Message; their changes are what gets sent.
+func (c *Cluster) forward(msg *Message, id NodeID) bool {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	forward := true
 	for _, app := range c.applications {
-		f := app.OnForward(&msg, id)
+		f := app.OnForward(msg, id)
 		if forward {
 			forward = f
 		}
@@ -127,6 +234,18 @@ func (c *Cluster) getNetworkTimeout() int {
 	return c.networkTimeout
 }
 
+func (c *Cluster) getMetrics() Metrics {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.metrics
+}
+
+func (c *Cluster) getProximityMeasurer() ProximityMeasurer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.measurer
+}
+
 func (c *Cluster) cacheProximity(id NodeID, proximity int64) {
 	c.proximityCache.Lock()
 	defer c.proximityCache.Unlock()
@@ -164,22 +283,56 @@ func (c *Cluster) String() string {
 	return c.ID().String()
 }
 
-// GetIP returns the IP address to use when communicating with a Node.
-func (c *Cluster) GetIP(node Node) string {
-	return c.self.GetIP(node)
+// GetIP returns the IP address to use when communicating with a Node. If the current Node can't reach the Node, e.g., because it is in another Region and has no GlobalIP, an UnreachableError is returned.
+func (c *Cluster) GetIP(node Node) (string, error) {
+	return node.ReachableFrom(c.self)
+}
+
+// SaveRoutingTable writes the Nodes in the current Node's routing table to w, so they can be restored with LoadRoutingTable when the Node restarts.
+func (c *Cluster) SaveRoutingTable(w io.Writer) error {
+	return c.table.save(w)
+}
+
+// LoadRoutingTable reads Nodes written by SaveRoutingTable from r and inserts them into the current Node's routing table. The Nodes may have left the Cluster since they were saved; any that have will be removed when they fail to respond to heartbeats.
+func (c *Cluster) LoadRoutingTable(r io.Reader) error {
+	return c.table.load(r)
+}
+
+// RenderRoutingTable writes the current Node's routing table to w as a grid, for debugging. There is a line for each row of the routing table, showing the prefix its Nodes share with the current Node and, for each column, the number of Nodes stored there or a dot if there are none.
+func (c *Cluster) RenderRoutingTable(w io.Writer) error {
+	return c.table.render(w)
+}
+
+// IterateRoutingTable calls f with the row, column and position within the cell of each Node in the current Node's routing table, until f returns false, without copying the whole routing table first. Each Node passed to f is a copy. The routing table is locked for reading while IterateRoutingTable runs, so f must not send Messages or do anything else that can change the routing table; to do that, collect the Nodes and act on them once IterateRoutingTable returns.
+func (c *Cluster) IterateRoutingTable(f func(row, col, entry int, node *Node) bool) {
+	c.table.iterate(func(row, col, entry int, node *Node) bool {
+		return f(row, col, entry, node.copy())
+	})
+}
+
+// Nearest returns the Node in the current Node's routing table that is numerically closest to the key, whatever prefix it shares with the key, and true. It complements Route for keys outside the leaf set, e.g., to pick a fallback or a replica. If the routing table is empty, it returns nil and false.
+func (c *Cluster) Nearest(key NodeID) (*Node, bool) {
+	node, err := c.table.nearest(key)
+	if err != nil {
+		return nil, false
+	}
+	return node.copy(), true
 }
 
-// SetLogger sets the log.Logger that the Cluster, along with its child routingTable and leafSet, will write to.
-func (c *Cluster) SetLogger(l *log.Logger) {
+// SetLogger sets the Logger that the Cluster, along with its child routingTable, leafSet and neighborhoodSet, will write to.
+func (c *Cluster) SetLogger(l Logger) {
 	c.log = l
 	c.table.log = l
 	c.leafset.log = l
+	c.neighborhoodset.log = l
 }
 
 // SetLogLevel sets the level of logging that will be written to the Logger. It will be mirrored to the child routingTable and leafSet.
 //
 // Use wendy.LogLevelDebug to write to the most verbose level of logging, helpful for debugging.
 //
+// Use wendy.LogLevelInfo to also write on Node lifecycle events, like Nodes joining and leaving the Cluster, or state tables being repaired.
+//
 // Use wendy.LogLevelWarn (the default) to write on events that may, but do not necessarily, indicate an error.
 //
 // Use wendy.LogLevelError to write only when an event occurs that is undoubtedly an error.
@@ -187,6 +340,7 @@ func (c *Cluster) SetLogLevel(level int) {
 	c.logLevel = level
 	c.table.logLevel = level
 	c.leafset.logLevel = level
+	c.neighborhoodset.logLevel = level
 }
 
 // SetHeartbeatFrequency sets the frequency in seconds with which heartbeats will be sent from this Node to test the health of other Nodes in the Cluster.
@@ -194,11 +348,250 @@ func (c *Cluster) SetHeartbeatFrequency(freq int) {
 	c.heartbeatFrequency = freq
 }
 
-// SetNetworkTimeout sets the number of seconds before which network requests will be considered timed out and killed.
+// SetHeartbeatJitter sets how much, as a percentage of the heartbeat frequency, the time between heartbeats may randomly vary either way, so that Nodes started at the same time don't all send their heartbeats at once. It defaults to 0; percentages are limited to between 0 and 100.
+func (c *Cluster) SetHeartbeatJitter(percent int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.heartbeatJitter = percent
+}
+
+// heartbeatDelay returns how long to wait before sending the next heartbeats: the heartbeat frequency, randomly varied by up to the heartbeat jitter either way.
+func (c *Cluster) heartbeatDelay(random *rand.Rand) time.Duration {
+	c.lock.RLock()
+	frequency := time.Duration(c.heartbeatFrequency) * time.Second
+	jitter := c.heartbeatJitter
+	c.lock.RUnlock()
+	if jitter <= 0 {
+		return frequency
+	}
+	if jitter > 100 {
+		jitter = 100
+	}
+	spread := float64(frequency) * float64(jitter) / 100
+	return frequency + time.Duration(spread*(2*random.Float64()-1))
+}
+
+// SetRegionMultiplier sets the multiplier applied to the proximity scores of Nodes outside the current Node's Region, biasing the state tables towards Nodes in the same Region. It defaults to 5. Multipliers less than 1 would favour other Regions, and are treated as 1, which turns the bias off.
+func (c *Cluster) SetRegionMultiplier(multiplier float64) {
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	c.self.setRegionMultiplier(multiplier)
+}
+
+// SetStrictRegions sets whether Regions must match exactly to be considered the same Region when choosing which IP to reach a Node on and when adjusting proximity scores. By default, Regions are compared ignoring case and surrounding whitespace, so "us-east-1" and "US-East-1" are the same Region.
+func (c *Cluster) SetStrictRegions(strict bool) {
+	c.self.setStrictRegions(strict)
+}
+
+// SetDistanceMetric sets the metric Distance measures with. It defaults to DistanceCircular. Messages are always routed by circular distance, whichever metric is set.
+func (c *Cluster) SetDistanceMetric(metric DistanceMetric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.distanceMetric = metric
+}
+
+// Distance returns how far the key is from the current Node's ID, as measured by the metric set with SetDistanceMetric, e.g., for diagnostics that compare the Cluster to a Kademlia network.
+func (c *Cluster) Distance(key NodeID) *big.Int {
+	c.lock.RLock()
+	metric := c.distanceMetric
+	c.lock.RUnlock()
+	if metric == DistanceXOR {
+		return c.self.ID.XORDistance(key).Base10()
+	}
+	return c.self.ID.Diff(key)
+}
+
+// SetProximitySmoothing sets the weight, between 0 and 1, that each new round trip time measured to a Node is given when it is combined with the Node's previous proximity score. Lower weights make the ordering of the routing table steadier on a jittery network, but slower to react to real changes; a weight of 1 disables smoothing. Weights outside that range are treated as 1. It defaults to 0.25.
+func (c *Cluster) SetProximitySmoothing(alpha float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.smoothing = alpha
+}
+
+func (c *Cluster) getProximitySmoothing() float64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.smoothing <= 0 || c.smoothing > 1 {
+		return 1
+	}
+	return c.smoothing
+}
+
+// SetMaxColumnEntries sets the number of Nodes kept in each row and column of the routing table, bounding its memory use. It defaults to 8. Messages are routed to the closest of them by proximity; the others are kept in reserve in case it leaves the Cluster. Values less than 1 are treated as 1.
+func (c *Cluster) SetMaxColumnEntries(max int) {
+	c.table.setMaxEntries(max)
+}
+
+// Pin keeps the Node with the specified ID in the routing table whatever its proximity, e.g., for a dedicated relay. A pinned Node is never dropped to make room for closer Nodes, and Messages are routed to it ahead of the other Nodes sharing its row and column of the routing table. Pinned Nodes are still removed if they stop responding. The Node doesn't have to be known yet; it is pinned once it is learned of.
+func (c *Cluster) Pin(id NodeID) error {
+	return c.table.setPinned(id, true)
+}
+
+// Unpin undoes Pin, returning the Node with the specified ID to its place by proximity among the other Nodes in its row and column of the routing table.
+func (c *Cluster) Unpin(id NodeID) error {
+	return c.table.setPinned(id, false)
+}
+
+// SetLeafSetSize sets the number of Nodes kept on each side of the leaf set, dropping the furthest Nodes from a side that holds more. It defaults to 16. Larger leaf sets tolerate more Nodes failing at once, at the cost of more state to exchange and more heartbeats to send; every Node in a Cluster should use the same size. Values less than 1 are treated as 1.
+func (c *Cluster) SetLeafSetSize(size int) {
+	if dropped := c.leafset.setSize(size); len(dropped) > 0 {
+		c.newLeaves()
+	}
+}
+
+// SetProximityMeasurer sets the ProximityMeasurer used to score how close other Nodes are to the current Node. By default, the proximity of a Node is the time it takes to connect to it, send it a message, and receive its acknowledgement. The Node is then asked to send a message back, and is left out of the state tables if that doesn't arrive within the network timeout, as Messages routed through a Node that can't reach other Nodes would be lost. A ProximityMeasurer doesn't contact the Node, so that check isn't made when one is set.
+func (c *Cluster) SetProximityMeasurer(measurer ProximityMeasurer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.measurer = measurer
+}
+
+// SetFailureThreshold sets the number of consecutive heartbeats a Node must fail to respond to before it is considered to have left the Cluster and is removed from the state tables. It defaults to 1.
+func (c *Cluster) SetFailureThreshold(threshold int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.failureThreshold = threshold
+}
+
+// SetNetworkTimeout sets the number of seconds before which network requests will be considered timed out and killed. It defaults to 10. The Timeout of any TimeoutError returned by the Cluster is the timeout that was in effect when the request was made.
 func (c *Cluster) SetNetworkTimeout(timeout int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.networkTimeout = timeout
 }
 
+// SetShutdownTimeout sets the number of seconds Stop and Kill wait for the Cluster to stop listening and finish handling the connections it has received. It defaults to 10.
+func (c *Cluster) SetShutdownTimeout(timeout int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.shutdownTimeout = timeout
+}
+
+func (c *Cluster) getShutdownTimeout() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.shutdownTimeout
+}
+
+// SetDrainTimeout sets how long Stop waits for the Applications that fulfill LeaveHandler to return from PreLeave before it leaves the Cluster anyway. It defaults to 10 seconds.
+func (c *Cluster) SetDrainTimeout(timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.drainTimeout = timeout
+}
+
+// SetClock sets the Clock the Cluster uses to schedule heartbeats, retries and shutdown timeouts. By default, the wall clock is used. The Clock should be set before Listen is called.
+func (c *Cluster) SetClock(clock Clock) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if clock == nil {
+		clock = realClock{}
+	}
+	c.clock = clock
+}
+
+func (c *Cluster) getClock() Clock {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.clock
+}
+
+// SetCompressionThreshold sets the length, in bytes, above which the Value of a Message is gzip compressed before it is sent to another Node. Messages are decompressed as soon as they're received, so Applications never see the difference. By default, or if the threshold is 0 or less, Messages are never compressed. Every Node in the Cluster must understand compressed Messages before any of them sets a threshold.
+func (c *Cluster) SetCompressionThreshold(bytes int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.compressAbove = bytes
+}
+
+func (c *Cluster) getCompressionThreshold() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.compressAbove
+}
+
+// compressMessage gzip compresses the Value of the Message if it is longer than the compression threshold.
+func (c *Cluster) compressMessage(msg Message) (Message, error) {
+	threshold := c.getCompressionThreshold()
+	if threshold <= 0 || len(msg.Value) <= threshold {
+		return msg, nil
+	}
+	return msg.compress()
+}
+
+// SetTransport sets the Transport the Cluster uses to listen for and connect to other Nodes. By default, Nodes connect over TCP. The Transport must be set before Listen is called, and every Node in the Cluster needs to use a compatible one.
+func (c *Cluster) SetTransport(transport Transport) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if transport == nil {
+		transport = tcpTransport{}
+	}
+	c.transport = transport
+}
+
+func (c *Cluster) getTransport() Transport {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.transport
+}
+
+// SetMetrics sets the Metrics that the Cluster reports hops, deliveries and timeouts to. By default, they are discarded.
+func (c *Cluster) SetMetrics(metrics Metrics) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
+	c.metrics = metrics
+}
+
+// SetMaxHops sets the number of hops a Message may take through the Cluster. A Message that arrives after taking more hops than that is assumed to be caught in a routing loop, and is dropped instead of being forwarded or delivered. It defaults to 64.
+func (c *Cluster) SetMaxHops(hops int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxHops = hops
+}
+
+func (c *Cluster) getMaxHops() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.maxHops
+}
+
+// SetRetryPolicy sets how many times the Cluster tries to send a Message to another Node, and how long it waits between attempts, before the Node is treated as dead or the request as timed out. By default, Messages are only sent once.
+func (c *Cluster) SetRetryPolicy(policy RetryPolicy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.retryPolicy = policy
+}
+
+func (c *Cluster) getRetryPolicy() RetryPolicy {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.retryPolicy
+}
+
+// SetInboundWorkers sets the number of goroutines that handle the connections the Cluster receives, and the number of connections that may be queued while they are all busy. State tables sent by other Nodes are inserted outside the workers, as checking that their Nodes can reach the current Node back needs a worker free to receive the reply. Connections that arrive while the queue is full are closed without being handled, and reported to the Metrics as dropped. It defaults to 64 workers and a queue of 256, and only takes effect the next time Listen is called.
+func (c *Cluster) SetInboundWorkers(workers, queue int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.inboundWorkers = workers
+	c.inboundQueue = queue
+}
+
+func (c *Cluster) getInboundWorkers() (int, int) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.inboundWorkers, c.inboundQueue
+}
+
+// SetNewLeavesDelay sets how long the leaf set must go without changing before Applications are notified of its new contents through OnNewLeaves.
+func (c *Cluster) SetNewLeavesDelay(delay time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.newLeavesDelay = delay
+}
+
 // NewCluster creates a new instance of a connection to the network and intialises the state tables and channels it requires.
 func NewCluster(self *Node, credentials Credentials) *Cluster {
 	return &Cluster{
@@ -206,44 +599,110 @@ func NewCluster(self *Node, credentials Credentials) *Cluster {
 		table:              newRoutingTable(self),
 		leafset:            newLeafSet(self),
 		neighborhoodset:    newNeighborhoodSet(self),
-		kill:               make(chan bool),
+		kill:               make(chan chan struct{}),
 		lastStateUpdate:    time.Now(),
 		applications:       []Application{},
-		log:                log.New(os.Stdout, "wendy("+self.ID.String()+") ", log.LstdFlags),
+		log:                NewLogger(log.New(os.Stdout, "wendy("+self.ID.String()+") ", log.LstdFlags)),
 		logLevel:           LogLevelWarn,
 		heartbeatFrequency: 300,
 		networkTimeout:     10,
 		credentials:        credentials,
 		joined:             false,
 		lock:               new(sync.RWMutex),
+		joinLock:           new(sync.Mutex),
+		inserting:          new(sync.WaitGroup),
 		proximityCache:     newProximityCache(),
+		failureThreshold:   1,
+		heartbeatFailures:  map[NodeID]int{},
+		requests:           map[uint64]chan []byte{},
+		newLeavesDelay:     100 * time.Millisecond,
+		metrics:            noopMetrics{},
+		maxHops:            defaultMaxHops,
+		inboundWorkers:     defaultInboundWorkers,
+		inboundQueue:       defaultInboundQueue,
+		shutdownTimeout:    10,
+		drainTimeout:       10 * time.Second,
+		clock:              realClock{},
+		smoothing:          defaultProximitySmoothing,
+		transport:          tcpTransport{},
+		ready:              make(chan struct{}),
+		readyOnce:          new(sync.Once),
 	}
 }
 
 // Stop gracefully shuts down the local connection to the Cluster, removing the local Node from the Cluster and preventing it from receiving or sending further messages.
 //
-// Before it disconnects the Node, Stop contacts every Node it knows of to warn them of its departure. If a graceful disconnect is not necessary, Kill should be used instead. Nodes will remove the Node from their state tables next time they attempt to contact it.
-func (c *Cluster) Stop() {
+// Before it disconnects the Node, Stop calls PreLeave on the Applications that fulfill LeaveHandler, waiting up to the drain timeout for them, then contacts every Node it knows of to warn them of its departure. If a graceful disconnect is not necessary, Kill should be used instead. Nodes will remove the Node from their state tables next time they attempt to contact it. Like Kill, Stop returns a TimeoutError if the Cluster doesn't shut down within the shutdown timeout.
+func (c *Cluster) Stop() error {
+	c.drain()
 	c.debug("Sending graceful exit message.")
 	msg := c.NewMessage(NODE_EXIT, c.self.ID, []byte{})
-	nodes := c.table.list([]int{}, []int{})
-	nodes = append(nodes, c.leafset.list()...)
-	nodes = append(nodes, c.neighborhoodset.list()...)
-	for _, node := range nodes {
+	for _, node := range c.listNodes() {
 		err := c.send(msg, node)
 		if err != nil {
 			c.fanOutError(err)
 		}
 	}
-	c.Kill()
+	return c.Kill()
+}
+
+// drain calls PreLeave on each Application that fulfills LeaveHandler, in the order they were registered, and waits for them to return or for the drain timeout to pass, whichever is first.
+func (c *Cluster) drain() {
+	handlers := []LeaveHandler{}
+	c.lock.RLock()
+	for _, app := range c.applications {
+		if handler, ok := app.(LeaveHandler); ok {
+			handlers = append(handlers, handler)
+		}
+	}
+	timeout := c.drainTimeout
+	c.lock.RUnlock()
+	if len(handlers) < 1 {
+		return
+	}
+	c.debug("Draining %d Applications before leaving.", len(handlers))
+	drained := make(chan struct{})
+	go func() {
+		for _, handler := range handlers {
+			handler.PreLeave()
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-c.getClock().After(timeout):
+		c.warn("Timed out after %s waiting for Applications to drain, leaving anyway.", timeout)
+	}
 }
 
 // Kill shuts down the local connection to the Cluster, removing the local Node from the Cluster and preventing it from receiving or sending further messages.
 //
 // Unlike Stop, Kill immediately disconnects the Node without sending a message to let other Nodes know of its exit.
-func (c *Cluster) Kill() {
+//
+// Kill waits for Listen to return and for the connections already received to be handled. If that takes longer than the shutdown timeout, or Listen isn't running, Kill gives up and returns a TimeoutError; any connections still being handled are left to finish on their own.
+func (c *Cluster) Kill() error {
 	c.debug("Exiting the cluster.")
-	c.kill <- true
+	timeout := c.getShutdownTimeout()
+	expired := c.getClock().After(time.Duration(timeout) * time.Second)
+	drained := make(chan struct{})
+	select {
+	case c.kill <- drained:
+	case <-expired:
+		c.warn("Timed out waiting for the cluster to stop listening.")
+		return throwTimeout("Stopping the cluster", time.Duration(timeout)*time.Second)
+	}
+	select {
+	case <-drained:
+		return nil
+	case <-expired:
+		c.warn("Timed out waiting for inbound connections to be handled.")
+		return throwTimeout("Stopping the cluster", time.Duration(timeout)*time.Second)
+	}
+}
+
+// Ready returns a channel that is closed once Listen has bound the current Node's port, and recorded it in the current Node if it was chosen automatically. The current Node's Port shouldn't be read before then when Listen is running in another goroutine, e.g., to tell other Nodes how to reach it.
+func (c *Cluster) Ready() <-chan struct{} {
+	return c.ready
 }
 
 // RegisterCallback allows anything that fulfills the Application interface to be hooked into the Wendy's callbacks.
@@ -259,11 +718,13 @@ func (c *Cluster) RegisterCallback(app Application) {
 func (c *Cluster) Listen() error {
 	portstr := strconv.Itoa(c.self.Port)
 	c.debug("Listening on port %d", c.self.Port)
-	ln, err := net.Listen("tcp", ":"+portstr)
+	ln, err := c.getTransport().Listen(":" + portstr)
 	if err != nil {
 		return err
 	}
 	defer ln.Close()
+	c.setListening(true)
+	defer c.setListening(false)
 	// save bound port back to Node in case where port is autoconfigured by OS
 	if c.self.Port == 0 {
 		c.debug("Port set to 0")
@@ -278,33 +739,92 @@ func (c *Cluster) Listen() error {
 			return errors.New("Couldn't record autoconfigured port: " + err.Error())
 		}
 		c.debug("Setting port to %d", port)
-		c.self.Port = int(port)
+		c.self.setPort(int(port))
 	}
+	c.readyOnce.Do(func() {
+		close(c.ready)
+	})
 	connections := make(chan net.Conn)
+	// closed when Listen returns, so the listener being closed isn't reported as an error
+	stopped := make(chan bool)
+	defer close(stopped)
 	go func(ln net.Listener, ch chan net.Conn) {
 		for {
 			conn, err := ln.Accept()
 			if err != nil {
-				c.fanOutError(err)
+				select {
+				case <-stopped:
+				default:
+					c.fanOutError(err)
+				}
 				return
 			}
 			c.debug("Connection received.")
-			ch <- conn
+			select {
+			case ch <- conn:
+			case <-stopped:
+				conn.Close()
+				return
+			}
 		}
 	}(ln, connections)
+	workers, queue := c.getInboundWorkers()
+	if workers < 1 {
+		workers = 1
+	}
+	if queue < 0 {
+		queue = 0
+	}
+	inbound := make(chan net.Conn, queue)
+	var running sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for conn := range inbound {
+				c.handleClient(conn)
+			}
+		}()
+	}
+	clock := c.getClock()
+	// seeded from the Clock, so the jitter is the same every time for a Clock that always starts at the same time
+	random := rand.New(rand.NewSource(clock.Now().UnixNano()))
+	heartbeats := clock.After(c.heartbeatDelay(random))
+	cacheExpiry := clock.After(proximityCacheLifetime)
 	for {
 		select {
-		case <-c.kill:
+		case drained := <-c.kill:
+			// the workers handle any connections still queued, then exit
+			close(inbound)
+			go func() {
+				running.Wait()
+				c.inserting.Wait()
+				// a connection handled while shutting down could have changed the leaf set, so only stop notifying Applications once they're all done
+				c.lock.Lock()
+				if c.newLeavesTimer != nil {
+					c.newLeavesTimer.Stop()
+				}
+				c.lock.Unlock()
+				close(drained)
+			}()
 			return nil
-		case <-time.After(time.Duration(c.heartbeatFrequency) * time.Second):
+		case <-heartbeats:
+			heartbeats = clock.After(c.heartbeatDelay(random))
 			c.debug("Sending heartbeats.")
 			go c.sendHeartbeats()
 			break
 		case conn := <-connections:
-			c.debug("Handling connection.")
-			go c.handleClient(conn)
+			select {
+			case inbound <- conn:
+				c.debug("Queued connection.")
+			default:
+				c.warn("Too many inbound connections, dropping connection from %s.", conn.RemoteAddr())
+				c.getMetrics().Dropped()
+				conn.Close()
+			}
 			break
-		case <-c.proximityCache.ticker:
+		case <-cacheExpiry:
+			cacheExpiry = clock.After(proximityCacheLifetime)
 			c.debug("Emptying proximity cache...")
 			go c.clearProximityCache()
 			break
@@ -313,75 +833,553 @@ func (c *Cluster) Listen() error {
 	return nil
 }
 
-// Send routes a message through the Cluster.
+// Send routes a message through the Cluster. If the next Node on the Message's route doesn't respond, it is removed from the state tables and the Message is routed again. An error is returned if the Message can't make any progress towards its key.
 func (c *Cluster) Send(msg Message) error {
-	c.debug("Getting target for message %s", msg.Key)
-	target, err := c.Route(msg.Key)
+	return c.SendContext(context.Background(), msg)
+}
+
+// SendContext routes a message through the Cluster, like Send, but gives up and returns the context's error as soon as the context is cancelled or its deadline passes.
+func (c *Cluster) SendContext(ctx context.Context, msg Message) error {
+	if maxHops := c.getMaxHops(); msg.Hop > maxHops {
+		action := "Routing message " + msg.Key.String()
+		c.err("Dropping message %s after %d hops; it's probably caught in a routing loop.", msg.Key, msg.Hop)
+		c.getMetrics().Timeout(action)
+		return nil
+	}
+	tried := map[NodeID]bool{}
+	forwarded := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.debug("Getting target for message %s", msg.Key)
+		target, table, err := c.nextHopFrom(msg.Key)
+		if err != nil {
+			return err
+		}
+		if target == nil {
+			c.debug("Couldn't find a target. Delivering message %s", msg.Key)
+			if msg.Request || msg.Purpose > NODE_ANN {
+				c.deliver(msg)
+			}
+			if msg.Traced {
+				c.returnTrace(msg)
+			}
+			return nil
+		}
+		if tried[target.ID] {
+			return noProgressError
+		}
+		tried[target.ID] = true
+		// the applications see each hop once, not once per Node tried for it
+		if !forwarded {
+			if !c.forward(&msg, target.ID) {
+				c.debug("Message %s wasn't forwarded because callback terminated it.", msg.Key)
+				return nil
+			}
+			forwarded = true
+		}
+		c.getMetrics().RouteHop(msg.Key)
+		if !c.self.regionMatches(target) {
+			c.getMetrics().CrossRegionHop(msg.Key, len(msg.Value))
+		}
+		out := msg
+		if msg.Traced {
+			out.Trace = append(append([]TraceHop{}, msg.Trace...), TraceHop{Node: *c.self.copy(), Table: table})
+		}
+		err = c.sendContext(ctx, out, target)
+		if !errors.Is(err, deadNodeError) {
+			return err
+		}
+		c.debug("Target %s is dead. Rerouting message %s", target.ID, msg.Key)
+		c.evicted()
+		err = c.remove(target.ID)
+		if err != nil {
+			c.err("Couldn't remove dead Node %s: %s", target.ID, err.Error())
+		}
+	}
+}
+
+// SendTraced routes a Message with the payload as its value and NODE_ANN+1 as its purpose towards the key, like Send, and returns the Nodes it passed through, in order, e.g., to debug why a Message was delivered where it was. The route starts with the current Node and ends with the Node the Message was delivered to. SendTraced waits up to the network timeout for the route to be sent back; use SendTracedMessage to choose the Message and the timeout, or to learn which state table each Node chose the next one from.
+func (c *Cluster) SendTraced(key NodeID, payload []byte) ([]Node, error) {
+	msg := c.NewMessage(NODE_ANN+1, key, payload)
+	trace, err := c.SendTracedMessage(msg, time.Duration(c.getNetworkTimeout())*time.Second)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if target == nil {
-		c.debug("Couldn't find a target. Delivering message %s", msg.Key)
-		if msg.Purpose > NODE_ANN {
-			c.deliver(msg)
+	nodes := make([]Node, 0, len(trace))
+	for _, hop := range trace {
+		nodes = append(nodes, hop.Node)
+	}
+	return nodes, nil
+}
+
+// SendTracedMessage routes a Message through the Cluster, like Send, recording each Node it passes through and which of that Node's state tables the next Node on its route was chosen from. The Node the Message is delivered to sends the route back, and SendTracedMessage waits up to the timeout for it, returning a TimeoutError if it doesn't arrive. The route starts with the current Node and ends with the Node the Message was delivered to, whose Table is empty.
+func (c *Cluster) SendTracedMessage(msg Message, timeout time.Duration) ([]TraceHop, error) {
+	id, response := c.newRequest()
+	defer c.endRequest(id)
+	msg.RequestID = id
+	msg.Traced = true
+	msg.Trace = nil
+	err := c.Send(msg)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case value := <-response:
+		var trace []TraceHop
+		err = json.Unmarshal(value, &trace)
+		if err != nil {
+			return nil, err
 		}
-		return nil
+		return trace, nil
+	case <-c.getClock().After(timeout):
+		return nil, throwTimeout("Tracing message "+msg.Key.String(), timeout)
 	}
-	forward := c.forward(msg, target.ID)
-	if forward {
-		err = c.send(msg, target)
-		if err == deadNodeError {
-			err = c.remove(target.ID)
+}
+
+// returnTrace sends the route a traced Message took to the current Node, which it was delivered to, back to the Node that sent it.
+func (c *Cluster) returnTrace(msg Message) {
+	trace := append(msg.Trace, TraceHop{Node: *c.self.copy()})
+	data, err := json.Marshal(trace)
+	if err != nil {
+		c.fanOutError(err)
+		return
+	}
+	resp := c.newRequestMessage(requestTrace, msg.Sender.ID, data)
+	resp.RequestID = msg.RequestID
+	resp.Response = true
+	err = c.send(resp, &msg.Sender)
+	if err != nil {
+		c.fanOutError(err)
+	}
+}
+
+// Broadcast sends a Message with the specified purpose and value directly to every Node the current Node knows of, each of them once. Each Message is keyed with the ID of the Node it is sent to, so it is delivered there instead of being routed on. Like any other Message, the purpose must be greater than NODE_ANN to be delivered to Applications.
+//
+// Broadcast is best-effort: the Messages are sent concurrently, each subject to the network timeout, and a Node that can't be reached is logged and skipped. Broadcast returns once every Node has been tried.
+func (c *Cluster) Broadcast(purpose byte, value []byte) {
+	var wg sync.WaitGroup
+	for _, node := range c.listNodes() {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			err := c.send(c.NewMessage(purpose, node.ID, value), node)
+			if err != nil {
+				c.warn("Couldn't broadcast to %s: %s", node, err.Error())
+			}
+		}(node)
+	}
+	wg.Wait()
+}
+
+// Request routes a Message with the payload as its value towards the key, like Send, and waits for the Node it is delivered to to respond, returning the value of the response. The Applications on that Node must fulfill RequestHandler to respond. If no response is received within the timeout, a TimeoutError is returned.
+func (c *Cluster) Request(key NodeID, payload []byte, timeout time.Duration) ([]byte, error) {
+	id, response := c.newRequest()
+	defer c.endRequest(id)
+	msg := c.newRequestMessage(requestApplication, key, payload)
+	msg.RequestID = id
+	err := c.Send(msg)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case value := <-response:
+		return value, nil
+	case <-c.getClock().After(timeout):
+		return nil, throwTimeout("Request to "+key.String(), timeout)
+	}
+}
+
+// newRequestMessage creates a Message that is a request of the specified kind, or the response to one.
+func (c *Cluster) newRequestMessage(kind byte, key NodeID, value []byte) Message {
+	msg := c.NewMessage(kind, key, value)
+	msg.Request = true
+	return msg
+}
+
+// newRequest returns a new request ID, and the channel the response to the request will be sent on. endRequest must be called once the response is no longer waited for.
+func (c *Cluster) newRequest() (uint64, chan []byte) {
+	id := atomic.AddUint64(&c.requestID, 1)
+	response := make(chan []byte, 1)
+	c.lock.Lock()
+	c.requests[id] = response
+	c.lock.Unlock()
+	return id, response
+}
+
+func (c *Cluster) endRequest(id uint64) {
+	c.lock.Lock()
+	delete(c.requests, id)
+	c.lock.Unlock()
+}
+
+// respond passes a response that was received to the request that is waiting for it, if there still is one.
+func (c *Cluster) respond(msg Message) {
+	c.lock.RLock()
+	response, ok := c.requests[msg.RequestID]
+	c.lock.RUnlock()
+	if !ok {
+		c.debug("Received a response to request %d, which isn't waiting anymore.", msg.RequestID)
+		return
+	}
+	select {
+	case response <- msg.Value:
+	default:
+	}
+}
+
+// onRequest handles a request or response that was delivered to the current Node. Requests are answered by the first RequestHandler registered, and the response is sent straight back to the Node that made the request.
+func (c *Cluster) onRequest(msg Message) {
+	if msg.Response {
+		c.respond(msg)
+		return
+	}
+	if msg.Purpose != requestApplication {
+		c.warn("Received request %d of unknown kind %d from %s.", msg.RequestID, msg.Purpose, msg.Sender.ID)
+		return
+	}
+	var handler RequestHandler
+	c.lock.RLock()
+	for _, app := range c.applications {
+		if h, ok := app.(RequestHandler); ok {
+			handler = h
+			break
 		}
-		return err
 	}
-	c.debug("Message %s wasn't forwarded because callback terminated it.", msg.Key)
-	return nil
+	c.lock.RUnlock()
+	if handler == nil {
+		c.warn("No Application can respond to request %d from %s.", msg.RequestID, msg.Sender.ID)
+		return
+	}
+	resp := c.newRequestMessage(requestApplication, msg.Sender.ID, handler.OnRequest(msg))
+	resp.RequestID = msg.RequestID
+	resp.Response = true
+	err := c.send(resp, &msg.Sender)
+	if err != nil {
+		c.fanOutError(err)
+	}
 }
 
-// Route checks the leafSet and routingTable to see if there's an appropriate match for the NodeID. If there is a better match than the current Node, a pointer to that Node is returned. Otherwise, nil is returned (and the message should be delivered).
+// Route checks the leafSet, routingTable and neighborhoodSet to see if there's an appropriate match for the NodeID. If there is a better match than the current Node, a pointer to that Node is returned. Otherwise, nil is returned (and the message should be delivered). If two Nodes are exactly as close to the key, the one whose ID is less is the better match, the same as in Owns.
 func (c *Cluster) Route(key NodeID) (*Node, error) {
-	target, err := c.leafset.route(key)
-	if err != nil {
+	return c.nextHop(key)
+}
+
+// nextHop decides which Node a Message with the specified key should be forwarded to, following the Pastry routing algorithm. If the key is covered by the leafSet, the Message goes to the Node in the leafSet numerically closest to the key. Otherwise, it goes to the closest Node in the routingTable that shares one more digit with the key than the current Node does. If there is no such Node, it goes to the known Node numerically closest to the key out of those that share at least as many digits with the key as the current Node and are numerically closer to it. If nextHop returns nil, the current Node is the Message's destination.
+func (c *Cluster) nextHop(key NodeID) (*Node, error) {
+	target, _, err := c.nextHopFrom(key)
+	return target, err
+}
+
+// nextHopFrom does the work for nextHop, also returning which state table the Node was chosen from: TableLeafSet, TableRoutingTable or TableNeighborhoodSet.
+func (c *Cluster) nextHopFrom(key NodeID) (*Node, string, error) {
+	// an empty leafSet covers every key, but Nodes may still be known from the other state tables
+	if !c.leafset.isEmpty() && c.leafset.covers(key) {
+		target, err := c.leafset.route(key)
 		if _, ok := err.(IdentityError); ok {
 			c.debug("I'm the target. Delivering message %s", key)
-			return nil, nil
+			return nil, "", nil
 		}
-		if err != nodeNotFoundError {
-			return nil, err
+		if err != nil && err != nodeNotFoundError {
+			return nil, "", err
 		}
-		if target != nil {
+		if target != nil && !target.isZero() {
 			c.debug("Target acquired in leafset.")
-			return target, nil
+			return target, TableLeafSet, nil
 		}
 	}
 	c.debug("Target not found in leaf set, checking routing table.")
-	target, err = c.table.route(key)
+	row := c.self.ID.CommonPrefixLen(key)
+	if row >= IDDigits {
+		c.debug("I'm the target. Delivering message %s", key)
+		return nil, "", nil
+	}
+	digit, err := key.Digit(row)
 	if err != nil {
-		if _, ok := err.(IdentityError); ok {
-			c.debug("I'm the target. Delivering message %s", key)
-			return nil, nil
-		}
-		if err != nodeNotFoundError {
-			return nil, err
+		return nil, "", err
+	}
+	if entries := c.table.list([]int{row}, []int{int(digit)}); len(entries) > 0 && !entries[0].isZero() {
+		c.debug("Target acquired in routing table.")
+		return entries[0], TableRoutingTable, nil
+	}
+	c.debug("Target not found in routing table, checking every known node.")
+	var target *Node
+	var table string
+	best := c.self.ID
+	// in the same order as listNodes, so a Node in more than one table is credited to the first
+	known := []struct {
+		table string
+		nodes []*Node
+	}{
+		{TableRoutingTable, c.table.list([]int{}, []int{})},
+		{TableLeafSet, c.leafset.list()},
+		{TableNeighborhoodSet, c.neighborhoodset.list()},
+	}
+	for _, tableNodes := range known {
+		for _, node := range tableNodes.nodes {
+			if node == nil || node.isZero() || key.CommonPrefixLen(node.ID) < row {
+				continue
+			}
+			if key.closer(node.ID, best) {
+				target = node
+				table = tableNodes.table
+				best = node.ID
+			}
 		}
 	}
 	if target != nil {
-		c.debug("Target acquired in routing table.")
-		return target, nil
+		c.debug("Target acquired from known nodes.")
+		return target, table, nil
+	}
+	c.debug("No node is closer than me. Delivering message %s", key)
+	return nil, "", nil
+}
+
+// State returns a snapshot of the current Node and its state tables, e.g., for a status page.
+func (c *Cluster) State() ClusterState {
+	state := ClusterState{
+		Self:            c.self.Status(),
+		RoutingTable:    c.table.status(),
+		LeafSet:         []NodeStatus{},
+		NeighborhoodSet: []NodeStatus{},
+	}
+	for _, node := range c.leafset.list() {
+		state.LeafSet = append(state.LeafSet, node.Status())
+	}
+	for _, node := range c.neighborhoodset.list() {
+		state.NeighborhoodSet = append(state.NeighborhoodSet, node.Status())
+	}
+	return state
+}
+
+// Owns returns true if the current Node is the Node numerically closest to the key out of every Node it knows of, i.e., if it is responsible for the key. If two Nodes are exactly as close to the key, the one whose ID is less owns it, so that they agree.
+func (c *Cluster) Owns(key NodeID) bool {
+	for _, node := range c.listNodes() {
+		if key.closer(node.ID, c.self.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+// ResponsibilityRange returns the arc of the node space the current Node is responsible for, i.e., the keys that are numerically closer to it than to its immediate neighbors in the leaf set, breaking ties as in Owns. The arc runs from start to end inclusive, counting up and wrapping around, so start may be greater than end. If the leaf set is empty, the current Node is responsible for the whole node space, and the arc starts just after its own ID and ends at it.
+func (c *Cluster) ResponsibilityRange() (start, end NodeID) {
+	self := c.self.ID
+	pred, succ := c.leafset.neighbors()
+	if pred == nil || succ == nil {
+		return self.Next(), self
+	}
+	start = arcMidpoint(pred.ID, self)
+	if !start.closer(self, pred.ID) {
+		start = start.Next()
+	}
+	end = arcMidpoint(self, succ.ID)
+	if !end.closer(self, succ.ID) {
+		end = end.Prev()
+	}
+	return start, end
+}
+
+// KnownNodes returns the number of distinct Nodes in the current Node's state tables, not counting the current Node.
+func (c *Cluster) KnownNodes() int {
+	return len(c.listNodes())
+}
+
+// Health returns a summary of how well the current Node is participating in the Cluster. The Cluster is considered healthy while it is listening and its leaf set isn't empty; a Node that can't route to any other Node is unhealthy, however many Nodes its routing table holds.
+func (c *Cluster) Health() HealthStatus {
+	leaves := len(c.leafset.list())
+	listening := atomic.LoadInt32(&c.listening) == 1
+	return HealthStatus{
+		Healthy:          listening && leaves > 0,
+		Listening:        listening,
+		LeafSetSize:      leaves,
+		LeafSetCapacity:  2 * c.leafset.size(),
+		RoutingTableSize: c.table.count(),
+		RecentEvictions:  c.recentEvictions(),
 	}
-	return nil, nil
+}
+
+func (c *Cluster) setListening(listening bool) {
+	if listening {
+		atomic.StoreInt32(&c.listening, 1)
+	} else {
+		atomic.StoreInt32(&c.listening, 0)
+	}
+}
+
+// evicted records that a Node was removed from the state tables for failing to respond, for Health to report.
+func (c *Cluster) evicted() {
+	now := c.getClock().Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evictions = append(trimEvictions(c.evictions, now), now)
+}
+
+func (c *Cluster) recentEvictions() int {
+	now := c.getClock().Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evictions = trimEvictions(c.evictions, now)
+	return len(c.evictions)
+}
+
+// trimEvictions drops the evictions that happened longer than healthEvictionWindow before now. The evictions must be in the order they happened.
+func trimEvictions(evictions []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(evictions) && now.Sub(evictions[i]) > healthEvictionWindow {
+		i++
+	}
+	return evictions[i:]
+}
+
+// CheckConsistency cross-checks the current Node's state tables, returning the anomalies it finds, e.g., for an operator to diagnose why Messages are delivered to the wrong Node. It checks that each side of the leaf set holds only Nodes from that side of the current Node, ordered from closest to furthest with no gaps or duplicates, and that no Node in the routing table or neighborhood set belongs in the leaf set without being in it. A healthy Cluster returns no issues.
+func (c *Cluster) CheckConsistency() []ConsistencyIssue {
+	issues := c.leafset.check()
+	reported := map[NodeID]bool{}
+	known := []struct {
+		table string
+		nodes []*Node
+	}{
+		{TableRoutingTable, c.table.list([]int{}, []int{})},
+		{TableNeighborhoodSet, c.neighborhoodset.list()},
+	}
+	for _, tableNodes := range known {
+		for _, node := range tableNodes.nodes {
+			if node == nil || node.isZero() || reported[node.ID] || !c.leafset.belongs(node.ID) {
+				continue
+			}
+			reported[node.ID] = true
+			issues = append(issues, ConsistencyIssue{
+				Kind:   ConsistencyMissingLeaf,
+				Node:   node.ID,
+				Detail: fmt.Sprintf("Node is in the %s but not the leaf set, though the leaf set has room for it or holds a further Node on its side.", tableNodes.table),
+			})
+		}
+	}
+	return issues
+}
+
+// EstimateSize returns a rough estimate of the number of Nodes in the Cluster, including the current Node, based on how densely the Nodes in the leaf set are packed around the current Node's ID. Until the leaf set is full, it is assumed to hold the whole Cluster.
+func (c *Cluster) EstimateSize() int {
+	return c.leafset.estimateSize()
+}
+
+// ReplicaSet returns the k Nodes that are numerically closest to the key, from closest to furthest, which may include the current Node. These are the Nodes that should hold replicas of data stored under the key. Only the Nodes in the leaf set are considered, so if k is larger than the leaf set, fewer Nodes are returned.
+func (c *Cluster) ReplicaSet(key NodeID, k int) []*Node {
+	return c.leafset.replicaSet(key, k)
+}
+
+// Ping sends a heartbeat to the Node and waits for it to be acknowledged, returning the time the round trip took. If the Node accepts the heartbeat but doesn't acknowledge it within the network timeout, a TimeoutError is returned. Any other error means the Node couldn't be reached at all.
+func (c *Cluster) Ping(node Node) (time.Duration, error) {
+	address, err := node.ReachableFrom(c.self)
+	if err != nil {
+		return 0, err
+	}
+	msg := c.NewMessage(HEARTBEAT, c.self.ID, []byte{})
+	return c.sendToIPTimed(context.Background(), msg, address)
 }
 
 // Join expresses a Node's desire to join the Cluster, kicking off a process that will populate its child leafSet, neighborhoodSet and routingTable. Once that process is complete, the Node can be said to be fully participating in the Cluster.
 //
-// The IP and port passed to Join should be those of a known Node in the Cluster. The algorithm assumes that the known Node is close in proximity to the current Node, but that is not a hard requirement.
+// The IP and port passed to Join should be those of a known Node in the Cluster. The algorithm assumes that the known Node is close in proximity to the current Node, but that is not a hard requirement. If the known Node can't be reached within the network timeout, Join returns an error and the Node is not joined to the Cluster.
+//
+// Join waits for the state tables that end the join. If they don't arrive within the network timeout, Join returns a TimeoutError. If the Cluster already has a Node with the current Node's ID, the join is abandoned, and Join returns an error wrapping ErrNodeIDCollision, which is also passed to the Applications' OnError. The Node should then be given a new ID, in a new Cluster, and join again.
+//
+// Several Nodes may join at the same time, through the same known Node or not. Shortly after it has joined, the Node asks the Nodes in its leaf set for their leaf sets, to learn of any Nodes that joined alongside it.
 func (c *Cluster) Join(ip string, port int) error {
+	return c.join(net.JoinHostPort(ip, strconv.Itoa(port)))
+}
+
+func (c *Cluster) join(address string) error {
 	credentials := c.marshalCredentials()
-	c.debug("Sending join message to %s:%d", ip, port)
+	c.debug("Sending join message to %s", address)
 	msg := c.NewMessage(NODE_JOIN, c.self.ID, credentials)
-	address := ip + ":" + strconv.Itoa(port)
-	return c.SendToIP(msg, address)
+	done := make(chan error, 1)
+	c.lock.Lock()
+	c.joinDone = done
+	c.joinErr = nil
+	c.lock.Unlock()
+	err := c.SendToIP(msg, address)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(c.getNetworkTimeout()) * time.Second
+	select {
+	case err = <-done:
+		return err
+	case <-c.getClock().After(timeout):
+		return throwTimeout("Joining through "+address, timeout)
+	}
+}
+
+// finishJoin reports the outcome of the join in progress to join. A non-nil error abandons the join, so later state tables are ignored.
+func (c *Cluster) finishJoin(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err != nil {
+		c.joinErr = err
+	}
+	if c.joinDone == nil {
+		return
+	}
+	select {
+	case c.joinDone <- err:
+	default:
+	}
+	c.joinDone = nil
+}
+
+// joinAbandoned returns true if the current Node gave up on its join.
+func (c *Cluster) joinAbandoned() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.joinErr != nil
+}
+
+// rejoinSampleSize is the number of Nodes in the routing table that Rejoin checks are still in the Cluster.
+const rejoinSampleSize = 8
+
+// Rejoin rejoins the Cluster through the bootstrap Node using the state the current Node had before it left, instead of a fresh Join, e.g., after a quick restart. The routing table must have been loaded with LoadRoutingTable first.
+//
+// Rejoin pings a random sample of the Nodes in the routing table, removing any that don't respond and asking the Cluster to repair their cells. If most of the sample responds, the current Node announces its presence straight away, and fills in its leaf set and neighborhood set from the replies. Otherwise the persisted state is considered stale, and Rejoin falls back to Join.
+func (c *Cluster) Rejoin(bootstrap Node) error {
+	address, err := bootstrap.ReachableFrom(c.self)
+	if err != nil {
+		return err
+	}
+	sample := c.table.list([]int{}, []int{})
+	rand.Shuffle(len(sample), func(i, j int) {
+		sample[i], sample[j] = sample[j], sample[i]
+	})
+	if len(sample) > rejoinSampleSize {
+		sample = sample[:rejoinSampleSize]
+	}
+	dead := 0
+	for _, node := range sample {
+		if _, err := c.Ping(*node); err == nil {
+			continue
+		}
+		c.debug("Node %s didn't respond, removing it from the routing table.", node)
+		dead++
+		_, err = c.table.removeNode(node.ID)
+		if err != nil && err != nodeNotFoundError {
+			return err
+		}
+		err = c.repairTable(node.ID)
+		if err != nil {
+			c.fanOutError(err)
+		}
+	}
+	if len(sample) < 1 || dead*2 > len(sample) {
+		c.debug("%d of %d Nodes in the routing table didn't respond, joining from scratch.", dead, len(sample))
+		return c.join(address)
+	}
+	err = c.insert(bootstrap, StateMask{Mask: all})
+	if err != nil {
+		return err
+	}
+	return c.announcePresence()
 }
 
 func (c *Cluster) fanOutError(err error) {
@@ -396,35 +1394,61 @@ func (c *Cluster) fanOutError(err error) {
 
 func (c *Cluster) sendHeartbeats() {
 	msg := c.NewMessage(HEARTBEAT, c.self.ID, []byte{})
-	nodes := c.table.list([]int{}, []int{})
-	nodes = append(nodes, c.leafset.list()...)
-	nodes = append(nodes, c.neighborhoodset.list()...)
-	sent := map[NodeID]bool{}
-	for _, node := range nodes {
-		if node == nil {
-			continue
-		}
-		if _, set := sent[node.ID]; set {
-			continue
-		}
+	for _, node := range c.listNodes() {
 		c.debug("Sending heartbeat to %s", node.ID)
 		err := c.send(msg, node)
-		if err == deadNodeError {
+		if _, ok := err.(TimeoutError); ok || err == deadNodeError {
+			if c.heartbeatFailed(node.ID) < c.getFailureThreshold() {
+				c.debug("Heartbeat to %s failed, not removing it yet.", node.ID)
+				continue
+			}
+			c.warn("Node %s failed to respond to %d heartbeats, removing it.", node, c.getFailureThreshold())
+			c.clearHeartbeatFailures(node.ID)
+			c.evicted()
 			err = c.remove(node.ID)
 			if err != nil {
 				c.fanOutError(err)
 			}
 			continue
 		}
-		sent[node.ID] = true
+		c.clearHeartbeatFailures(node.ID)
 	}
+	err := c.repairLeafsetGaps()
+	if err != nil {
+		c.fanOutError(err)
+	}
+}
+
+// heartbeatFailed records a failed heartbeat to the Node, returning the number of consecutive heartbeats to the Node that have failed.
+func (c *Cluster) heartbeatFailed(id NodeID) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.heartbeatFailures[id]++
+	return c.heartbeatFailures[id]
+}
+
+func (c *Cluster) clearHeartbeatFailures(id NodeID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.heartbeatFailures, id)
+}
+
+func (c *Cluster) getFailureThreshold() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.failureThreshold
 }
 
 func (c *Cluster) deliver(msg Message) {
+	if msg.Request {
+		c.onRequest(msg)
+		return
+	}
 	if msg.Purpose <= NODE_ANN {
 		c.warn("Received utility message %s to the deliver function. Purpose was %d.", msg.Key, msg.Purpose)
 		return
 	}
+	c.getMetrics().Delivered(msg.Hop)
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	for _, app := range c.applications {
@@ -434,9 +1458,12 @@ func (c *Cluster) deliver(msg Message) {
 
 func (c *Cluster) handleClient(conn net.Conn) {
 	defer conn.Close()
-	var msg Message
-	decoder := json.NewDecoder(conn)
-	err := decoder.Decode(&msg)
+	msg, err := decodeMessage(conn)
+	if err != nil {
+		c.fanOutError(err)
+		return
+	}
+	msg, err = msg.decompress()
 	if err != nil {
 		c.fanOutError(err)
 		return
@@ -449,21 +1476,25 @@ func (c *Cluster) handleClient(conn net.Conn) {
 		c.warn("Credentials did not match. Supplied credentials: %s", msg.Credentials)
 		return
 	}
-	if msg.Purpose != NODE_JOIN {
+	if (msg.Request || msg.Purpose != NODE_JOIN) && !msg.Sender.IsZero() {
 		node, _ := c.get(msg.Sender.ID)
 		if node != nil {
-			node.updateLastHeardFrom()
+			node.updateLastHeardFrom(c.getClock().Now())
 		}
 	}
-	conn.Write([]byte(`{"status": "Received."}`))
+	conn.Write(ackResponse)
 	c.debug("Got message with purpose %v", msg.Purpose)
 	msg.Hop = msg.Hop + 1
+	if msg.Request {
+		c.onRequestReceived(msg)
+		return
+	}
 	switch msg.Purpose {
 	case NODE_JOIN:
 		c.onNodeJoin(msg)
 		break
 	case NODE_ANN:
-		c.onNodeAnnounce(msg)
+		c.insertAsync(c.onNodeAnnounce, msg)
 		break
 	case NODE_EXIT:
 		c.onNodeExit(msg)
@@ -476,13 +1507,13 @@ func (c *Cluster) handleClient(conn net.Conn) {
 		}
 		break
 	case STAT_DATA:
-		c.onStateReceived(msg)
+		c.insertAsync(c.onStateReceived, msg)
 		break
 	case STAT_REQ:
 		c.onStateRequested(msg)
 		break
 	case NODE_RACE:
-		c.onRaceCondition(msg)
+		c.insertAsync(c.onRaceCondition, msg)
 		break
 	case NODE_REPR:
 		c.onRepairRequest(msg)
@@ -492,45 +1523,134 @@ func (c *Cluster) handleClient(conn net.Conn) {
 	}
 }
 
+// insertAsync handles a Message carrying state tables in a goroutine of its own, rather than in the inbound worker that received it. Inserting the Nodes in the state tables can mean asking them to reach the current Node back, and the reply needs a worker free to receive it; with every worker waiting on a reply, none would arrive.
+func (c *Cluster) insertAsync(handler func(Message), msg Message) {
+	c.inserting.Add(1)
+	go func() {
+		defer c.inserting.Done()
+		handler(msg)
+	}()
+}
+
+// ackResponse is written back to the sender of a Message once the Message has been decoded and its credentials accepted.
+var ackResponse = []byte(`{"status": "Received."}`)
+
 func (c *Cluster) send(msg Message, destination *Node) error {
+	return c.sendContext(context.Background(), msg, destination)
+}
+
+func (c *Cluster) sendContext(ctx context.Context, msg Message, destination *Node) error {
 	if destination == nil {
 		return errors.New("Can't send to a nil node.")
 	}
 	if c.self == nil {
 		return errors.New("Can't send from a nil node.")
 	}
-	address := c.GetIP(*destination)
+	address, err := destination.ReachableFrom(c.self)
+	if err != nil {
+		return err
+	}
 	c.debug("Sending message %s with purpose %d to %s", msg.Key, msg.Purpose, address)
-	start := time.Now()
-	err := c.SendToIP(msg, address)
+	rtt, err := c.sendToIPTimed(ctx, msg, address)
+	if timeout, ok := err.(TimeoutError); ok {
+		timeout.Node = destination.copy()
+		timeout.Key = msg.Key
+		return timeout
+	}
 	if err == nil {
-		proximity := time.Since(start)
-		destination.setProximity(int64(proximity))
-		destination.updateLastHeardFrom()
+		now := c.getClock().Now()
+		// destination may be a copy, so the routing table's own entry for the Node is updated too
+		entry, _ := c.table.getNode(destination.ID)
+		if c.getProximityMeasurer() == nil {
+			sample := int64(rtt)
+			if resampled, err := c.table.resample(destination.ID, sample, c.getProximitySmoothing()); err == nil {
+				entry = resampled
+				if entry != destination {
+					destination.setProximity(entry.getRawProximity())
+				}
+			} else {
+				destination.smoothProximity(sample, c.getProximitySmoothing())
+			}
+		}
+		if entry != nil && entry != destination {
+			entry.updateLastHeardFrom(now)
+		}
+		destination.updateLastHeardFrom(now)
 	}
 	return err
 }
 
 // SendToIP sends a message directly to an IP using the Wendy networking logic.
 func (c *Cluster) SendToIP(msg Message, address string) error {
+	return c.SendToIPContext(context.Background(), msg, address)
+}
+
+// SendToIPContext sends a message directly to an IP, like SendToIP, but gives up and returns the context's error as soon as the context is cancelled or its deadline passes. The network timeout still applies, to each attempt the RetryPolicy allows.
+func (c *Cluster) SendToIPContext(ctx context.Context, msg Message, address string) error {
+	_, err := c.sendToIPTimed(ctx, msg, address)
+	return err
+}
+
+// sendToIPTimed does the work for SendToIPContext, also returning how long the attempt that succeeded took. The attempts that failed, and the waits between them, aren't counted, so retries don't inflate the round trip time.
+func (c *Cluster) sendToIPTimed(ctx context.Context, msg Message, address string) (time.Duration, error) {
+	msg, err := c.compressMessage(msg)
+	if err != nil {
+		return 0, err
+	}
+	var rtt time.Duration
+	err = c.getRetryPolicy().retry(ctx, c.getClock(), func() error {
+		start := time.Now()
+		err := c.sendToIP(ctx, msg, address)
+		rtt = time.Since(start)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rtt, nil
+}
+
+func (c *Cluster) sendToIP(ctx context.Context, msg Message, address string) error {
 	c.debug("Sending message %s", string(msg.Value))
-	conn, err := net.DialTimeout("tcp", address, time.Duration(c.getNetworkTimeout())*time.Second)
+	timeout := c.getNetworkTimeout()
+	conn, err := c.getTransport().Dial(ctx, address, time.Duration(timeout)*time.Second)
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		c.debug(err.Error())
 		return deadNodeError
 	}
 	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(time.Duration(c.getNetworkTimeout()) * time.Second))
-	encoder := json.NewEncoder(conn)
-	err = encoder.Encode(msg)
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	// interrupt any blocked reads or writes if the context is done before the message is acknowledged
+	sent := make(chan struct{})
+	defer close(sent)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-sent:
+		}
+	}()
+	err = encodeMessage(conn, msg)
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
 	c.debug("Sent message %s  with purpose %d to %s", msg.Key, msg.Purpose, address)
-	_, err = conn.Read(nil)
+	// wait for the receiver to acknowledge the message
+	_, err = conn.Read(make([]byte, len(ackResponse)))
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-			return deadNodeError
+			action := "Sending message to " + address
+			c.getMetrics().Timeout(action)
+			return throwTimeout(action, time.Duration(timeout)*time.Second)
 		}
 		if err == io.EOF {
 			err = nil
@@ -544,6 +1664,8 @@ func (c *Cluster) SendToIP(msg Message, address string) error {
 // A node wants to join the cluster. We need to route its message as we normally would, but we should also send it our state tables as appropriate.
 func (c *Cluster) onNodeJoin(msg Message) {
 	c.debug("\033[4;31mNode %s joined!\033[0m", msg.Key)
+	c.joinLock.Lock()
+	defer c.joinLock.Unlock()
 	mask := StateMask{
 		Mask: rT,
 		Rows: []int{},
@@ -576,7 +1698,7 @@ func (c *Cluster) onNodeJoin(msg Message) {
 	}
 	err = c.sendStateTables(msg.Sender, mask, eol)
 	if err != nil {
-		if err != deadNodeError {
+		if !errors.Is(err, deadNodeError) {
 			c.fanOutError(err)
 		}
 	}
@@ -590,6 +1712,13 @@ func (c *Cluster) onNodeJoin(msg Message) {
 // A node has joined the cluster. We need to decide if it belongs in our state tables and if the nodes in the state tables it sends us belong in our state tables. If the version of our state tables it sends to us doesn't match our local version, we need to resend our state tables to prevent a race condition.
 func (c *Cluster) onNodeAnnounce(msg Message) {
 	c.debug("\0333[4;31mNode %s announced its presence!\033[0m", msg.Key)
+	// measuring the Nodes takes up to the network timeout, so it is done before taking the joinLock, rather than holding up every other join
+	candidates, err := c.candidates(msg)
+	if err == nil {
+		candidates = c.measure(candidates)
+	}
+	c.joinLock.Lock()
+	defer c.joinLock.Unlock()
 	conflicts := byte(0)
 	if c.self.leafsetVersion > msg.LSVersion {
 		c.debug("Expected LSVersion %d, got %d", c.self.leafsetVersion, msg.LSVersion)
@@ -612,7 +1741,9 @@ func (c *Cluster) onNodeAnnounce(msg Message) {
 		return
 	}
 	c.debug("No conflicts!")
-	err := c.insertMessage(msg)
+	if err == nil {
+		err = c.insertMeasured(candidates)
+	}
 	if err != nil {
 		c.fanOutError(err)
 	}
@@ -630,6 +1761,19 @@ func (c *Cluster) onNodeExit(msg Message) {
 }
 
 func (c *Cluster) onStateReceived(msg Message) {
+	if !c.isJoined() {
+		if c.joinAbandoned() {
+			c.debug("Ignoring state tables from %s, the join was abandoned.", msg.Sender.ID)
+			return
+		}
+		err := c.checkCollision(msg)
+		if err != nil {
+			c.err("Not joining the cluster: %s", err.Error())
+			c.fanOutError(err)
+			c.finishJoin(err)
+			return
+		}
+	}
 	err := c.insertMessage(msg)
 	if err != nil {
 		c.debug(err.Error())
@@ -644,12 +1788,16 @@ func (c *Cluster) onStateReceived(msg Message) {
 	}
 	c.debug("State received. EOL is %v, isJoined is %v.", state.EOL, c.isJoined())
 	if !c.isJoined() && state.EOL {
+		c.finishJoin(nil)
 		c.debug("Haven't announced presence yet... waiting %d seconds", (2 * c.getNetworkTimeout()))
-		time.Sleep(time.Duration(2*c.getNetworkTimeout()) * time.Second)
-		err = c.announcePresence()
-		if err != nil {
-			c.fanOutError(err)
-		}
+		// wait in another goroutine, so the inbound worker handling this Message is free to handle others in the meantime
+		go func() {
+			<-c.getClock().After(time.Duration(2*c.getNetworkTimeout()) * time.Second)
+			err := c.announcePresence()
+			if err != nil {
+				c.fanOutError(err)
+			}
+		}()
 	} else if !state.EOL {
 		c.debug("Already announced presence.")
 	} else {
@@ -657,6 +1805,38 @@ func (c *Cluster) onStateReceived(msg Message) {
 	}
 }
 
+// checkCollision returns an error wrapping ErrNodeIDCollision if the state tables in the Message, or the Node that sent them, include a Node with the current Node's ID but a different address.
+func (c *Cluster) checkCollision(msg Message) error {
+	var state stateTables
+	err := json.Unmarshal(msg.Value, &state)
+	if err != nil {
+		return err
+	}
+	nodes := []*Node{&msg.Sender}
+	if state.NeighborhoodSet != nil {
+		nodes = append(nodes, state.NeighborhoodSet[:]...)
+	}
+	if state.LeafSet != nil {
+		for _, side := range state.LeafSet {
+			nodes = append(nodes, side[:]...)
+		}
+	}
+	if state.RoutingTable != nil {
+		for _, row := range state.RoutingTable {
+			nodes = append(nodes, row[:]...)
+		}
+	}
+	for _, node := range nodes {
+		if node == nil || !node.ID.Equals(c.self.ID) {
+			continue
+		}
+		if node.LocalIP != c.self.LocalIP || node.GlobalIP != c.self.GlobalIP || node.Port != c.self.Port {
+			return fmt.Errorf("%w: %s is already used by %s.", ErrNodeIDCollision, c.self.ID, node)
+		}
+	}
+	return nil
+}
+
 func (c *Cluster) onStateRequested(msg Message) {
 	c.debug("%s wants to know about my state tables!", msg.Sender.ID)
 	var mask StateMask
@@ -691,6 +1871,31 @@ func (c *Cluster) onRepairRequest(msg Message) {
 	c.sendStateTables(msg.Sender, mask, false)
 }
 
+// onRequestReceived handles a Message with Request set that was received. Checks that the current Node can reach the sender back are answered straight away; other requests, and the responses to them, are routed like any other Message.
+func (c *Cluster) onRequestReceived(msg Message) {
+	switch msg.Purpose {
+	case requestReachBack:
+		c.onReversePing(msg)
+	default:
+		c.onMessageReceived(msg)
+	}
+}
+
+// onReversePing replies to a Node that is checking the current Node can reach it back, sending the reply to the address the Node gave for itself. Replies are passed on to the check that is waiting for them.
+func (c *Cluster) onReversePing(msg Message) {
+	if msg.Response {
+		c.respond(msg)
+		return
+	}
+	resp := c.newRequestMessage(requestReachBack, msg.Sender.ID, []byte{})
+	resp.RequestID = msg.RequestID
+	resp.Response = true
+	err := c.send(resp, &msg.Sender)
+	if err != nil {
+		c.debug("Couldn't reach %s back: %s", msg.Sender.ID, err.Error())
+	}
+}
+
 func (c *Cluster) onMessageReceived(msg Message) {
 	c.debug("Received message %s", msg.Key)
 	err := c.Send(msg)
@@ -729,11 +1934,13 @@ func (c *Cluster) sendStateTables(node Node, tables StateMask, eol bool) error {
 	msg := c.NewMessage(STAT_DATA, c.self.ID, data)
 	target, err := c.get(node.ID)
 	if err != nil {
-		if _, ok := err.(IdentityError); !ok && err != nodeNotFoundError {
+		if _, ok := err.(IdentityError); ok {
+			// a different Node with my ID; it finds out about the collision from the state tables' sender
+			c.warn("Node %s has the same ID as me.", node)
+		} else if err != nodeNotFoundError {
 			return err
-		} else if err == nodeNotFoundError {
-			return c.send(msg, &node)
 		}
+		return c.send(msg, &node)
 	}
 	c.debug("Sending state tables to %s", node.ID)
 	return c.send(msg, target)
@@ -791,7 +1998,8 @@ func (c *Cluster) announcePresence() error {
 		msg.RTVersion = node.routingTableVersion
 		msg.NSVersion = node.neighborhoodSetVersion
 		err := c.send(msg, node)
-		if err == deadNodeError {
+		if errors.Is(err, deadNodeError) {
+			c.evicted()
 			err = c.remove(node.ID)
 			if err != nil {
 				c.fanOutError(err)
@@ -801,16 +2009,40 @@ func (c *Cluster) announcePresence() error {
 		sent[node.ID] = true
 	}
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	joined := c.joined
 	c.joined = true
+	c.lock.Unlock()
+	if !joined {
+		go c.reprobe()
+	}
 	return nil
 }
 
+// reprobe asks the Nodes in the leaf set for their leaf sets once the joins that were in flight when the current Node joined have had time to finish. Nodes that joined at the same time as the current Node aren't in the state tables it joined with, so this is how the current Node learns of them.
+func (c *Cluster) reprobe() {
+	<-c.getClock().After(time.Duration(2*c.getNetworkTimeout()) * time.Second)
+	mask := StateMask{Mask: lS}
+	data, err := json.Marshal(mask)
+	if err != nil {
+		c.fanOutError(err)
+		return
+	}
+	msg := c.NewMessage(STAT_REQ, c.self.ID, data)
+	for _, node := range c.leafset.list() {
+		c.debug("Asking %s for its leaf set.", node)
+		err = c.send(msg, node)
+		if err != nil {
+			c.fanOutError(err)
+		}
+	}
+}
+
 func (c *Cluster) repairLeafset(id NodeID) error {
 	target, err := c.leafset.getNextNode(id)
 	if err != nil {
 		if err == nodeNotFoundError {
 			c.warn("No node found when trying to repair the leafset. Was there a catastrophe?")
+			return nil
 		} else {
 			return err
 		}
@@ -821,13 +2053,56 @@ func (c *Cluster) repairLeafset(id NodeID) error {
 		return err
 	}
 	msg := c.NewMessage(NODE_REPR, id, data)
+	c.info("Asking %s to help repair the leaf set.", target)
+	return c.send(msg, target)
+}
+
+// repairLeafsetGaps asks for help filling the side of the leaf set that has a gap in it, if the other side is full. A gap is normally repaired as soon as the Node that left it is removed, but the repair can fail. If neither side is full, the Cluster is too small to fill the leaf set, and there is nothing to repair.
+func (c *Cluster) repairLeafsetGaps() error {
+	size := c.leafset.size()
+	left, right := c.leafset.leftCount(), c.leafset.rightCount()
+	side, filled := 0, 0
+	if left < size && right == size {
+		side, filled = -1, left
+	} else if right < size && left == size {
+		side, filled = 1, right
+	} else {
+		return nil
+	}
+	target, err := c.leafset.furthest(side)
+	if err != nil {
+		return err
+	}
+	mask := StateMask{Mask: lS}
+	data, err := json.Marshal(mask)
+	if err != nil {
+		return err
+	}
+	msg := c.NewMessage(NODE_REPR, c.self.ID, data)
+	c.info("Only %d of %d slots on side %d of the leaf set are filled, asking %s to help repair it.", filled, size, side, target)
 	return c.send(msg, target)
 }
 
 func (c *Cluster) repairTable(id NodeID) error {
 	row := c.self.ID.CommonPrefixLen(id)
+	if row >= IDDigits {
+		// the current Node has no cell in its own routing table
+		return throwIdentityError("repair", "in", "routing table")
+	}
 	reqRow := row
-	col := int(id.Digit(row))
+	digit, err := id.Digit(row)
+	if err != nil {
+		return err
+	}
+	col := int(digit)
+	// a Node in the neighborhood set that belongs in the cell can fill it without asking anyone
+	if node := c.tableReplacement(id); node != nil {
+		_, err = c.table.insertNode(*node, node.getRawProximity())
+		if err == nil || err == rtDuplicateInsertError {
+			c.debug("Repaired row %d, column %d of the routing table with %s from the neighborhood set.", reqRow, col, node)
+			return nil
+		}
+	}
 	targets := []*Node{}
 	for len(targets) < 1 && row < len(c.table.nodes) {
 		targets = c.table.list([]int{row}, []int{})
@@ -842,6 +2117,7 @@ func (c *Cluster) repairTable(id NodeID) error {
 	}
 	msg := c.NewMessage(NODE_REPR, c.self.ID, data)
 	for _, target := range targets {
+		c.info("Asking %s to help repair row %d, column %d of the routing table.", target, reqRow, col)
 		err = c.send(msg, target)
 		if err != nil {
 			return err
@@ -850,6 +2126,42 @@ func (c *Cluster) repairTable(id NodeID) error {
 	return nil
 }
 
+// tableReplacement returns a Node in the neighborhood set that belongs in the same cell of the routing table as the Node with the ID, to take its place, or nil if there is none. The Nodes in the neighborhood set are known to be alive and close, so they make good replacements.
+func (c *Cluster) tableReplacement(id NodeID) *Node {
+	row := c.self.ID.CommonPrefixLen(id)
+	if row >= IDDigits {
+		return nil
+	}
+	col, err := id.Digit(row)
+	if err != nil {
+		return nil
+	}
+	for _, node := range c.neighborhoodset.list() {
+		if node.ID.Equals(id) || c.self.ID.CommonPrefixLen(node.ID) != row {
+			continue
+		}
+		if d, err := node.ID.Digit(row); err == nil && d == col {
+			return node
+		}
+	}
+	return nil
+}
+
+// removeFromTable removes the Node with the ID from the routing table, returning it. If the neighborhood set has a Node to take its place, the two are swapped in one step, so the cell is never left empty, and true is returned to say the cell needs no repair.
+func (c *Cluster) removeFromTable(id NodeID) (*Node, bool, error) {
+	if replacement := c.tableReplacement(id); replacement != nil {
+		if old, err := c.table.getNode(id); err == nil {
+			existed, err := c.table.replace(id, *replacement)
+			if err == nil && existed {
+				c.debug("Replaced %s in the routing table with %s from the neighborhood set.", id, replacement.ID)
+				return old, true, nil
+			}
+		}
+	}
+	removed, err := c.table.removeNode(id)
+	return removed, false, err
+}
+
 func (c *Cluster) repairNeighborhood() error {
 	targets := c.neighborhoodset.list()
 	mask := StateMask{Mask: nS}
@@ -859,6 +2171,7 @@ func (c *Cluster) repairNeighborhood() error {
 	}
 	msg := c.NewMessage(NODE_REPR, c.self.ID, data)
 	for _, target := range targets {
+		c.info("Asking %s to help repair the neighborhood set.", target)
 		err = c.send(msg, target)
 		if err != nil {
 			return err
@@ -868,159 +2181,272 @@ func (c *Cluster) repairNeighborhood() error {
 }
 
 func (c *Cluster) updateProximity(node *Node) error {
+	measurer := c.getProximityMeasurer()
 	proximity := c.getCachedProximity(node.ID)
-	if proximity < 0 {
-		msg := c.NewMessage(HEARTBEAT, c.self.ID, []byte{})
+	sampled := proximity < 0
+	if sampled {
 		c.debug("Checking proximity to %s", node.ID)
-		err := c.send(msg, node)
+		if measurer != nil {
+			measured, err := measurer.Measure(*node)
+			if err != nil {
+				return err
+			}
+			proximity = measured
+		} else {
+			rtt, err := c.Ping(*node)
+			if err != nil {
+				return err
+			}
+			proximity = int64(rtt)
+		}
+	}
+	if measurer == nil {
+		// the Node answered, or did recently, but may not be able to send anything to the current Node
+		err := c.checkReachableBack(*node)
 		if err != nil {
 			return err
 		}
-		c.debug("Proximity to %s checked.", node.ID)
-		c.cacheProximity(node.ID, node.getRawProximity())
-		c.debug("Proximity to %s cached.", node.ID)
 	}
+	if sampled {
+		// a Node already in the routing table has its new sample folded into the proximity it was known by
+		if known, err := c.table.getNode(node.ID); err == nil {
+			node.setProximity(known.getRawProximity())
+		}
+		node.smoothProximity(proximity, c.getProximitySmoothing())
+	} else {
+		node.setProximity(proximity)
+	}
+	c.debug("Proximity to %s checked.", node.ID)
+	c.cacheProximity(node.ID, node.getRawProximity())
+	c.debug("Proximity to %s cached.", node.ID)
 	return nil
 }
 
+// checkReachableBack asks the Node to send a Message back to the current Node, and waits up to the network timeout for it to arrive. A Node behind a NAT or firewall may be reachable without being able to reach the current Node, and Messages routed through it would be lost; noReachBackError is returned for those Nodes.
+func (c *Cluster) checkReachableBack(node Node) error {
+	id, response := c.newRequest()
+	defer c.endRequest(id)
+	msg := c.newRequestMessage(requestReachBack, node.ID, []byte{})
+	msg.RequestID = id
+	err := c.send(msg, &node)
+	if err != nil {
+		c.debug("Couldn't ask %s to reach me back: %s", node.ID, err.Error())
+		return noReachBackError
+	}
+	select {
+	case <-response:
+		return nil
+	case <-c.getClock().After(time.Duration(c.getNetworkTimeout()) * time.Second):
+		c.debug("%s didn't reach me back within %d seconds.", node.ID, c.getNetworkTimeout())
+		return noReachBackError
+	}
+}
+
 func (c *Cluster) insertMessage(msg Message) error {
+	candidates, err := c.candidates(msg)
+	if err != nil {
+		return err
+	}
+	return c.insertMeasured(c.measure(candidates))
+}
+
+// candidate is a Node the current Node has learned of, and the state tables it should be inserted into.
+type candidate struct {
+	node        Node
+	tables      StateMask
+	measured    bool // whether measure measured the Node's proximity; only Nodes whose proximity was measured go into the routing table
+	unreachable bool // whether the current Node can't reach the Node, e.g., because it is in another Region and has no GlobalIP; its proximity can't be measured
+}
+
+// candidates returns the sender of a Message carrying state tables, and the Nodes in those state tables, each with the tables it should be inserted into. A Node listed more than once is returned once, to be inserted into every table it was listed for.
+func (c *Cluster) candidates(msg Message) ([]candidate, error) {
 	var state stateTables
 	err := json.Unmarshal(msg.Value, &state)
 	if err != nil {
 		c.debug("Error unmarshalling JSON: %s", err.Error())
-		return err
+		return nil, err
 	}
-	sender := &msg.Sender
+	sender := msg.Sender
 	c.debug("Updating versions for %s. RT: %d, LS: %d, NS: %d.", sender.ID.String(), msg.RTVersion, msg.LSVersion, msg.NSVersion)
 	sender.updateVersions(msg.RTVersion, msg.LSVersion, msg.NSVersion)
-	err = c.insert(*sender, StateMask{Mask: all})
-	if err != nil {
-		return err
+	candidates := []candidate{{node: sender, tables: StateMask{Mask: all}}}
+	seen := map[NodeID]int{sender.ID: 0}
+	add := func(node *Node, mask byte) {
+		if node == nil {
+			return
+		}
+		if i, ok := seen[node.ID]; ok {
+			candidates[i].tables.Mask |= mask
+			return
+		}
+		seen[node.ID] = len(candidates)
+		candidates = append(candidates, candidate{node: *node, tables: StateMask{Mask: mask}})
 	}
 	if state.NeighborhoodSet != nil {
 		for _, node := range state.NeighborhoodSet {
-			if node == nil {
-				continue
-			}
-			err = c.insert(*node, StateMask{Mask: nS})
-			if err != nil {
-				return err
-			}
+			add(node, nS)
 		}
 	}
 	if state.LeafSet != nil {
 		for _, side := range state.LeafSet {
 			for _, node := range side {
-				if node == nil {
-					continue
-				}
-				err = c.insert(*node, StateMask{Mask: lS | nS})
-				if err != nil {
-					return err
-				}
+				add(node, lS|nS)
 			}
 		}
 	}
 	if state.RoutingTable != nil {
 		for _, row := range state.RoutingTable {
 			for _, node := range row {
-				if node == nil {
-					continue
-				}
-				err = c.insert(*node, StateMask{Mask: rT | nS})
-				if err != nil {
-					return err
-				}
+				add(node, rT|nS)
 			}
 		}
 	}
-	return nil
+	return candidates, nil
 }
 
 func (c *Cluster) insert(node Node, tables StateMask) error {
-	if node.IsZero() {
-		return nil
-	}
-	if node.ID.Equals(c.self.ID) {
-		c.debug("Skipping inserting myself.")
-		return nil
-	}
-	c.debug("Inserting node %s", node.ID)
-	if node.getRawProximity() <= 0 && (tables.includeNS() || tables.includeRT()) {
-		c.debug("Updating proximity")
-		c.updateProximity(&node)
-		c.debug("Updated proximity")
-		c.debug("Inserting node %s in routing table.", node.ID)
-		resp, err := c.table.insertNode(node, node.getRawProximity())
-		if err != nil && err != rtDuplicateInsertError {
-			c.err("Error inserting node: %s", err.Error())
+	if !node.IsZero() {
+		if err := node.Validate(); err != nil {
 			return err
 		}
-		if resp != nil && err != rtDuplicateInsertError {
-			c.debug("Inserted node %s in routing table.", resp.ID)
+	}
+	return c.insertMeasured(c.measure([]candidate{{node: node, tables: tables}}))
+}
+
+// measure drops the candidates that can't be inserted, like the current Node or a Node with a malformed address, keeps the Nodes the current Node can't reach out of the routing table, and measures the proximity of those going into the routing table or neighborhood set whose proximity isn't known yet. The proximities are measured concurrently, so state tables listing several Nodes that don't answer, or can't reach the current Node back, take as long as the slowest of them to measure rather than all of them put together. Candidates that can't reach the current Node back are dropped too.
+func (c *Cluster) measure(candidates []candidate) []candidate {
+	kept := make([]candidate, 0, len(candidates))
+	for _, cand := range candidates {
+		node := cand.node
+		if node.IsZero() {
+			continue
+		}
+		if node.ID.Equals(c.self.ID) {
+			c.debug("Skipping inserting myself.")
+			continue
 		}
-		if err == rtDuplicateInsertError {
-			c.debug(err.Error())
+		if err := node.Validate(); err != nil {
+			c.warn("Not inserting node: %s", err.Error())
+			continue
 		}
-	}
-	if tables.includeLS() {
-		c.debug("Inserting node %s in leaf set.", node.ID)
-		resp, err := c.leafset.insertNode(node)
-		if err != nil && err != lsDuplicateInsertError {
-			return err
+		if _, err := node.ReachableFrom(c.self); err != nil {
+			// Messages can't be routed through a Node the current Node can't reach, but it still belongs in the leaf set
+			c.debug("Not inserting node %s in routing table: %s", node.ID, err.Error())
+			cand.tables.Mask &^= rT
+			cand.unreachable = true
 		}
-		if resp != nil && err != lsDuplicateInsertError {
-			c.debug("Inserted node %s in leaf set.", resp.ID)
-			c.newLeaves(c.leafset.list())
+		kept = append(kept, cand)
+	}
+	unreachable := make([]bool, len(kept))
+	var measuring sync.WaitGroup
+	for i := range kept {
+		if kept[i].unreachable || kept[i].node.getRawProximity() > 0 || !(kept[i].tables.includeNS() || kept[i].tables.includeRT()) {
+			continue
 		}
-		c.debug("At the end of the leafset insert block.")
-		if err == lsDuplicateInsertError {
-			c.debug(err.Error())
+		kept[i].measured = true
+		measuring.Add(1)
+		go func(i int) {
+			defer measuring.Done()
+			c.debug("Updating proximity")
+			if err := c.updateProximity(&kept[i].node); err == noReachBackError {
+				unreachable[i] = true
+			}
+			c.debug("Updated proximity")
+		}(i)
+	}
+	measuring.Wait()
+	measured := make([]candidate, 0, len(kept))
+	for i, cand := range kept {
+		if unreachable[i] {
+			c.warn("Not inserting node %s: %s", cand.node.ID, noReachBackError.Error())
+			continue
 		}
+		measured = append(measured, cand)
 	}
-	if tables.includeNS() {
-		c.debug("Inserting node %s in neighborhood set.", node.ID)
-		resp, err := c.neighborhoodset.insertNode(node, node.getRawProximity())
-		if err != nil && err != nsDuplicateInsertError {
-			return err
+	return measured
+}
+
+// insertMeasured inserts candidates returned by measure into the state tables they belong in. The candidates going into the routing table are inserted in one batch.
+func (c *Cluster) insertMeasured(candidates []candidate) error {
+	batch := []Node{}
+	for _, cand := range candidates {
+		if cand.measured {
+			batch = append(batch, cand.node)
 		}
-		if resp != nil && err != nsDuplicateInsertError {
-			c.debug("Inserted node %s in neighborhood set.", resp.ID)
+	}
+	if len(batch) > 0 {
+		c.debug("Inserting %d nodes in routing table.", len(batch))
+		inserted := c.table.insertBatch(batch)
+		c.debug("Inserted %d nodes in routing table.", inserted)
+	}
+	for _, cand := range candidates {
+		node, tables := cand.node, cand.tables
+		c.debug("Inserting node %s", node.ID)
+		if tables.includeLS() {
+			c.debug("Inserting node %s in leaf set.", node.ID)
+			resp, err := c.leafset.insertNode(node)
+			if err != nil && err != lsDuplicateInsertError && err != lsFullError {
+				return err
+			}
+			if resp != nil && err != lsDuplicateInsertError {
+				c.debug("Inserted node %s in leaf set.", resp.ID)
+				c.newLeaves()
+			}
+			c.debug("At the end of the leafset insert block.")
+			if err == lsDuplicateInsertError || err == lsFullError {
+				c.debug(err.Error())
+			}
 		}
-		if err == nsDuplicateInsertError {
-			c.debug(err.Error())
+		if tables.includeNS() {
+			c.debug("Inserting node %s in neighborhood set.", node.ID)
+			resp, err := c.neighborhoodset.insertNode(node, node.getRawProximity())
+			if err != nil && err != nsDuplicateInsertError && err != nsFullError {
+				return err
+			}
+			if resp != nil && err != nsDuplicateInsertError {
+				c.debug("Inserted node %s in neighborhood set.", resp.ID)
+			}
+			if err == nsDuplicateInsertError || err == nsFullError {
+				c.debug(err.Error())
+			}
 		}
 	}
 	return nil
 }
 
 func (c *Cluster) remove(id NodeID) error {
-	resp, err := c.table.removeNode(id)
-	if err != nil {
+	tableResp, replaced, err := c.removeFromTable(id)
+	if err != nil && err != nodeNotFoundError {
 		return err
 	}
-	if resp != nil {
-		err = c.repairTable(resp.ID)
-		if err != nil {
-			return err
-		}
+	leafResp, err := c.leafset.removeNode(id)
+	if err != nil && err != nodeNotFoundError {
+		return err
 	}
-	resp, err = c.leafset.removeNode(id)
-	if err != nil {
+	neighborhoodResp, err := c.neighborhoodset.removeNode(id)
+	if err != nil && err != nodeNotFoundError {
 		return err
 	}
-	if resp != nil {
-		err = c.repairLeafset(resp.ID)
+	for _, resp := range []*Node{tableResp, leafResp, neighborhoodResp} {
+		if resp != nil {
+			c.fanOutExit(*resp.copy())
+			break
+		}
+	}
+	if tableResp != nil && !replaced {
+		err = c.repairTable(tableResp.ID)
 		if err != nil {
 			return err
 		}
-		c.newLeaves(c.leafset.list())
 	}
-	resp, err = c.neighborhoodset.removeNode(id)
-	if err != nil {
-		return err
+	if leafResp != nil {
+		c.newLeaves()
+		err = c.repairLeafset(leafResp.ID)
+		if err != nil {
+			return err
+		}
 	}
-	if resp != nil {
+	if neighborhoodResp != nil {
 		err = c.repairNeighborhood()
 		if err != nil {
 			return err
@@ -1029,6 +2455,23 @@ func (c *Cluster) remove(id NodeID) error {
 	return nil
 }
 
+// listNodes returns every Node in the state tables, without duplicates.
+func (c *Cluster) listNodes() []*Node {
+	nodes := c.table.list([]int{}, []int{})
+	nodes = append(nodes, c.leafset.list()...)
+	nodes = append(nodes, c.neighborhoodset.list()...)
+	seen := map[NodeID]bool{}
+	result := []*Node{}
+	for _, node := range nodes {
+		if node == nil || node.isZero() || seen[node.ID] {
+			continue
+		}
+		seen[node.ID] = true
+		result = append(result, node)
+	}
+	return result
+}
+
 func (c *Cluster) get(id NodeID) (*Node, error) {
 	node, err := c.neighborhoodset.getNode(id)
 	if err == nodeNotFoundError {
@@ -1044,18 +2487,24 @@ func (c *Cluster) get(id NodeID) (*Node, error) {
 
 func (c *Cluster) debug(format string, v ...interface{}) {
 	if c.logLevel <= LogLevelDebug {
-		c.log.Printf(format, v...)
+		c.log.Debugf(format, v...)
+	}
+}
+
+func (c *Cluster) info(format string, v ...interface{}) {
+	if c.logLevel <= LogLevelInfo {
+		c.log.Infof(format, v...)
 	}
 }
 
 func (c *Cluster) warn(format string, v ...interface{}) {
 	if c.logLevel <= LogLevelWarn {
-		c.log.Printf(format, v...)
+		c.log.Warnf(format, v...)
 	}
 }
 
 func (c *Cluster) err(format string, v ...interface{}) {
 	if c.logLevel <= LogLevelError {
-		c.log.Printf(format, v...)
+		c.log.Errorf(format, v...)
 	}
 }
@@ -1,6 +1,20 @@
 package wendy
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"math/rand"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -79,21 +93,320 @@ func (t *testCallback) OnHeartbeat(node Node) {
 	}
 }
 
+type testMeasurer map[NodeID]int64
+
+func (m testMeasurer) Measure(node Node) (int64, error) {
+	if proximity, ok := m[node.ID]; ok {
+		return proximity, nil
+	}
+	return -1, nodeNotFoundError
+}
+
+// testLogger is a Logger that keeps every line written to it
+type testLogger struct {
+	lines []string
+	lock  *sync.Mutex
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{lock: new(sync.Mutex)}
+}
+
+func (l *testLogger) Debugf(format string, v ...interface{}) {
+	l.printf(format, v...)
+}
+
+func (l *testLogger) Infof(format string, v ...interface{}) {
+	l.printf(format, v...)
+}
+
+func (l *testLogger) Warnf(format string, v ...interface{}) {
+	l.printf(format, v...)
+}
+
+func (l *testLogger) Errorf(format string, v ...interface{}) {
+	l.printf(format, v...)
+}
+
+func (l *testLogger) printf(format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// contains returns true if a single line written to the testLogger contains all the substrings
+func (l *testLogger) contains(substrs ...string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, line := range l.lines {
+		found := true
+		for _, substr := range substrs {
+			if !strings.Contains(line, substr) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// errorCallback is a testCallback that reports errors on a channel instead of failing the test
+type errorCallback struct {
+	*testCallback
+	errors chan error
+}
+
+func (e *errorCallback) OnError(err error) {
+	select {
+	case e.errors <- err:
+	default:
+	}
+}
+
+// rewritingCallback is a testCallback that changes the Value of every Message it forwards
+type rewritingCallback struct {
+	*testCallback
+	value []byte
+}
+
+func (r *rewritingCallback) OnForward(msg *Message, next NodeID) bool {
+	r.testCallback.OnForward(msg, next)
+	msg.Value = r.value
+	return true
+}
+
+// concurrencyCallback is a testCallback that records how many Messages are being delivered at once, holding each delivery until release is closed
+type concurrencyCallback struct {
+	*testCallback
+	lock      sync.Mutex
+	active    int
+	max       int
+	delivered int
+	started   chan struct{}
+	release   chan struct{}
+}
+
+func (c *concurrencyCallback) OnDeliver(msg Message) {
+	c.lock.Lock()
+	c.active++
+	if c.active > c.max {
+		c.max = c.active
+	}
+	c.lock.Unlock()
+	select {
+	case c.started <- struct{}{}:
+	default:
+	}
+	<-c.release
+	c.lock.Lock()
+	c.active--
+	c.delivered++
+	c.lock.Unlock()
+	c.testCallback.OnDeliver(msg)
+}
+
+// fakeClock is a Clock that only moves when it is advanced
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{deadline: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// advance moves the clock forward, firing every channel returned by After whose duration has passed
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	waiting := []fakeWaiter{}
+	for _, waiter := range c.waiters {
+		if waiter.deadline.After(c.now) {
+			waiting = append(waiting, waiter)
+			continue
+		}
+		waiter.ch <- c.now
+	}
+	c.waiters = waiting
+}
+
+// wait blocks until at least n channels returned by After are waiting to fire
+func (c *fakeClock) wait(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.lock.Lock()
+		waiting := len(c.waiters)
+		c.lock.Unlock()
+		if waiting >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting on %d timers.", n)
+}
+
 func makeCluster(idBytes string) (*Cluster, error) {
 	id, err := NodeIDFromBytes([]byte(idBytes))
 	if err != nil {
 		return nil, err
 	}
+	return makeClusterWithID(id), nil
+}
+
+func makeClusterWithID(id NodeID) *Cluster {
 	node := NewNode(id, "127.0.0.1", "127.0.0.1", "testing", 0)
 	cluster := NewCluster(node, nil)
 	cluster.SetHeartbeatFrequency(10)
 	cluster.SetNetworkTimeout(1)
 	cluster.SetLogLevel(LogLevelDebug)
-	return cluster, nil
+	return cluster
 }
 
-// Test joining two nodes
-func TestClusterJoinTwo(t *testing.T) {
+// startListening starts the Cluster listening in another goroutine, and waits until its port is bound, so the port can be read safely. The test fails if Listen returns before then.
+func startListening(t *testing.T, cluster *Cluster) {
+	failed := make(chan error, 1)
+	go func() {
+		failed <- cluster.Listen()
+	}()
+	select {
+	case <-cluster.Ready():
+	case err := <-failed:
+		t.Fatalf("Listen returned before binding a port: %v", err)
+	}
+}
+
+// Test that a message that is never acknowledged returns a TimeoutError
+func TestClusterSendTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// never acknowledge the message
+		time.Sleep(3 * time.Second)
+	}()
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.SetLogLevel(LogLevelError)
+	metrics := NewCountingMetrics()
+	one.SetMetrics(metrics)
+	msg := one.NewMessage(HEARTBEAT, one.self.ID, []byte{})
+	err = one.SendToIP(msg, ln.Addr().String())
+	timeout, ok := err.(TimeoutError)
+	if !ok {
+		t.Fatalf("Expected TimeoutError, got %v.", err)
+	}
+	if timeout.Timeout != time.Second {
+		t.Errorf("Expected timeout of 1 second, got %s.", timeout.Timeout)
+	}
+	if timeouts := metrics.Timeouts(); timeouts != 1 {
+		t.Errorf("Expected %d timeout to be counted, got %d.", 1, timeouts)
+	}
+}
+
+// Test that a message to a Node that never acknowledges it returns a TimeoutError naming the Node and the Message's key
+func TestClusterSendTimeoutNode(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// never acknowledge the message
+		time.Sleep(3 * time.Second)
+	}()
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.SetLogLevel(LogLevelError)
+	addr := ln.Addr().(*net.TCPAddr)
+	slow := NewNode(NodeIDWithPrefix(2), "127.0.0.1", "127.0.0.1", "testing", addr.Port)
+	key := NodeIDWithPrefix(2, 1)
+	err = one.send(one.NewMessage(NODE_ANN+1, key, []byte{}), slow)
+	timeout, ok := err.(TimeoutError)
+	if !ok {
+		t.Fatalf("Expected TimeoutError, got %v.", err)
+	}
+	if timeout.Node == nil || !timeout.Node.ID.Equals(slow.ID) {
+		t.Errorf("Expected the TimeoutError to name %s, got %v.", slow.ID, timeout.Node)
+	}
+	if !timeout.Key.Equals(key) {
+		t.Errorf("Expected the TimeoutError to have key %s, got %s.", key, timeout.Key)
+	}
+	if !strings.Contains(timeout.Error(), slow.ID.String()) {
+		t.Errorf("Expected the error to mention %s, got %q.", slow.ID, timeout.Error())
+	}
+}
+
+// Test that inserting the current node into the cluster's state tables is a no-op
+func TestClusterInsertSelf(t *testing.T) {
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = one.insert(*one.self, StateMask{Mask: all})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if nodes := one.listNodes(); len(nodes) != 0 {
+		t.Errorf("Expected %d nodes in the state tables, got %d.", 0, len(nodes))
+	}
+	if one.self.routingTableVersion != 0 || one.self.leafsetVersion != 0 || one.self.neighborhoodSetVersion != 0 {
+		t.Errorf("Expected state table versions to be unchanged, got %d, %d and %d.", one.self.routingTableVersion, one.self.leafsetVersion, one.self.neighborhoodSetVersion)
+	}
+	target, err := one.Route(one.self.ID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if target != nil {
+		t.Errorf("Expected a message for the current node to be delivered locally, got %s.", target.ID)
+	}
+}
+
+// Test pinging a node that is listening and one that isn't
+func TestClusterPing(t *testing.T) {
 	if testing.Short() {
 		return
 	}
@@ -101,245 +414,2010 @@ func TestClusterJoinTwo(t *testing.T) {
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	one.debug("One is %s", one.self.ID)
-	oneCB := newTestCallback(t)
-	one.RegisterCallback(oneCB)
 	two, err := makeCluster("this is some other Node for testing purposes only.")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	two.debug("Two is %s", two.self.ID)
 	twoCB := newTestCallback(t)
 	two.RegisterCallback(twoCB)
-	go func() {
-		defer one.Kill()
-		err := one.Listen()
-		if err != nil {
-			t.Fatalf(err.Error())
+	startListening(t, two)
+	defer two.Kill()
+	rtt, err := one.Ping(*two.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if rtt <= 0 {
+		t.Errorf("Expected a positive round trip time, got %s.", rtt)
+	}
+	select {
+	case node := <-twoCB.onHeartbeat:
+		if !node.ID.Equals(one.self.ID) {
+			t.Errorf("Expected heartbeat from %s, got one from %s.", one.self.ID, node.ID)
 		}
-	}()
+	case <-time.After(1 * time.Second):
+		t.Errorf("Expected the ping to be received as a heartbeat.")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// close the listener straight away so nothing is listening on the port
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	dead := *two.self
+	dead.Port = port
+	_, err = one.Ping(dead)
+	if err != deadNodeError {
+		t.Errorf("Expected deadNodeError pinging a node that isn't listening, got %v.", err)
+	}
+}
+
+// Test that cancelling the context while waiting on an acknowledgement returns the context's error rather than a TimeoutError
+func TestClusterSendContextCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ln.Close()
 	go func() {
-		defer two.Kill()
-		err := two.Listen()
+		conn, err := ln.Accept()
 		if err != nil {
-			t.Fatalf(err.Error())
+			return
 		}
+		defer conn.Close()
+		// never acknowledge the message
+		time.Sleep(3 * time.Second)
 	}()
-	time.Sleep(2 * time.Millisecond)
-	err = two.Join(one.self.LocalIP, one.self.Port)
+	one, err := makeCluster("this is a test Node for testing purposes only.")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	ticker := time.NewTicker(3 * time.Duration(one.getNetworkTimeout()) * time.Second)
-	defer ticker.Stop()
-	select {
-	case <-ticker.C:
-		t.Fatalf("Timeout waiting on join. Waited %d seconds.", 3*one.getNetworkTimeout())
-		return
-	case <-oneCB.onNodeJoin:
-		_, err = one.table.getNode(two.self.ID)
-		if err != nil {
-			t.Fatalf(err.Error())
-		}
-		_, err = two.table.getNode(one.self.ID)
-		if err != nil {
-			t.Fatalf(err.Error())
+	one.SetLogLevel(LogLevelError)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	msg := one.NewMessage(HEARTBEAT, one.self.ID, []byte{})
+	err = one.SendToIPContext(ctx, msg, ln.Addr().String())
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v.", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Duration(one.getNetworkTimeout())*time.Second {
+		t.Errorf("Expected send to return as soon as the context was cancelled, took %s.", elapsed)
+	}
+	err = one.SendContext(ctx, msg)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled from a cancelled context, got %v.", err)
+	}
+}
+
+// Test that a snapshot of the cluster's state doesn't change as nodes are inserted concurrently
+func TestClusterState(t *testing.T) {
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.SetLogLevel(LogLevelError)
+	insert := func(start, end int) {
+		for i := start; i < end; i++ {
+			node := NewNode(HashToNodeID([]byte(strconv.Itoa(i))), "127.0.0.2", "127.0.0.2", "testing", 55555)
+			// later nodes are closer, so they displace earlier ones
+			node.setProximity(int64(1000 - i))
+			one.insert(*node, StateMask{Mask: all})
 		}
-		_, err = one.leafset.getNode(two.self.ID)
+	}
+	insert(0, 50)
+	state := one.State()
+	if !state.Self.ID.Equals(one.self.ID) {
+		t.Errorf("Expected snapshot of %s, got %s.", one.self.ID, state.Self.ID)
+	}
+	if len(state.LeafSet) == 0 || len(state.NeighborhoodSet) == 0 {
+		t.Fatalf("Expected nodes in the snapshot, got %d in the leaf set and %d in the neighborhood set.", len(state.LeafSet), len(state.NeighborhoodSet))
+	}
+	reference := one.State()
+	done := make(chan bool)
+	go func() {
+		insert(50, 150)
+		done <- true
+	}()
+	for i := 0; i < 10; i++ {
+		one.State()
+	}
+	<-done
+	if !reflect.DeepEqual(state, reference) {
+		t.Errorf("Expected snapshot not to change as nodes were inserted.")
+	}
+	if reflect.DeepEqual(one.State(), reference) {
+		t.Errorf("Expected a new snapshot to include the nodes inserted since.")
+	}
+}
+
+// Test that removing a node evicts it from every state table, even those it was never inserted into
+func TestClusterRemove(t *testing.T) {
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.SetLogLevel(LogLevelError)
+	id, err := NodeIDFromBytes([]byte("this is some other Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	other := NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+	_, err = one.leafset.insertNode(*other)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = one.neighborhoodset.insertNode(*other, 1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = one.remove(id)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = one.leafset.getNode(id); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError from leaf set, got %v.", err)
+	}
+	if _, err = one.neighborhoodset.getNode(id); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError from neighborhood set, got %v.", err)
+	}
+}
+
+// Test that a custom ProximityMeasurer is used when inserting newly learned nodes
+func TestClusterProximityMeasurer(t *testing.T) {
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.SetLogLevel(LogLevelError)
+	near := NewNode(NodeID{1, 1}, "127.0.0.2", "127.0.0.2", "testing", 55555)
+	far := NewNode(NodeID{2, 2}, "127.0.0.3", "127.0.0.3", "testing", 55555)
+	one.SetProximityMeasurer(testMeasurer{near.ID: 10, far.ID: 20})
+	for _, node := range []*Node{far, near} {
+		err = one.insert(*node, StateMask{Mask: nS})
 		if err != nil {
 			t.Fatalf(err.Error())
 		}
-		_, err = two.leafset.getNode(one.self.ID)
-		if err != nil {
-			t.Fatalf(err.Error())
+	}
+	nodes := one.neighborhoodset.list()
+	if len(nodes) != 2 {
+		t.Fatalf("Expected 2 nodes in the neighborhood set, got %d.", len(nodes))
+	}
+	if !nodes[0].ID.Equals(near.ID) || nodes[0].getRawProximity() != 10 {
+		t.Errorf("Expected %s with proximity 10 first, got %s with proximity %d.", near.ID, nodes[0].ID, nodes[0].getRawProximity())
+	}
+	if !nodes[1].ID.Equals(far.ID) || nodes[1].getRawProximity() != 20 {
+		t.Errorf("Expected %s with proximity 20 second, got %s with proximity %d.", far.ID, nodes[1].ID, nodes[1].getRawProximity())
+	}
+	if proximity := one.getCachedProximity(near.ID); proximity != 10 {
+		t.Errorf("Expected cached proximity of 10, got %d.", proximity)
+	}
+}
+
+// Test that two listening nodes can exchange a heartbeat over the network
+func TestClusterHeartbeat(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	oneCB := newTestCallback(t)
+	one.RegisterCallback(oneCB)
+	two, err := makeCluster("this is some other Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	startListening(t, one)
+	defer one.Kill()
+	_, err = two.table.insertNode(*one.self, -1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	peer, err := two.table.getNode(one.self.ID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	msg := two.NewMessage(HEARTBEAT, two.self.ID, []byte{})
+	err = two.send(msg, peer)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	select {
+	case node := <-oneCB.onHeartbeat:
+		if !node.ID.Equals(two.self.ID) {
+			t.Errorf("Expected heartbeat from %s, got one from %s.", two.self.ID, node.ID)
 		}
-		_, err = one.neighborhoodset.getNode(two.self.ID)
-		if err != nil {
-			t.Fatalf(err.Error())
+	case <-time.After(1 * time.Second):
+		t.Fatal("Timed out waiting for heartbeat.")
+	}
+	// send returns once the heartbeat is acknowledged, having recorded the round trip in two's routing table
+	peer, err = two.table.getNode(one.self.ID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if proximity := peer.getRawProximity(); proximity <= 0 {
+		t.Errorf("Expected the round trip to record a proximity for %s, got %d.", one.self.ID, proximity)
+	}
+}
+
+// Test that joining through an unreachable node returns an error
+func TestClusterJoinUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// close the listener, so nothing is listening on the port
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.SetLogLevel(LogLevelError)
+	err = one.Join(addr.IP.String(), addr.Port)
+	if err != deadNodeError {
+		t.Errorf("Expected deadNodeError, got %v.", err)
+	}
+	if one.isJoined() {
+		t.Errorf("Expected the node not to be joined.")
+	}
+}
+
+// Test that a node announcing its exit is removed from the state tables and reported to applications
+func TestClusterNodeExit(t *testing.T) {
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.SetLogLevel(LogLevelError)
+	oneCB := newTestCallback(t)
+	one.RegisterCallback(oneCB)
+	two, err := makeCluster("this is some other Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = one.leafset.insertNode(*two.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = one.neighborhoodset.insertNode(*two.self, 1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(one.listNodes()) != 1 {
+		t.Errorf("Expected one distinct node, got %d.", len(one.listNodes()))
+	}
+	one.onNodeExit(two.NewMessage(NODE_EXIT, two.self.ID, []byte{}))
+	if _, err = one.leafset.getNode(two.self.ID); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError from leaf set, got %v.", err)
+	}
+	select {
+	case node := <-oneCB.onNodeExit:
+		if !node.ID.Equals(two.self.ID) {
+			t.Errorf("Expected exit of %s, got %s.", two.self.ID, node.ID)
+		}
+	default:
+		t.Errorf("Expected an OnNodeExit callback.")
+	}
+	select {
+	case node := <-oneCB.onNodeExit:
+		t.Errorf("Expected a single OnNodeExit callback, got another for %s.", node.ID)
+	default:
+	}
+}
+
+// Test that a node that stops responding to heartbeats is removed once it reaches the failure threshold
+func TestClusterHeartbeatFailureThreshold(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.SetLogLevel(LogLevelError)
+	one.SetFailureThreshold(3)
+	id, err := NodeIDFromBytes([]byte("this is some other Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	dead := NewNode(id, addr.IP.String(), addr.IP.String(), "testing", addr.Port)
+	_, err = one.leafset.insertNode(*dead)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 1; i < 3; i++ {
+		one.sendHeartbeats()
+		if _, err = one.leafset.getNode(id); err != nil {
+			t.Fatalf("Expected node to survive %d failed heartbeats, got %v.", i, err)
+		}
+	}
+	one.sendHeartbeats()
+	if _, err = one.leafset.getNode(id); err != nodeNotFoundError {
+		t.Errorf("Expected node to be removed after 3 failed heartbeats, got %v.", err)
+	}
+}
+
+// Test that a gap left in the leaf set by a departed node is refilled from another node's leaf set
+func TestClusterRepairLeafSet(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	two, err := makeCluster("this is some other Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.self.ID = NodeID{0x8000000000000000, 0}
+	two.self.ID = NodeID{0x7000000000000000, 0}
+	gone := NewNode(NodeID{0x7f00000000000000, 0}, "127.0.0.1", "127.0.0.1", "testing", 1)
+	replacement := NewNode(NodeID{0x6f00000000000000, 0}, "127.0.0.1", "127.0.0.1", "testing", 1)
+	one.SetProximityMeasurer(testMeasurer{replacement.ID: 10})
+	startListening(t, one)
+	defer one.Kill()
+	startListening(t, two)
+	defer two.Kill()
+	for _, node := range []*Node{gone, two.self} {
+		if _, err = one.leafset.insertNode(*node); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, node := range []*Node{replacement, one.self} {
+		if _, err = two.leafset.insertNode(*node); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	err = one.remove(gone.ID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err = one.leafset.getNode(replacement.ID); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected %s to be learned from %s's leaf set, got %v.", replacement.ID, two.self.ID, err)
+}
+
+// Test each branch of the routing decision: the leaf set, the routing table, and the fallback to any closer node
+func TestClusterNextHop(t *testing.T) {
+	ids := map[string]NodeID{}
+	for _, id := range []string{"80000000000000000000000000000000", "81000000000000000000000000000000", "7f000000000000000000000000000000", "21000000000000000000000000000000", "2f000000000000000000000000000000", "30000000000000000000000000000000", "40000000000000000000000000000000", "8080000000000000000000000000000a", "c0000000000000000000000000000000"} {
+		nodeID, err := NodeIDFromString(id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		ids[id] = nodeID
+	}
+	one := makeClusterWithID(ids["80000000000000000000000000000000"])
+	one.SetLogLevel(LogLevelError)
+	for _, id := range []string{"81000000000000000000000000000000", "7f000000000000000000000000000000"} {
+		if _, err := one.leafset.insertNode(*NewNode(ids[id], "127.0.0.2", "127.0.0.2", "testing", 55555)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if _, err := one.table.insertNode(*NewNode(ids["21000000000000000000000000000000"], "127.0.0.2", "127.0.0.2", "testing", 55555), 1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// the neighborhood set holds the only node that can make progress towards keys starting with 3
+	if _, err := one.neighborhoodset.insertNode(*NewNode(ids["2f000000000000000000000000000000"], "127.0.0.2", "127.0.0.2", "testing", 55555), 1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	tests := [...]struct {
+		key      string
+		expected string // empty if the message should be delivered locally
+	}{
+		{"80000000000000000000000000000000", ""},
+		{"8080000000000000000000000000000a", "81000000000000000000000000000000"},
+		{"21000000000000000000000000000000", "21000000000000000000000000000000"},
+		{"30000000000000000000000000000000", "2f000000000000000000000000000000"},
+		{"40000000000000000000000000000000", "2f000000000000000000000000000000"},
+		{"c0000000000000000000000000000000", "81000000000000000000000000000000"},
+	}
+	for i, test := range tests {
+		target, err := one.nextHop(ids[test.key])
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if test.expected == "" {
+			if target != nil {
+				t.Errorf("test %v: expected %s to be delivered locally, got %s", i, test.key, target.ID)
+			}
+			continue
+		}
+		if target == nil || !target.ID.Equals(ids[test.expected]) {
+			t.Errorf("test %v: expected %s to be routed to %s, got %v", i, test.key, test.expected, target)
+		}
+	}
+}
+
+// Test that a Message bouncing between two nodes with broken routing tables is dropped once it takes too many hops
+func TestClusterRoutingLoop(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	one := makeClusterWithID(NodeID{0x1000000000000000, 0})
+	two := makeClusterWithID(NodeID{0x2000000000000000, 0})
+	metrics := []*CountingMetrics{}
+	for _, cluster := range []*Cluster{one, two} {
+		cluster := cluster
+		cluster.SetLogLevel(LogLevelError)
+		cluster.SetMaxHops(5)
+		m := NewCountingMetrics()
+		cluster.SetMetrics(m)
+		metrics = append(metrics, m)
+		startListening(t, cluster)
+		defer cluster.Kill()
+	}
+	// each node believes the other is the next hop towards keys starting with 3
+	one.table.nodes[0][3] = []*Node{two.self}
+	two.table.nodes[0][3] = []*Node{one.self}
+	key := NodeID{0x3000000000000000, 0}
+	err := one.Send(one.NewMessage(NODE_ANN+1, key, []byte("hello")))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	deadline := time.Now().Add(1 * time.Second)
+	for metrics[0].Timeouts()+metrics[1].Timeouts() < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if timeouts := metrics[0].Timeouts() + metrics[1].Timeouts(); timeouts != 1 {
+		t.Fatalf("Expected the message to be dropped once, got %d timeouts.", timeouts)
+	}
+	if hops := metrics[0].Hops() + metrics[1].Hops(); hops != 6 {
+		t.Errorf("Expected the message to be forwarded %d times before being dropped, got %d.", 6, hops)
+	}
+	if deliveries := metrics[0].Deliveries() + metrics[1].Deliveries(); deliveries != 0 {
+		t.Errorf("Expected the message not to be delivered, got %d deliveries.", deliveries)
+	}
+}
+
+// Test that a Logger made with NewLogger writes the lines at or above the log level to the *log.Logger
+func TestClusterNewLogger(t *testing.T) {
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	var buf bytes.Buffer
+	cluster.SetLogger(NewLogger(log.New(&buf, "", 0)))
+	cluster.SetLogLevel(LogLevelInfo)
+	cluster.debug("a debug line")
+	cluster.info("an info line")
+	cluster.err("an error line")
+	if expected := "an info line\nan error line\n"; buf.String() != expected {
+		t.Errorf("Expected %q to be logged, got %q.", expected, buf.String())
+	}
+}
+
+// Test that a routed Message is passed to OnForward on the way and OnDeliver at its destination, with any changes made by OnForward
+func TestClusterForwardDeliver(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	oneCB := &rewritingCallback{testCallback: newTestCallback(t), value: []byte("rewritten")}
+	one.RegisterCallback(oneCB)
+	two, err := makeCluster("this is some other Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	twoCB := newTestCallback(t)
+	two.RegisterCallback(twoCB)
+	startListening(t, two)
+	defer two.Kill()
+	_, err = one.leafset.insertNode(*two.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = one.Send(one.NewMessage(NODE_ANN+1, two.self.ID, []byte("original")))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	select {
+	case data := <-oneCB.onForward:
+		if !data.next.Equals(two.self.ID) {
+			t.Errorf("Expected message to be forwarded to %s, was forwarded to %s instead.", two.self.ID, data.next)
+		}
+	default:
+		t.Fatalf("Expected OnForward to be called.")
+	}
+	select {
+	case msg := <-twoCB.onDeliver:
+		if string(msg.Value) != "rewritten" {
+			t.Errorf("Expected delivered value to be %s, got %s instead.", "rewritten", msg.Value)
+		}
+		if msg.Hop != 1 {
+			t.Errorf("Expected message to take %d hop, took %d instead.", 1, msg.Hop)
+		}
+	case <-time.After(time.Duration(one.getNetworkTimeout()) * time.Second):
+		t.Fatalf("Timeout waiting on delivery.")
+	}
+}
+
+// Test that a Message is routed through the Cluster and delivered at the Node closest to its key
+func TestClusterSendThreeHops(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	clusters := []*Cluster{}
+	callbacks := []*testCallback{}
+	metrics := []*CountingMetrics{}
+	for _, id := range []string{"10000000000000000000000000000000", "20000000000000000000000000000000", "30000000000000000000000000000000"} {
+		nodeID, err := NodeIDFromString(id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		cluster := makeClusterWithID(nodeID)
+		callback := newTestCallback(t)
+		cluster.RegisterCallback(callback)
+		m := NewCountingMetrics()
+		cluster.SetMetrics(m)
+		startListening(t, cluster)
+		defer cluster.Kill()
+		clusters = append(clusters, cluster)
+		callbacks = append(callbacks, callback)
+		metrics = append(metrics, m)
+	}
+	// each Node only knows about the next one, so the Message has to be forwarded at every hop
+	for i := 0; i < len(clusters)-1; i++ {
+		_, err := clusters[i].table.insertNode(*clusters[i+1].self, clusters[i].self.Proximity(clusters[i+1].self))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = clusters[i].leafset.insertNode(*clusters[i+1].self)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	key, err := NodeIDFromString("31000000000000000000000000000000")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = clusters[0].Send(clusters[0].NewMessage(NODE_ANN+1, key, []byte("hello")))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	select {
+	case msg := <-callbacks[2].onDeliver:
+		if !msg.Key.Equals(key) {
+			t.Errorf("Expected message with key %s to be delivered, got %s instead.", key, msg.Key)
+		}
+		if msg.Hop != 2 {
+			t.Errorf("Expected message to take %d hops, took %d instead.", 2, msg.Hop)
+		}
+	case <-time.After(time.Duration(clusters[0].getNetworkTimeout()) * time.Second):
+		t.Fatalf("Timeout waiting on delivery.")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-callbacks[i].onDeliver:
+			t.Errorf("Expected message to not be delivered at node %d, but it was delivered with key %s.", i, msg.Key)
+		default:
+		}
+		if hops := metrics[i].Hops(); hops != 1 {
+			t.Errorf("Expected node %d to forward the message %d time, forwarded it %d times.", i, 1, hops)
+		}
+	}
+	if deliveries := metrics[2].Deliveries(); deliveries != 1 {
+		t.Errorf("Expected %d delivery, got %d.", 1, deliveries)
+	}
+	if average := metrics[2].AverageHops(); average != 2 {
+		t.Errorf("Expected an average of %d hops, got %v.", 2, average)
+	}
+}
+
+// Test that Send removes a dead Node from the Message's route and routes the Message again
+func TestClusterSendDeadNode(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// close the listener straight away so nothing is listening on the port
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	two, err := makeCluster("this is some other Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	two.self.Port = port
+	oneCB := newTestCallback(t)
+	one.RegisterCallback(oneCB)
+	_, err = one.leafset.insertNode(*two.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = one.Send(one.NewMessage(NODE_ANN+1, two.self.ID, []byte("hello")))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = one.leafset.getNode(two.self.ID); err != nodeNotFoundError {
+		t.Errorf("Expected dead node to be removed from the leaf set, got %v instead.", err)
+	}
+	select {
+	case <-oneCB.onDeliver:
+	default:
+		t.Errorf("Expected message to be delivered locally once the dead node was removed.")
+	}
+}
+
+// Test that a Message rerouted around dead nodes is passed to OnForward once, not once per node tried
+func TestClusterSendDeadNodesForwardOnce(t *testing.T) {
+	one := makeClusterWithID(NodeIDWithPrefix(1))
+	oneCB := newTestCallback(t)
+	one.RegisterCallback(oneCB)
+	for _, prefix := range []byte{5, 6} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		// close the listener straight away so nothing is listening on the port
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+		dead := NewNode(NodeIDWithPrefix(prefix), "127.0.0.1", "127.0.0.1", "testing", port)
+		_, err = one.leafset.insertNode(*dead)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	err := one.Send(one.NewMessage(NODE_ANN+1, NodeIDWithPrefix(6), []byte("hello")))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	select {
+	case <-oneCB.onDeliver:
+	default:
+		t.Fatalf("Expected message to be delivered locally once the dead nodes were removed.")
+	}
+	if forwards := len(oneCB.onForward); forwards != 1 {
+		t.Errorf("Expected OnForward to be called once, got %d calls.", forwards)
+	}
+}
+
+// Test that several nodes joining the leaf set in quick succession produce a single OnNewLeaves call, as does a node leaving
+func TestClusterNewLeaves(t *testing.T) {
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.SetNewLeavesDelay(10 * time.Millisecond)
+	oneCB := newTestCallback(t)
+	one.RegisterCallback(oneCB)
+	ids := []string{
+		"this is some other Node for testing purposes only.",
+		"yet another Node for testing purposes only.",
+		"a fourth Node for testing purposes only.",
+	}
+	nodes := []*Node{}
+	for _, id := range ids {
+		other, err := makeCluster(id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		err = one.insert(*other.self, StateMask{Mask: lS})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		nodes = append(nodes, other.self)
+	}
+	select {
+	case leaves := <-oneCB.onNewLeaves:
+		if len(leaves) != len(nodes) {
+			t.Errorf("Expected %d leaves, got %d instead.", len(nodes), len(leaves))
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timeout waiting on OnNewLeaves.")
+	}
+	// removing a node tries to repair the leaf set through a node that isn't listening; only the notification matters here
+	one.remove(nodes[0].ID)
+	select {
+	case leaves := <-oneCB.onNewLeaves:
+		if len(leaves) != len(nodes)-1 {
+			t.Errorf("Expected %d leaves, got %d instead.", len(nodes)-1, len(leaves))
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timeout waiting on OnNewLeaves.")
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-oneCB.onNewLeaves:
+		t.Errorf("Expected a single OnNewLeaves call per change.")
+	default:
+	}
+}
+
+// Test that listening and then killing a cluster doesn't leak goroutines
+func TestClusterListenKill(t *testing.T) {
+	before := runtime.NumGoroutine()
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	done := make(chan error)
+	go func() {
+		done <- one.Listen()
+	}()
+	time.Sleep(2 * time.Millisecond)
+	one.Kill()
+	if err = <-done; err != nil {
+		t.Fatalf(err.Error())
+	}
+	deadline := time.Now().Add(1 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected at most %d goroutines after Kill, got %d.", before, after)
+	}
+}
+
+// Test joining two nodes
+func TestClusterJoinTwo(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	one, err := makeCluster("this is a test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.debug("One is %s", one.self.ID)
+	oneCB := newTestCallback(t)
+	one.RegisterCallback(oneCB)
+	two, err := makeCluster("this is some other Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	two.debug("Two is %s", two.self.ID)
+	twoCB := newTestCallback(t)
+	two.RegisterCallback(twoCB)
+	oneLog := newTestLogger()
+	one.SetLogger(oneLog)
+	go func() {
+		defer one.Kill()
+		err := one.Listen()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}()
+	go func() {
+		defer two.Kill()
+		err := two.Listen()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}()
+	time.Sleep(2 * time.Millisecond)
+	err = two.Join(one.self.LocalIP, one.self.Port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ticker := time.NewTicker(3 * time.Duration(one.getNetworkTimeout()) * time.Second)
+	defer ticker.Stop()
+	select {
+	case <-ticker.C:
+		t.Fatalf("Timeout waiting on join. Waited %d seconds.", 3*one.getNetworkTimeout())
+		return
+	case <-oneCB.onNodeJoin:
+		if !oneLog.contains(two.self.ID.String(), "joined the cluster.") {
+			t.Errorf("Expected the join to be logged.")
+		}
+		_, err = one.table.getNode(two.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = two.table.getNode(one.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = one.leafset.getNode(two.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = two.leafset.getNode(one.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = one.neighborhoodset.getNode(two.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = two.neighborhoodset.getNode(one.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	ticker.Stop()
+}
+
+// Test joining three nodes
+func TestClusterJoinThreeToTwo(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	one, err := makeCluster("A test Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	one.debug("One is %s", one.self.ID)
+	oneCB := newTestCallback(t)
+	one.RegisterCallback(oneCB)
+	two, err := makeCluster("just some other Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	two.debug("Two is %s", two.self.ID)
+	twoCB := newTestCallback(t)
+	two.RegisterCallback(twoCB)
+	three, err := makeCluster("yet a third Node for testing purposes only.")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	three.debug("Three is %s", three.self.ID)
+	threeCB := newTestCallback(t)
+	three.RegisterCallback(threeCB)
+	go func() {
+		defer one.Kill()
+		err := one.Listen()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}()
+	go func() {
+		defer two.Kill()
+		err := two.Listen()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}()
+	go func() {
+		defer three.Kill()
+		err := three.Listen()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}()
+	time.Sleep(2 * time.Millisecond)
+	err = two.Join(one.self.LocalIP, one.self.Port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ticker := time.NewTicker(5 * time.Duration(one.getNetworkTimeout()) * time.Second)
+	defer ticker.Stop()
+	select {
+	case <-ticker.C:
+		t.Fatalf("Timeout waiting on two join. Waited %d seconds.", 5*one.getNetworkTimeout())
+		return
+	case <-oneCB.onNodeJoin:
+		_, err = one.table.getNode(two.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = two.table.getNode(one.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = one.leafset.getNode(two.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = two.leafset.getNode(one.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = one.neighborhoodset.getNode(two.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = two.neighborhoodset.getNode(one.self.ID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	ticker.Stop()
+	err = three.Join(two.self.LocalIP, two.self.Port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	returns := 0
+	ticker = time.NewTicker(120 * time.Second)
+	defer ticker.Stop()
+L:
+	for {
+		select {
+		case <-ticker.C:
+			t.Fatalf("Timeout waiting on three to join. Waited %d seconds.", 120)
+			return
+		case <-twoCB.onNodeJoin:
+			t.Logf("Got node join callback from twoCB")
+			if returns < 1 {
+				t.Logf("Waiting on first Node join callback")
+				returns = returns + 1
+				continue
+			}
+			break L
+		case <-oneCB.onNodeJoin:
+			t.Logf("Got Node join callback from oneCB")
+			if returns < 1 {
+				t.Logf("Waiting on second Node join callback")
+				returns = returns + 1
+				continue
+			}
+			break L
+		}
+	}
+	_, err = one.table.getNode(three.self.ID)
+	if err != nil {
+		t.Logf("Error getting three from one's table")
+		t.Errorf(err.Error())
+	}
+	_, err = two.table.getNode(three.self.ID)
+	if err != nil {
+		t.Logf("Error getting three from two's table")
+		t.Errorf(err.Error())
+	}
+	_, err = three.table.getNode(one.self.ID)
+	if err != nil {
+		t.Logf("Error getting one from three's table")
+		t.Errorf(err.Error())
+	}
+	_, err = three.table.getNode(two.self.ID)
+	if err != nil {
+		t.Logf("Error getting two from three's table")
+		t.Errorf(err.Error())
+	}
+	_, err = one.leafset.getNode(three.self.ID)
+	if err != nil {
+		t.Logf("Error getting three from one's leaf set")
+		t.Errorf(err.Error())
+	}
+	_, err = two.leafset.getNode(three.self.ID)
+	if err != nil {
+		t.Logf("Error getting three from two's leaf set")
+		t.Errorf(err.Error())
+	}
+	_, err = three.leafset.getNode(one.self.ID)
+	if err != nil {
+		t.Logf("Error getting one from three's leaf set")
+		t.Errorf(err.Error())
+	}
+	_, err = three.leafset.getNode(two.self.ID)
+	if err != nil {
+		t.Logf("Error getting two from three's leaf set")
+		t.Errorf(err.Error())
+	}
+	_, err = one.neighborhoodset.getNode(three.self.ID)
+	if err != nil {
+		t.Logf("Error getting three from one's neighborhood set")
+		t.Errorf(err.Error())
+	}
+	_, err = two.neighborhoodset.getNode(three.self.ID)
+	if err != nil {
+		t.Logf("Error getting three from two's neighborhood set")
+		t.Errorf(err.Error())
+	}
+	_, err = three.neighborhoodset.getNode(one.self.ID)
+	if err != nil {
+		t.Logf("Error getting one from three's neighborhood set")
+		t.Errorf(err.Error())
+	}
+	_, err = three.neighborhoodset.getNode(two.self.ID)
+	if err != nil {
+		t.Logf("Error getting two from three's neighborhood set")
+		t.Errorf(err.Error())
+	}
+	return
+}
+
+// Test that inbound Messages are never handled by more goroutines than the configured number of workers
+func TestClusterInboundWorkers(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	cluster := makeClusterWithID(HashToNodeID([]byte("inbound workers")))
+	cluster.SetInboundWorkers(2, 50)
+	callback := &concurrencyCallback{testCallback: newTestCallback(t), started: make(chan struct{}, 20), release: make(chan struct{})}
+	cluster.RegisterCallback(callback)
+	startListening(t, cluster)
+	defer cluster.Kill()
+	address, err := cluster.GetIP(*cluster.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := cluster.SendToIP(cluster.NewMessage(NODE_ANN+1, cluster.self.ID, []byte(strconv.Itoa(i))), address)
+			if err != nil {
+				t.Errorf(err.Error())
+			}
+		}(i)
+	}
+	// the rest of the Messages can't be acknowledged until the workers are released, so wait for the workers instead of the senders
+	for i := 0; i < 2; i++ {
+		select {
+		case <-callback.started:
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting on delivery %d.", i)
+		}
+	}
+	// give the workers a chance to pick up more than they should
+	time.Sleep(10 * time.Millisecond)
+	callback.lock.Lock()
+	active := callback.active
+	callback.lock.Unlock()
+	if active != 2 {
+		t.Errorf("Expected %d Messages to be delivered at once, got %d.", 2, active)
+	}
+	close(callback.release)
+	wg.Wait()
+	deadline := time.Now().Add(time.Second)
+	for {
+		callback.lock.Lock()
+		delivered := callback.delivered
+		callback.lock.Unlock()
+		if delivered == 20 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting on delivery, only %d of %d Messages delivered.", delivered, 20)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	callback.lock.Lock()
+	defer callback.lock.Unlock()
+	if callback.max > 2 {
+		t.Errorf("Expected at most %d Messages to be delivered at once, got %d.", 2, callback.max)
+	}
+}
+
+// Test that inbound connections are dropped and counted when the queue is full
+func TestClusterInboundDropped(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	cluster := makeClusterWithID(HashToNodeID([]byte("inbound dropped")))
+	cluster.SetInboundWorkers(1, 0)
+	metrics := NewCountingMetrics()
+	cluster.SetMetrics(metrics)
+	callback := &concurrencyCallback{testCallback: newTestCallback(t), started: make(chan struct{}, 10), release: make(chan struct{})}
+	cluster.RegisterCallback(callback)
+	startListening(t, cluster)
+	defer cluster.Kill()
+	address, err := cluster.GetIP(*cluster.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// nothing can be queued, so the first Message is dropped too if the worker isn't waiting for it yet
+	timeout := time.After(time.Second)
+	for started := false; !started; {
+		cluster.SendToIP(cluster.NewMessage(NODE_ANN+1, cluster.self.ID, []byte("first")), address)
+		select {
+		case <-callback.started:
+			started = true
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("Timeout waiting on delivery.")
+		}
+	}
+	before := metrics.Drops()
+	// the only worker is busy and nothing can be queued, so these are all dropped
+	for i := 0; i < 3; i++ {
+		cluster.SendToIP(cluster.NewMessage(NODE_ANN+1, cluster.self.ID, []byte("dropped")), address)
+	}
+	close(callback.release)
+	if drops := metrics.Drops() - before; drops != 3 {
+		t.Errorf("Expected %d dropped connections, got %d.", 3, drops)
+	}
+	select {
+	case msg := <-callback.onDeliver:
+		if string(msg.Value) != "first" {
+			t.Errorf("Expected the first Message to be delivered, got %s.", msg.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on delivery.")
+	}
+}
+
+// Test that Nodes in more than one state table are only counted once
+func TestClusterKnownNodes(t *testing.T) {
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	if known := cluster.KnownNodes(); known != 0 {
+		t.Errorf("Expected %d known Nodes, got %d.", 0, known)
+	}
+	other := NewNode(NodeIDWithPrefix(2), "127.0.0.2", "127.0.0.2", "testing", 55555)
+	another := NewNode(NodeIDWithPrefix(3), "127.0.0.3", "127.0.0.3", "testing", 55555)
+	_, err := cluster.table.insertNode(*other, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = cluster.leafset.insertNode(*other)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = cluster.leafset.insertNode(*another)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if known := cluster.KnownNodes(); known != 2 {
+		t.Errorf("Expected %d known Nodes, got %d.", 2, known)
+	}
+	if size := cluster.EstimateSize(); size != 3 {
+		t.Errorf("Expected an estimated %d Nodes, got %d.", 3, size)
+	}
+}
+
+// Test that a key exactly as far from two Nodes is always routed to the lesser of them, whichever order they were learned in and whichever state table they're in
+func TestClusterRouteTie(t *testing.T) {
+	key := NodeIDWithPrefix(2)
+	lesser := NewNode(NodeIDWithPrefix(1), "127.0.0.1", "127.0.0.1", "testing", 55555)
+	greater := NewNode(NodeIDWithPrefix(3), "127.0.0.2", "127.0.0.2", "testing", 55555)
+	orders := [][]*Node{{lesser, greater}, {greater, lesser}}
+	for i, order := range orders {
+		for _, mask := range []byte{lS, rT} {
+			cluster := makeClusterWithID(NodeIDWithPrefix(8))
+			for _, node := range order {
+				var err error
+				if mask == lS {
+					_, err = cluster.leafset.insertNode(*node)
+				} else {
+					_, err = cluster.table.insertNode(*node, 10)
+				}
+				if err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			for j := 0; j < 10; j++ {
+				target, err := cluster.Route(key)
+				if err != nil {
+					t.Fatalf(err.Error())
+				}
+				if target == nil || !target.ID.Equals(lesser.ID) {
+					t.Fatalf("order %d, mask %d: expected %s, got %v.", i, mask, lesser.ID, target)
+				}
+			}
+			if cluster.Owns(key) {
+				t.Errorf("order %d, mask %d: expected the current Node not to own %s.", i, mask, key)
+			}
+		}
+	}
+	// the current Node wins a tie with a greater Node, and agrees that it owns the key
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	_, err := cluster.leafset.insertNode(*greater)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	target, err := cluster.Route(key)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if target != nil || !cluster.Owns(key) {
+		t.Errorf("Expected the current Node to own %s, got %v.", key, target)
+	}
+	// and loses a tie with a lesser Node, even when the lesser Node only turns up in the search of every known Node
+	cluster = makeClusterWithID(NodeIDWithPrefix(3))
+	_, err = cluster.table.insertNode(*lesser, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	target, err = cluster.Route(key)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if target == nil || !target.ID.Equals(lesser.ID) || cluster.Owns(key) {
+		t.Errorf("Expected %s to own %s, got %v.", lesser.ID, key, target)
+	}
+}
+
+// Test that the responsibility ranges of the two Nodes in a two Node ring partition the node space, and agree with Owns
+func TestClusterResponsibilityRange(t *testing.T) {
+	alone := makeClusterWithID(NodeIDWithPrefix(1))
+	start, end := alone.ResponsibilityRange()
+	if start != alone.self.ID.Next() || end != alone.self.ID {
+		t.Errorf("Expected a single Node to be responsible for the whole node space, got %s to %s.", start, end)
+	}
+	pairs := [][2]NodeID{
+		{NodeID{0, 0}, NodeID{0, 10}},
+		{NodeID{0, 0}, NodeID{0, 11}},
+		{NodeIDWithPrefix(1), NodeIDWithPrefix(9)},
+		{NodeID{0, 0}, NodeID{0x8000000000000000, 0}},
+	}
+	for i, pair := range pairs {
+		one := makeClusterWithID(pair[0])
+		two := makeClusterWithID(pair[1])
+		_, err := one.leafset.insertNode(*two.self)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = two.leafset.insertNode(*one.self)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		oneStart, oneEnd := one.ResponsibilityRange()
+		twoStart, twoEnd := two.ResponsibilityRange()
+		if oneEnd.Next() != twoStart || twoEnd.Next() != oneStart {
+			t.Errorf("pair %d: expected %s to %s and %s to %s to partition the node space.", i, oneStart, oneEnd, twoStart, twoEnd)
+		}
+		for _, key := range []NodeID{oneStart, oneEnd} {
+			if !one.Owns(key) || two.Owns(key) {
+				t.Errorf("pair %d: expected %s to own %s.", i, one.self.ID, key)
+			}
+		}
+		for _, key := range []NodeID{twoStart, twoEnd} {
+			if !two.Owns(key) || one.Owns(key) {
+				t.Errorf("pair %d: expected %s to own %s.", i, two.self.ID, key)
+			}
+		}
+	}
+}
+
+// Test that the time between heartbeats varies within the jitter, the same way for Clocks that start at the same time
+func TestClusterHeartbeatJitter(t *testing.T) {
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	cluster.SetHeartbeatFrequency(10)
+	random := rand.New(rand.NewSource(newFakeClock().Now().UnixNano()))
+	if delay := cluster.heartbeatDelay(random); delay != 10*time.Second {
+		t.Errorf("Expected no jitter by default, got a delay of %s.", delay)
+	}
+	cluster.SetHeartbeatJitter(20)
+	delays := []time.Duration{}
+	distinct := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		delay := cluster.heartbeatDelay(random)
+		if delay < 8*time.Second || delay > 12*time.Second {
+			t.Errorf("Expected delays between %s and %s, got %s.", 8*time.Second, 12*time.Second, delay)
+		}
+		delays = append(delays, delay)
+		distinct[delay] = true
+	}
+	if len(distinct) < 50 {
+		t.Errorf("Expected the delays to vary, got %d distinct delays out of %d.", len(distinct), len(delays))
+	}
+	random = rand.New(rand.NewSource(newFakeClock().Now().UnixNano()))
+	for i, expected := range delays {
+		if delay := cluster.heartbeatDelay(random); delay != expected {
+			t.Fatalf("delay %d: expected %s, got %s.", i, expected, delay)
+		}
+	}
+}
+
+// Test that Kill gives up and returns a TimeoutError when a connection is still being handled after the shutdown timeout
+func TestClusterKillTimeout(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	cluster := makeClusterWithID(HashToNodeID([]byte("kill timeout")))
+	cluster.SetShutdownTimeout(1)
+	callback := &concurrencyCallback{testCallback: newTestCallback(t), started: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(callback.release)
+	cluster.RegisterCallback(callback)
+	done := make(chan error)
+	go func() {
+		done <- cluster.Listen()
+	}()
+	time.Sleep(2 * time.Millisecond)
+	address, err := cluster.GetIP(*cluster.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = cluster.SendToIP(cluster.NewMessage(NODE_ANN+1, cluster.self.ID, []byte("blocked")), address)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	select {
+	case <-callback.started:
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on delivery.")
+	}
+	start := time.Now()
+	err = cluster.Kill()
+	if _, ok := err.(TimeoutError); !ok {
+		t.Errorf("Expected TimeoutError, got %v.", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected Kill to return within the shutdown timeout, took %s.", elapsed)
+	}
+	// Listen itself shouldn't be held up by the blocked connection
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on Listen to return.")
+	}
+}
+
+// Test that each Node in a two Node cluster owns the half of the node space closest to it
+func TestClusterOwns(t *testing.T) {
+	one := makeClusterWithID(NodeIDWithPrefix(1))
+	two := makeClusterWithID(NodeIDWithPrefix(9))
+	_, err := one.leafset.insertNode(*two.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = two.leafset.insertNode(*one.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tests := []struct {
+		key   NodeID
+		owner *Cluster
+	}{
+		{NodeIDWithPrefix(1), one},
+		{NodeIDWithPrefix(0), one},
+		{NodeIDWithPrefix(4, 0xf), one},
+		{NodeIDWithPrefix(0xd, 1), one},
+		{NodeIDWithPrefix(5, 1), two},
+		{NodeIDWithPrefix(9), two},
+		{NodeIDWithPrefix(0xc, 0xe), two},
+		// exactly as close to both, so the lesser ID owns it
+		{NodeIDWithPrefix(5), one},
+	}
+	for _, test := range tests {
+		for _, cluster := range []*Cluster{one, two} {
+			if owns := cluster.Owns(test.key); owns != (cluster == test.owner) {
+				t.Errorf("Expected %s owning %s to be %v, got %v.", cluster.self.ID, test.key, cluster == test.owner, owns)
+			}
+		}
+	}
+}
+
+// Test that a Node in another Region without a GlobalIP is kept out of the routing table, but still inserted into the leaf set
+func TestClusterInsertUnreachable(t *testing.T) {
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	hidden := NewNode(NodeIDWithPrefix(3), "10.0.0.3", "", "elsewhere", 55555)
+	if addr, err := cluster.GetIP(*hidden); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected ErrUnreachable getting the address of a Node without a GlobalIP in another Region, got %s (%v).", addr, err)
+	}
+	err := cluster.insert(*hidden, StateMask{Mask: all})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if node, err := cluster.table.getNode(hidden.ID); err != nodeNotFoundError {
+		t.Errorf("Expected %s not to be inserted into the routing table, got %v (%v).", hidden.ID, node, err)
+	}
+	if _, err := cluster.leafset.getNode(hidden.ID); err != nil {
+		t.Errorf("Expected %s to be inserted into the leaf set, got %v.", hidden.ID, err)
+	}
+}
+
+// Test that a Node with a malformed address in the state tables a Node is sent is left out, without stopping the other Nodes from being inserted
+func TestClusterInsertMessageInvalidNode(t *testing.T) {
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	valid := []*Node{
+		NewNode(NodeIDWithPrefix(3), "127.0.0.3", "127.0.0.3", "testing", 55555),
+		NewNode(NodeIDWithPrefix(7), "127.0.0.7", "127.0.0.7", "testing", 55555),
+	}
+	invalid := NewNode(NodeIDWithPrefix(5), "not an IP", "", "testing", 55555)
+	cluster.SetProximityMeasurer(testMeasurer{valid[0].ID: 10, valid[1].ID: 20, invalid.ID: 30})
+	leafset := [2][]*Node{{valid[0], invalid, valid[1]}, {}}
+	value, err := json.Marshal(stateTables{LeafSet: &leafset})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = cluster.insertMessage(cluster.NewMessage(STAT_DATA, cluster.self.ID, value))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, node := range valid {
+		if _, err := cluster.leafset.getNode(node.ID); err != nil {
+			t.Errorf("Expected %s to be inserted into the leaf set, got %v.", node.ID, err)
+		}
+	}
+	if node, err := cluster.get(invalid.ID); err != nodeNotFoundError {
+		t.Errorf("Expected %s not to be inserted, got %v (%v).", invalid.ID, node, err)
+	}
+}
+
+// Test that each kind of failure can be identified with errors.Is
+func TestClusterErrorSentinels(t *testing.T) {
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	if _, err := NodeIDFromString("not a NodeID"); !errors.Is(err, ErrInvalidNodeID) {
+		t.Errorf("Expected ErrInvalidNodeID parsing an invalid NodeID, got %v.", err)
+	}
+	if _, err := cluster.get(NodeIDWithPrefix(2)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound getting an unknown Node, got %v.", err)
+	}
+	hidden := NewNode(NodeIDWithPrefix(3), "10.0.0.3", "", "elsewhere", 55555)
+	if err := cluster.send(cluster.NewMessage(NODE_ANN+1, hidden.ID, []byte{}), hidden); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected ErrUnreachable sending to a Node without a GlobalIP in another Region, got %v.", err)
+	}
+	// nothing is listening on a port that was just closed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	if err := cluster.SendToIP(cluster.NewMessage(NODE_ANN+1, cluster.self.ID, []byte{}), address); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected ErrUnreachable sending to a closed port, got %v.", err)
+	}
+	cluster.table.setMaxEntries(1)
+	_, err = cluster.table.insertNode(*NewNode(NodeIDWithPrefix(4), "127.0.0.4", "127.0.0.4", "testing", 55555), 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = cluster.table.insertNode(*NewNode(NodeIDWithPrefix(4, 1), "127.0.0.5", "127.0.0.5", "testing", 55555), 20); !errors.Is(err, ErrTableFull) {
+		t.Errorf("Expected ErrTableFull inserting into a full routing table cell, got %v.", err)
+	}
+}
+
+// Test that a broadcast is delivered once to every known Node, even if one of them is dead
+func TestClusterBroadcast(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	clusters := []*Cluster{}
+	callbacks := []*testCallback{}
+	for _, prefix := range []byte{1, 5, 9} {
+		cluster := makeClusterWithID(NodeIDWithPrefix(prefix))
+		callback := newTestCallback(t)
+		cluster.RegisterCallback(callback)
+		startListening(t, cluster)
+		defer cluster.Kill()
+		clusters = append(clusters, cluster)
+		callbacks = append(callbacks, callback)
+	}
+	// the same Node in more than one state table is still only sent one Message
+	for _, other := range clusters[1:] {
+		_, err := clusters[0].table.insertNode(*other.self, 10)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = clusters[0].leafset.insertNode(*other.self)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	dead := NewNode(NodeIDWithPrefix(0xd), "127.0.0.1", "127.0.0.1", "testing", port)
+	_, err = clusters[0].leafset.insertNode(*dead)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	clusters[0].Broadcast(NODE_ANN+1, []byte("everyone"))
+	for i, callback := range callbacks[1:] {
+		select {
+		case msg := <-callback.onDeliver:
+			if !msg.Key.Equals(clusters[i+1].self.ID) || string(msg.Value) != "everyone" {
+				t.Errorf("Expected broadcast keyed to %s, got %s.", clusters[i+1].self.ID, msg.String())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting on broadcast to %s.", clusters[i+1].self.ID)
 		}
-		_, err = two.neighborhoodset.getNode(one.self.ID)
-		if err != nil {
-			t.Fatalf(err.Error())
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i, callback := range callbacks {
+		select {
+		case msg := <-callback.onDeliver:
+			t.Errorf("Expected no more deliveries at node %d, got %s.", i, msg.String())
+		default:
 		}
 	}
-	ticker.Stop()
 }
 
-// Test joining three nodes
-func TestClusterJoinThreeToTwo(t *testing.T) {
+// Test that heartbeats are sent when the Clock says they're due, and that the Node's last contact is recorded with the Clock's time
+func TestClusterClockHeartbeat(t *testing.T) {
 	if testing.Short() {
 		return
 	}
-	one, err := makeCluster("A test Node for testing purposes only.")
+	one := makeClusterWithID(NodeIDWithPrefix(1))
+	callback := newTestCallback(t)
+	one.RegisterCallback(callback)
+	two := makeClusterWithID(NodeIDWithPrefix(2))
+	clock := newFakeClock()
+	two.SetClock(clock)
+	startListening(t, one)
+	defer one.Kill()
+	startListening(t, two)
+	defer two.Kill()
+	_, err := two.leafset.insertNode(*one.self)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	one.debug("One is %s", one.self.ID)
-	oneCB := newTestCallback(t)
-	one.RegisterCallback(oneCB)
-	two, err := makeCluster("just some other Node for testing purposes only.")
-	if err != nil {
-		t.Fatalf(err.Error())
+	// one for heartbeats, one for emptying the proximity cache
+	clock.wait(t, 2)
+	select {
+	case node := <-callback.onHeartbeat:
+		t.Fatalf("Expected no heartbeat before the clock was advanced, got one from %s.", node.ID)
+	case <-time.After(10 * time.Millisecond):
 	}
-	two.debug("Two is %s", two.self.ID)
-	twoCB := newTestCallback(t)
-	two.RegisterCallback(twoCB)
-	three, err := makeCluster("yet a third Node for testing purposes only.")
+	clock.advance(10 * time.Second)
+	select {
+	case node := <-callback.onHeartbeat:
+		if !node.ID.Equals(two.self.ID) {
+			t.Errorf("Expected heartbeat from %s, got %s.", two.self.ID, node.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on heartbeat.")
+	}
+	node, err := two.leafset.getNode(one.self.ID)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	three.debug("Three is %s", three.self.ID)
-	threeCB := newTestCallback(t)
-	three.RegisterCallback(threeCB)
+	// the heartbeat has been acknowledged by the time it's delivered, but the sender may not have recorded it yet
+	deadline := time.Now().Add(time.Second)
+	for !node.LastHeardFrom().Equal(clock.Now()) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !node.LastHeardFrom().Equal(clock.Now()) {
+		t.Errorf("Expected %s to have been heard from at %s, got %s.", node.ID, clock.Now(), node.LastHeardFrom())
+	}
+}
+
+// Test that Kill times out when the Clock moves past the shutdown timeout
+func TestClusterClockKillTimeout(t *testing.T) {
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	clock := newFakeClock()
+	cluster.SetClock(clock)
+	cluster.SetShutdownTimeout(30)
+	done := make(chan error)
+	// Listen isn't running, so nothing will ever stop
 	go func() {
-		defer one.Kill()
-		err := one.Listen()
-		if err != nil {
-			t.Fatalf(err.Error())
-		}
+		done <- cluster.Kill()
 	}()
-	go func() {
-		defer two.Kill()
-		err := two.Listen()
-		if err != nil {
-			t.Fatalf(err.Error())
+	clock.wait(t, 1)
+	clock.advance(29 * time.Second)
+	select {
+	case err := <-done:
+		t.Fatalf("Expected Kill to wait for the shutdown timeout, returned %v.", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.advance(time.Second)
+	select {
+	case err := <-done:
+		if _, ok := err.(TimeoutError); !ok {
+			t.Errorf("Expected TimeoutError, got %v.", err)
 		}
-	}()
-	go func() {
-		defer three.Kill()
-		err := three.Listen()
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on Kill to return.")
+	}
+}
+
+// Test that a Node joining with the ID of a Node already in the Cluster is told of the collision and doesn't join
+func TestClusterJoinCollision(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	one := makeClusterWithID(NodeIDWithPrefix(1))
+	two := makeClusterWithID(NodeIDWithPrefix(9))
+	three := makeClusterWithID(NodeIDWithPrefix(1))
+	callback := &errorCallback{testCallback: newTestCallback(t), errors: make(chan error, 10)}
+	three.RegisterCallback(callback)
+	for _, cluster := range []*Cluster{one, two, three} {
+		startListening(t, cluster)
+		defer cluster.Kill()
+	}
+	for _, pair := range [][2]*Cluster{{one, two}, {two, one}} {
+		_, err := pair[0].leafset.insertNode(*pair[1].self)
 		if err != nil {
 			t.Fatalf(err.Error())
 		}
-	}()
-	time.Sleep(2 * time.Millisecond)
-	err = two.Join(one.self.LocalIP, one.self.Port)
-	if err != nil {
-		t.Fatalf(err.Error())
 	}
-	ticker := time.NewTicker(5 * time.Duration(one.getNetworkTimeout()) * time.Second)
-	defer ticker.Stop()
+	err := three.Join(two.self.LocalIP, two.self.Port)
+	if !errors.Is(err, ErrNodeIDCollision) {
+		t.Fatalf("Expected Join to return ErrNodeIDCollision, got %v.", err)
+	}
 	select {
-	case <-ticker.C:
-		t.Fatalf("Timeout waiting on two join. Waited %d seconds.", 5*one.getNetworkTimeout())
-		return
-	case <-oneCB.onNodeJoin:
-		_, err = one.table.getNode(two.self.ID)
-		if err != nil {
-			t.Fatalf(err.Error())
+	case err := <-callback.errors:
+		if !errors.Is(err, ErrNodeIDCollision) {
+			t.Errorf("Expected ErrNodeIDCollision to be passed to OnError, got %v.", err)
 		}
-		_, err = two.table.getNode(one.self.ID)
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on ErrNodeIDCollision.")
+	}
+	if three.isJoined() {
+		t.Errorf("Expected the colliding Node not to join.")
+	}
+	node, err := two.get(three.self.ID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if node.Port != one.self.Port {
+		t.Errorf("Expected the bootstrap Node to still know the ID as %s, got %s.", one.self, node)
+	}
+}
+
+// Test that a Node in the neighborhood set fills an emptied routing table cell
+func TestClusterRepairTableFromNeighborhood(t *testing.T) {
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	removed := NewNode(NodeIDWithPrefix(5), "127.0.0.2", "127.0.0.2", "testing", 55555)
+	neighbor := NewNode(NodeIDWithPrefix(5, 3), "127.0.0.3", "127.0.0.3", "testing", 55555)
+	unrelated := NewNode(NodeIDWithPrefix(8), "127.0.0.4", "127.0.0.4", "testing", 55555)
+	_, err := cluster.table.insertNode(*removed, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, node := range []*Node{unrelated, neighbor} {
+		_, err = cluster.neighborhoodset.insertNode(*node, 20)
 		if err != nil {
 			t.Fatalf(err.Error())
 		}
-		_, err = one.leafset.getNode(two.self.ID)
+	}
+	err = cluster.remove(removed.ID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	entries := cluster.table.list([]int{0}, []int{5})
+	if len(entries) != 1 || !entries[0].ID.Equals(neighbor.ID) {
+		t.Errorf("Expected row 0, column 5 to be repaired with %s, got %v.", neighbor.ID, entries)
+	} else if proximity := entries[0].getRawProximity(); proximity != 20 {
+		t.Errorf("Expected %s to keep its proximity from the neighborhood set, 20, got %d.", neighbor.ID, proximity)
+	}
+	if entries := cluster.table.list([]int{0}, []int{8}); len(entries) != 0 {
+		t.Errorf("Expected only the emptied cell to be repaired, got %v in row 0, column 8.", entries)
+	}
+}
+
+// Test that Nearest finds the Node in the routing table closest to a key, and reports an empty routing table
+func TestClusterNearest(t *testing.T) {
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	key := NodeIDWithPrefix(7, 2)
+	if node, ok := cluster.Nearest(key); ok {
+		t.Errorf("Expected no Node to be nearest in an empty routing table, got %s.", node.ID)
+	}
+	nodes := []*Node{
+		NewNode(NodeIDWithPrefix(3), "127.0.0.2", "127.0.0.2", "testing", 55555),
+		NewNode(NodeIDWithPrefix(7, 9), "127.0.0.3", "127.0.0.3", "testing", 55555),
+		NewNode(NodeIDWithPrefix(8), "127.0.0.4", "127.0.0.4", "testing", 55555),
+	}
+	for _, node := range nodes {
+		_, err := cluster.table.insertNode(*node, 10)
 		if err != nil {
 			t.Fatalf(err.Error())
 		}
-		_, err = two.leafset.getNode(one.self.ID)
-		if err != nil {
-			t.Fatalf(err.Error())
+	}
+	nearest, ok := cluster.Nearest(key)
+	if !ok {
+		t.Fatalf("Expected a Node to be nearest to %s.", key)
+	}
+	for _, node := range nodes {
+		if key.Diff(node.ID).Cmp(key.Diff(nearest.ID)) < 0 {
+			t.Errorf("Expected %s to be the nearest node to %s, but %s is nearer.", nearest.ID, key, node.ID)
 		}
-		_, err = one.neighborhoodset.getNode(two.self.ID)
+	}
+}
+
+// Test that IterateRoutingTable visits every Node in the routing table once, and stops when told to
+func TestClusterIterateRoutingTable(t *testing.T) {
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	for i, prefix := range []byte{3, 5, 7, 9} {
+		node := NewNode(NodeIDWithPrefix(prefix), "127.0.0.2", "127.0.0.2", "testing", 55555)
+		_, err := cluster.table.insertNode(*node, int64(10+i))
 		if err != nil {
 			t.Fatalf(err.Error())
 		}
-		_, err = two.neighborhoodset.getNode(one.self.ID)
-		if err != nil {
-			t.Fatalf(err.Error())
+	}
+	seen := map[NodeID]int{}
+	cluster.IterateRoutingTable(func(row, col, entry int, node *Node) bool {
+		seen[node.ID] += 1
+		return true
+	})
+	if len(seen) != cluster.table.count() {
+		t.Errorf("Expected to visit %d nodes, visited %d.", cluster.table.count(), len(seen))
+	}
+	for id, visits := range seen {
+		if visits != 1 {
+			t.Errorf("Expected to visit %s once, visited it %d times.", id, visits)
 		}
 	}
-	ticker.Stop()
-	err = three.Join(two.self.LocalIP, two.self.Port)
+	visits := 0
+	cluster.IterateRoutingTable(func(row, col, entry int, node *Node) bool {
+		visits += 1
+		return visits < 2
+	})
+	if visits != 2 {
+		t.Errorf("Expected iteration to stop after %d nodes, visited %d.", 2, visits)
+	}
+}
+
+// Test that Health reports a listening Cluster as unhealthy while its leaf set is empty, and healthy once it isn't
+func TestClusterHealth(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	cluster := makeClusterWithID(NodeIDWithPrefix(1))
+	if health := cluster.Health(); health.Healthy || health.Listening {
+		t.Errorf("Expected a Cluster that isn't listening to be unhealthy, got %+v.", health)
+	}
+	startListening(t, cluster)
+	defer cluster.Kill()
+	health := cluster.Health()
+	if health.Healthy || !health.Listening || health.LeafSetSize != 0 {
+		t.Errorf("Expected a listening Cluster with an empty leaf set to be unhealthy, got %+v.", health)
+	}
+	if health.LeafSetCapacity != 32 {
+		t.Errorf("Expected a leaf set capacity of %d, got %d.", 32, health.LeafSetCapacity)
+	}
+	other := NewNode(NodeIDWithPrefix(2), "127.0.0.2", "127.0.0.2", "testing", 55555)
+	_, err := cluster.leafset.insertNode(*other)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	returns := 0
-	ticker = time.NewTicker(120 * time.Second)
-	defer ticker.Stop()
-L:
-	for {
-		select {
-		case <-ticker.C:
-			t.Fatalf("Timeout waiting on three to join. Waited %d seconds.", 120)
-			return
-		case <-twoCB.onNodeJoin:
-			t.Logf("Got node join callback from twoCB")
-			if returns < 1 {
-				t.Logf("Waiting on first Node join callback")
-				returns = returns + 1
-				continue
+	_, err = cluster.table.insertNode(*other, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cluster.evicted()
+	health = cluster.Health()
+	if !health.Healthy || health.LeafSetSize != 1 || health.RoutingTableSize != 1 || health.RecentEvictions != 1 {
+		t.Errorf("Expected a listening Cluster with a populated leaf set to be healthy, got %+v.", health)
+	}
+}
+
+// Test that Nodes joining through the same Node at the same time all end up in each other's leaf sets
+func TestClusterConcurrentJoins(t *testing.T) {
+	if testing.Short() {
+		return
+	}
+	clusters := []*Cluster{}
+	for i := byte(1); i <= 4; i++ {
+		cluster := makeClusterWithID(NodeIDWithPrefix(i * 3))
+		cluster.SetLogLevel(LogLevelWarn)
+		clusters = append(clusters, cluster)
+		startListening(t, cluster)
+		defer cluster.Kill()
+	}
+	bootstrap := clusters[0]
+	for _, cluster := range clusters[1:] {
+		go func(cluster *Cluster) {
+			err := cluster.Join(bootstrap.self.LocalIP, bootstrap.self.Port)
+			if err != nil {
+				t.Errorf(err.Error())
 			}
-			break L
-		case <-oneCB.onNodeJoin:
-			t.Logf("Got Node join callback from oneCB")
-			if returns < 1 {
-				t.Logf("Waiting on second Node join callback")
-				returns = returns + 1
-				continue
+		}(cluster)
+	}
+	consistent := func() bool {
+		for _, cluster := range clusters {
+			for _, other := range clusters {
+				if cluster == other {
+					continue
+				}
+				if _, err := cluster.leafset.getNode(other.self.ID); err != nil {
+					return false
+				}
 			}
-			break L
 		}
+		return true
 	}
-	_, err = one.table.getNode(three.self.ID)
-	if err != nil {
-		t.Logf("Error getting three from one's table")
-		t.Errorf(err.Error())
+	deadline := time.Now().Add(10 * time.Duration(bootstrap.getNetworkTimeout()) * time.Second)
+	for !consistent() {
+		if time.Now().After(deadline) {
+			for _, cluster := range clusters {
+				t.Logf("%s knows %v", cluster.self.ID, cluster.leafset.list())
+			}
+			t.Fatalf("Timeout waiting on the leaf sets to converge.")
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	_, err = two.table.getNode(three.self.ID)
-	if err != nil {
-		t.Logf("Error getting three from two's table")
-		t.Errorf(err.Error())
+}
+
+// Test that a Node rejoining with a persisted routing table that is still mostly valid skips routing a join through the Cluster, and prunes the Nodes that have left
+func TestClusterRejoin(t *testing.T) {
+	if testing.Short() {
+		return
 	}
-	_, err = three.table.getNode(one.self.ID)
-	if err != nil {
-		t.Logf("Error getting one from three's table")
-		t.Errorf(err.Error())
+	one := makeClusterWithID(NodeIDWithPrefix(1))
+	two := makeClusterWithID(NodeIDWithPrefix(9))
+	for _, cluster := range []*Cluster{one, two} {
+		cluster.SetLogLevel(LogLevelWarn)
+		startListening(t, cluster)
+		defer cluster.Kill()
 	}
-	_, err = three.table.getNode(two.self.ID)
-	if err != nil {
-		t.Logf("Error getting two from three's table")
-		t.Errorf(err.Error())
+	// wait for the joining Node to join, and for every Node to know of every other Node
+	wait := func(joining *Cluster, others ...*Cluster) {
+		deadline := time.Now().Add(10 * time.Duration(one.getNetworkTimeout()) * time.Second)
+		for {
+			done := joining.isJoined()
+			for _, cluster := range append(others, joining) {
+				done = done && cluster.KnownNodes() >= len(others)
+			}
+			if done {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timeout waiting on %s to join.", joining.self.ID)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
 	}
-	_, err = one.leafset.getNode(three.self.ID)
+	err := two.Join(one.self.LocalIP, one.self.Port)
 	if err != nil {
-		t.Logf("Error getting three from one's leaf set")
-		t.Errorf(err.Error())
+		t.Fatalf(err.Error())
 	}
-	_, err = two.leafset.getNode(three.self.ID)
+	wait(two, one)
+	// the joining Node's key is closest to two, so a cold join is routed on from one
+	cold := NewCountingMetrics()
+	one.SetMetrics(cold)
+	three := makeClusterWithID(NodeIDWithPrefix(0xa))
+	three.SetLogLevel(LogLevelWarn)
+	startListening(t, three)
+	err = three.Join(one.self.LocalIP, one.self.Port)
 	if err != nil {
-		t.Logf("Error getting three from two's leaf set")
-		t.Errorf(err.Error())
+		t.Fatalf(err.Error())
 	}
-	_, err = three.leafset.getNode(one.self.ID)
+	wait(three, one, two)
+	var persisted bytes.Buffer
+	err = three.SaveRoutingTable(&persisted)
 	if err != nil {
-		t.Logf("Error getting one from three's leaf set")
-		t.Errorf(err.Error())
+		t.Fatalf(err.Error())
 	}
-	_, err = three.leafset.getNode(two.self.ID)
+	port := three.self.Port
+	err = three.Kill()
 	if err != nil {
-		t.Logf("Error getting two from three's leaf set")
-		t.Errorf(err.Error())
+		t.Fatalf(err.Error())
 	}
-	_, err = one.neighborhoodset.getNode(three.self.ID)
+
+	warm := NewCountingMetrics()
+	one.SetMetrics(warm)
+	restarted := NewCluster(NewNode(three.self.ID, "127.0.0.1", "127.0.0.1", "testing", port), nil)
+	restarted.SetNetworkTimeout(1)
+	restarted.SetLogLevel(LogLevelWarn)
+	err = restarted.LoadRoutingTable(&persisted)
 	if err != nil {
-		t.Logf("Error getting three from one's neighborhood set")
-		t.Errorf(err.Error())
+		t.Fatalf(err.Error())
 	}
-	_, err = two.neighborhoodset.getNode(three.self.ID)
+	gone := NewNode(NodeIDWithPrefix(5), "127.0.0.1", "127.0.0.1", "testing", 1)
+	_, err = restarted.table.insertNode(*gone, 1)
 	if err != nil {
-		t.Logf("Error getting three from two's neighborhood set")
-		t.Errorf(err.Error())
+		t.Fatalf(err.Error())
 	}
-	_, err = three.neighborhoodset.getNode(one.self.ID)
+	startListening(t, restarted)
+	defer restarted.Kill()
+	err = restarted.Rejoin(*one.self)
 	if err != nil {
-		t.Logf("Error getting one from three's neighborhood set")
-		t.Errorf(err.Error())
+		t.Fatalf(err.Error())
 	}
-	_, err = three.neighborhoodset.getNode(two.self.ID)
+	wait(restarted, one, two)
+	if _, err = restarted.table.getNode(gone.ID); err != nodeNotFoundError {
+		t.Errorf("Expected the Node that left to be pruned from the routing table, got %v.", err)
+	}
+	if _, err = restarted.leafset.getNode(two.self.ID); err != nil {
+		t.Errorf("Expected two to be in the rejoined Node's leaf set: %s", err.Error())
+	}
+	if cold.Hops() < 1 || warm.Hops() != 0 {
+		t.Errorf("Expected the cold join to be routed and the rejoin not to be, got %d and %d hops.", cold.Hops(), warm.Hops())
+	}
+}
+
+// Test that Distance uses circular distance unless the XOR metric is set
+func TestClusterDistanceMetric(t *testing.T) {
+	cluster := makeClusterWithID(NodeID{0, 1})
+	key := NodeID{0xffffffffffffffff, 0xffffffffffffffff}
+	if d := cluster.Distance(key); d.Cmp(big.NewInt(2)) != 0 {
+		t.Errorf("Expected a circular distance of 2, got %s.", d)
+	}
+	cluster.SetDistanceMetric(DistanceXOR)
+	expected := NodeID{0xffffffffffffffff, 0xfffffffffffffffe}
+	if d := cluster.Distance(key); d.Cmp(expected.Base10()) != 0 {
+		t.Errorf("Expected an XOR distance of %s, got %s.", expected.Base10(), d)
+	}
+	if d := cluster.Distance(cluster.self.ID); d.Sign() != 0 {
+		t.Errorf("Expected the current Node to be no distance from itself, got %s.", d)
+	}
+}
+
+// Test that Clusters keeping 8 Nodes on each side of their leaf sets never hold more, and still route every key to the Node closest to it
+func TestClusterLeafSetSize(t *testing.T) {
+	clusters := map[NodeID]*Cluster{}
+	for i := byte(0); i < 20; i++ {
+		cluster := makeClusterWithID(NodeIDWithPrefix(i*7%16, i/16+1, i%16))
+		cluster.SetLogLevel(LogLevelWarn)
+		cluster.SetLeafSetSize(8)
+		clusters[cluster.self.ID] = cluster
+	}
+	for _, cluster := range clusters {
+		for _, other := range clusters {
+			if cluster == other {
+				continue
+			}
+			_, err := cluster.leafset.insertNode(*other.self)
+			if err != nil && err != lsFullError {
+				t.Fatalf(err.Error())
+			}
+			_, err = cluster.table.insertNode(*other.self, 10)
+			if err != nil && !errors.Is(err, ErrTableFull) {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+	for id, cluster := range clusters {
+		exported := cluster.leafset.export()
+		if len(exported[0]) != 8 || len(exported[1]) != 8 || cluster.leafset.leftCount() != 8 || cluster.leafset.rightCount() != 8 {
+			t.Errorf("Expected %s to hold 8 Nodes on each side of its leaf set, got %d and %d slots holding %d and %d Nodes.", id, len(exported[0]), len(exported[1]), cluster.leafset.leftCount(), cluster.leafset.rightCount())
+		}
+		if capacity := cluster.Health().LeafSetCapacity; capacity != 16 {
+			t.Errorf("Expected %s to report a leaf set capacity of 16, got %d.", id, capacity)
+		}
+	}
+	for i := byte(0); i < 16; i++ {
+		key := NodeIDWithPrefix(i, 15-i, 3)
+		var closest NodeID
+		for id := range clusters {
+			if closest.IsZero() || key.closer(id, closest) {
+				closest = id
+			}
+		}
+		for id := range clusters {
+			current, hops := clusters[id], 0
+			for {
+				next, err := current.Route(key)
+				if err != nil {
+					t.Fatalf(err.Error())
+				}
+				if next == nil {
+					break
+				}
+				current, hops = clusters[next.ID], hops+1
+				if current == nil || hops > len(clusters) {
+					t.Fatalf("Expected %s to be routed from %s through known Nodes without looping, got %v after %d hops.", key, id, next, hops)
+				}
+			}
+			if !current.self.ID.Equals(closest) {
+				t.Errorf("Expected %s to be routed from %s to %s, got %s.", key, id, closest, current.self.ID)
+			}
+		}
+	}
+}
+
+// Test that a consistent Cluster reports no issues, while a deliberately corrupted leaf set, and a Node missing from it, are reported
+func TestClusterCheckConsistency(t *testing.T) {
+	cluster := makeClusterWithID(NodeID{0, 1000})
+	cluster.SetLogLevel(LogLevelWarn)
+	cluster.SetLeafSetSize(4)
+	for _, id := range []NodeID{{0, 998}, {0, 999}, {0, 1001}, {0, 1002}} {
+		node := *NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+		_, err := cluster.leafset.insertNode(node)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = cluster.table.insertNode(node, 10)
+		if err != nil && !errors.Is(err, ErrTableFull) {
+			t.Fatalf(err.Error())
+		}
+	}
+	if issues := cluster.CheckConsistency(); len(issues) != 0 {
+		t.Fatalf("Expected no issues, got %v.", issues)
+	}
+	left := cluster.leafset.left
+	left[0], left[1] = left[1], left[0]
+	cluster.leafset.right[3] = NewNode(NodeID{0, 1003}, "127.0.0.2", "127.0.0.2", "testing", 55555)
+	_, err := cluster.table.insertNode(*NewNode(NodeID{0, 1005}, "127.0.0.2", "127.0.0.2", "testing", 55555), 10)
 	if err != nil {
-		t.Logf("Error getting two from three's neighborhood set")
-		t.Errorf(err.Error())
+		t.Fatalf(err.Error())
+	}
+	expected := map[string]NodeID{
+		ConsistencyLeafSetOrder: {0, 999},
+		ConsistencyLeafSetGap:   {0, 1003},
+		ConsistencyMissingLeaf:  {0, 1005},
+	}
+	issues := cluster.CheckConsistency()
+	if len(issues) != len(expected) {
+		t.Fatalf("Expected %d issues, got %v.", len(expected), issues)
+	}
+	for _, issue := range issues {
+		if id, ok := expected[issue.Kind]; !ok || issue.Node != id {
+			t.Errorf("Unexpected issue %q about %s: %s", issue.Kind, issue.Node, issue.Detail)
+		}
 	}
-	return
 }
@@ -2,33 +2,73 @@ package wendy
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"math/big"
 	"os"
+	"sort"
 	"sync"
 )
 
+// leafSet holds the Nodes with the IDs closest to the current Node's ID. left holds the Nodes with lesser IDs and right holds the Nodes with greater IDs, each ordered from closest to furthest. Both sides always have as many slots as the leafSet's size; empty slots are nil, and come after every Node. lock guards left and right, like the routingTable's lock: every method takes it for as long as it reads or changes them, so a leafSet is safe to use from several goroutines at once, and unexported helpers that expect the caller to hold it say so.
 type leafSet struct {
 	self     *Node
-	left     [16]*Node
-	right    [16]*Node
-	log      *log.Logger
+	left     []*Node
+	right    []*Node
+	log      Logger
 	logLevel int
 	lock     *sync.RWMutex
 }
 
+// defaultLeafSetSize is the number of Nodes each side of the leafSet holds, unless Cluster.SetLeafSetSize is used.
+const defaultLeafSetSize = 16
+
 func newLeafSet(self *Node) *leafSet {
 	return &leafSet{
 		self:     self,
-		left:     [16]*Node{},
-		right:    [16]*Node{},
-		log:      log.New(os.Stdout, "wendy#leafSet("+self.ID.String()+")", log.LstdFlags),
+		left:     make([]*Node, defaultLeafSetSize),
+		right:    make([]*Node, defaultLeafSetSize),
+		log:      NewLogger(log.New(os.Stdout, "wendy#leafSet("+self.ID.String()+")", log.LstdFlags)),
 		logLevel: LogLevelWarn,
 		lock:     new(sync.RWMutex),
 	}
 }
 
+// setSize sets the number of Nodes each side of the leafSet holds, dropping the furthest Nodes from a side that holds more, and returning them. Values less than 1 are treated as 1.
+func (l *leafSet) setSize(size int) []*Node {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if size < 1 {
+		size = 1
+	}
+	dropped := []*Node{}
+	for _, side := range []*[]*Node{&l.left, &l.right} {
+		nodes := make([]*Node, size)
+		copy(nodes, *side)
+		for i := size; i < len(*side); i++ {
+			if (*side)[i] != nil {
+				dropped = append(dropped, (*side)[i])
+			}
+		}
+		*side = nodes
+	}
+	if len(dropped) > 0 {
+		l.self.incrementLSVersion()
+	}
+	return dropped
+}
+
+// size returns the number of Nodes each side of the leafSet can hold.
+func (l *leafSet) size() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return len(l.left)
+}
+
 var lsDuplicateInsertError = errors.New("Node already exists in leaf set.")
+var lsFullError = fmt.Errorf("%w: Node is further than every Node on its side of the leaf set.", ErrTableFull)
 
+// insertNode inserts the Node into the side of the leafSet it belongs on, returning the inserted Node. A Node further from the current Node than every Node on a full side isn't inserted, and lsFullError, which wraps ErrTableFull, is returned, so callers can tell it apart from a Node that was inserted; a Node that is already in the leafSet returns lsDuplicateInsertError.
 func (l *leafSet) insertNode(node Node) (*Node, error) {
 	return l.insertValues(node.ID, node.LocalIP, node.GlobalIP, node.Region, node.Port, node.routingTableVersion, node.leafsetVersion, node.neighborhoodSetVersion)
 }
@@ -38,12 +78,12 @@ func (l *leafSet) insertValues(id NodeID, localIP, globalIP, region string, port
 	defer l.lock.Unlock()
 	node := NewNode(id, localIP, globalIP, region, port)
 	node.updateVersions(rTVersion, lSVersion, nSVersion)
-	side := l.self.ID.RelPos(node.ID)
+	side := node.ID.RelPos(l.self.ID)
 	var inserted, contained bool
 	if side == -1 {
 		l.left, contained, inserted = node.insertIntoArray(l.left, l.self)
 		if !contained {
-			return nil, nil
+			return nil, lsFullError
 		} else if !inserted {
 			return nil, lsDuplicateInsertError
 		} else {
@@ -53,7 +93,7 @@ func (l *leafSet) insertValues(id NodeID, localIP, globalIP, region string, port
 	} else if side == 1 {
 		l.right, contained, inserted = node.insertIntoArray(l.right, l.self)
 		if !contained {
-			return nil, nil
+			return nil, lsFullError
 		} else if !inserted {
 			return nil, lsDuplicateInsertError
 		} else {
@@ -67,7 +107,7 @@ func (l *leafSet) insertValues(id NodeID, localIP, globalIP, region string, port
 func (l *leafSet) getNode(id NodeID) (*Node, error) {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
-	side := l.self.ID.RelPos(id)
+	side := id.RelPos(l.self.ID)
 	if side == -1 {
 		for _, node := range l.left {
 			if node == nil {
@@ -92,105 +132,230 @@ func (l *leafSet) getNode(id NodeID) (*Node, error) {
 	return nil, nodeNotFoundError
 }
 
+// getNextNode returns the Node to ask for help repairing the leafSet after the Node with the specified ID was removed. That is the furthest Node on the same side of the leafSet as the removed Node or, if that side is empty, the furthest Node on the other side.
 func (l *leafSet) getNextNode(id NodeID) (*Node, error) {
+	side := id.RelPos(l.self.ID)
+	if side == 0 {
+		return nil, throwIdentityError("get next", "from", "leaf set")
+	}
+	return l.furthest(side)
+}
+
+// furthest returns the furthest Node on the specified side of the leafSet, -1 for the left and 1 for the right or, if that side is empty, the furthest Node on the other side.
+func (l *leafSet) furthest(side int) (*Node, error) {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
-	side := l.self.ID.RelPos(id)
-	last := -1
+	same, other := l.right, l.left
 	if side == -1 {
-		for pos, node := range l.left {
-			if node == nil {
-				continue
-			} else {
-				last = pos
-				if node.ID.Less(id) {
-					return node, nil
-				}
-				continue
+		same, other = l.left, l.right
+	}
+	for _, nodes := range [][]*Node{same, other} {
+		for i := len(nodes) - 1; i >= 0; i-- {
+			if nodes[i] != nil {
+				return nodes[i], nil
 			}
 		}
-		if last > -1 {
-			return l.left[last], nil
+	}
+	return nil, nodeNotFoundError
+}
+
+// isEmpty returns true if there are no Nodes on either side of the leafSet, e.g., on a new Cluster with only the current Node in it.
+func (l *leafSet) isEmpty() bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.left[0] == nil && l.right[0] == nil
+}
+
+// leftCount returns the number of Nodes on the left of the leafSet, which precede the current Node. Empty slots aren't counted.
+func (l *leafSet) leftCount() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return countNodes(l.left)
+}
+
+// rightCount returns the number of Nodes on the right of the leafSet, which succeed the current Node. Empty slots aren't counted.
+func (l *leafSet) rightCount() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return countNodes(l.right)
+}
+
+func countNodes(nodes []*Node) int {
+	count := 0
+	for _, node := range nodes {
+		if node != nil && !node.isZero() {
+			count++
 		}
-		return nil, nodeNotFoundError
-	} else if side == 1 {
-		for pos, node := range l.right {
+	}
+	return count
+}
+
+// neighbors returns the current Node's immediate predecessor and successor in the leafSet. If one side of the leafSet is empty, the Cluster is small enough that the furthest Node on the other side is the neighbor on the empty side, wrapping around the node space. Both are nil if the leafSet is empty.
+func (l *leafSet) neighbors() (*Node, *Node) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	furthest := func(nodes []*Node) *Node {
+		var last *Node
+		for _, node := range nodes {
 			if node == nil {
-				continue
-			} else {
-				last = pos
-				if id.Less(node.ID) {
-					return node, nil
-				}
-				continue
+				break
 			}
+			last = node
 		}
-		if last > -1 {
-			return l.left[last], nil
-		}
+		return last
+	}
+	pred, succ := l.left[0], l.right[0]
+	if pred == nil {
+		pred = furthest(l.right)
+	}
+	if succ == nil {
+		succ = furthest(l.left)
+	}
+	return pred, succ
+}
+
+// closest returns the Node in the leafSet whose ID is closest to the current Node's ID, i.e., the current Node's immediate successor or predecessor, whichever is closer. If both are exactly as close, the lesser is returned, as in NodeID.closer.
+func (l *leafSet) closest() (*Node, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	left, right := l.left[0], l.right[0]
+	if left == nil && right == nil {
 		return nil, nodeNotFoundError
-	} else {
-		return nil, throwIdentityError("get next", "from", "leaf set")
 	}
-	return nil, nodeNotFoundError
+	if left == nil {
+		return right, nil
+	}
+	if right == nil || !l.self.ID.closer(right.ID, left.ID) {
+		return left, nil
+	}
+	return right, nil
 }
 
 func (l *leafSet) route(key NodeID) (*Node, error) {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
-	side := l.self.ID.RelPos(key)
-	best_score := l.self.ID.Diff(key)
+	if !l.inRange(key) {
+		return nil, nodeNotFoundError
+	}
+	side := key.RelPos(l.self.ID)
 	best := l.self
-	biggest := l.self.ID
+	nodes := l.right
 	if side == -1 {
-		for _, node := range l.left {
-			if node == nil {
-				break
-			}
-			diff := key.Diff(node.ID)
-			if diff.Cmp(best_score) == -1 || (diff.Cmp(best_score) == 0 && node.ID.Less(best.ID)) {
-				best = node
-				best_score = diff
-			}
-			biggest = node.ID
+		nodes = l.left
+	}
+	for _, node := range nodes {
+		if node == nil {
+			break
 		}
-	} else {
-		for _, node := range l.right {
-			if node == nil {
-				break
-			}
-			diff := key.Diff(node.ID)
-			if diff.Cmp(best_score) == -1 || (diff.Cmp(best_score) == 0 && node.ID.Less(best.ID)) {
-				best = node
-				best_score = diff
-			}
-			biggest = node.ID
+		if key.closer(node.ID, best.ID) {
+			best = node
 		}
 	}
-	if biggest.Less(key) {
-		return nil, nodeNotFoundError
-	}
 	if !best.ID.Equals(l.self.ID) {
 		return best, nil
-	} else {
-		return nil, throwIdentityError("route to", "in", "leaf set")
 	}
-	return nil, nodeNotFoundError
+	return nil, throwIdentityError("route to", "in", "leaf set")
 }
 
-func (l *leafSet) export() [2][16]*Node {
+// covers returns true if the key falls between the furthest Nodes on the left and right of the leafSet, inclusive. An empty leafSet covers every key, as the current Node is the only Node it knows of.
+func (l *leafSet) covers(key NodeID) bool {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
-	return [2][16]*Node{l.left, l.right}
+	return l.inRange(key)
 }
 
+// inRange does the work for covers. The caller must hold the leafSet's lock.
+func (l *leafSet) inRange(key NodeID) bool {
+	side := key.RelPos(l.self.ID)
+	if side == 0 || (l.left[0] == nil && l.right[0] == nil) {
+		return true
+	}
+	nodes := l.right
+	if side == -1 {
+		nodes = l.left
+	}
+	furthest := l.self.ID
+	for _, node := range nodes {
+		if node == nil {
+			break
+		}
+		furthest = node.ID
+	}
+	if side == -1 {
+		return !key.Less(furthest)
+	}
+	return !furthest.Less(key)
+}
+
+// replicaSet returns up to k Nodes from the leafSet and the current Node that are numerically closest to the key, ordered from closest to furthest. If k is larger than the number of Nodes available, all of them are returned.
+func (l *leafSet) replicaSet(key NodeID, k int) []*Node {
+	nodes := append(l.list(), l.self)
+	sort.Slice(nodes, func(i, j int) bool {
+		return key.closer(nodes[i].ID, nodes[j].ID)
+	})
+	if k < 0 {
+		k = 0
+	}
+	if k < len(nodes) {
+		nodes = nodes[:k]
+	}
+	return nodes
+}
+
+// estimateSize returns a rough estimate of the number of Nodes in the Cluster, based on how much of the node space the leafSet spans. If the leafSet isn't full, it is assumed to hold every other Node in the Cluster.
+func (l *leafSet) estimateSize() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.left[len(l.left)-1] == nil || l.right[len(l.right)-1] == nil {
+		// a Node can be on both sides while there are too few Nodes to fill them
+		seen := map[NodeID]bool{}
+		for _, array := range [][]*Node{l.left, l.right} {
+			for _, node := range array {
+				if node != nil {
+					seen[node.ID] = true
+				}
+			}
+		}
+		return len(seen) + 1
+	}
+	span := l.self.ID.Diff(l.left[len(l.left)-1].ID)
+	span.Add(span, l.self.ID.Diff(l.right[len(l.right)-1].ID))
+	if span.Sign() == 0 {
+		return len(l.left) + len(l.right) + 1
+	}
+	// the leafSet's Nodes are spread over span, so the whole node space holds about 2^128 * Nodes / span of them
+	estimate := new(big.Int).Lsh(big.NewInt(int64(len(l.left)+len(l.right))), 128)
+	estimate.Div(estimate, span)
+	if !estimate.IsInt64() || estimate.Int64() > int64(^uint(0)>>1) {
+		return int(^uint(0) >> 1)
+	}
+	return int(estimate.Int64())
+}
+
+// export returns a copy of the left and right sides of the leafSet. The Nodes are copies too, so changing them doesn't change the leafSet.
+func (l *leafSet) export() [2][]*Node {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	nodes := [2][]*Node{}
+	for side, array := range [2][]*Node{l.left, l.right} {
+		nodes[side] = make([]*Node, len(array))
+		for i, node := range array {
+			if node != nil {
+				nodes[side][i] = node.copy()
+			}
+		}
+	}
+	return nodes
+}
+
+// list returns the Nodes in the leafSet in ring order, from the furthest Node on the left to the furthest Node on the right. Empty slots are skipped.
 func (l *leafSet) list() []*Node {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
 	nodes := []*Node{}
-	for _, node := range l.left {
-		if node != nil {
-			nodes = append(nodes, node)
+	for i := len(l.left) - 1; i >= 0; i-- {
+		if l.left[i] != nil {
+			nodes = append(nodes, l.left[i])
 		}
 	}
 	for _, node := range l.right {
@@ -201,8 +366,73 @@ func (l *leafSet) list() []*Node {
 	return nodes
 }
 
-func (node *Node) insertIntoArray(array [16]*Node, center *Node) ([16]*Node, bool, bool) {
-	var result [16]*Node
+// check returns the ways the leafSet breaks its own invariants: each side holding only Nodes from that side of the current Node, ordered from closest to furthest, with every empty slot after every Node, and no Node held twice.
+func (l *leafSet) check() []ConsistencyIssue {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	issues := []ConsistencyIssue{}
+	seen := map[NodeID]bool{}
+	sides := []struct {
+		side  int
+		name  string
+		nodes []*Node
+	}{
+		{-1, "left", l.left},
+		{1, "right", l.right},
+	}
+	for _, side := range sides {
+		var prev *Node
+		gap := false
+		for i, node := range side.nodes {
+			if node == nil {
+				gap = true
+				continue
+			}
+			if gap {
+				issues = append(issues, ConsistencyIssue{Kind: ConsistencyLeafSetGap, Node: node.ID, Detail: fmt.Sprintf("Node is in slot %d on the %s of the leaf set, after an empty slot.", i, side.name)})
+			}
+			if node.ID.RelPos(l.self.ID) != side.side {
+				issues = append(issues, ConsistencyIssue{Kind: ConsistencyLeafSetSide, Node: node.ID, Detail: fmt.Sprintf("Node is on the %s of the leaf set, but its ID is on the other side of the current Node.", side.name)})
+			}
+			if seen[node.ID] {
+				issues = append(issues, ConsistencyIssue{Kind: ConsistencyLeafSetDuplicate, Node: node.ID, Detail: "Node is in the leaf set more than once."})
+			}
+			seen[node.ID] = true
+			if prev != nil && l.self.ID.Diff(node.ID).Cmp(l.self.ID.Diff(prev.ID)) < 0 {
+				issues = append(issues, ConsistencyIssue{Kind: ConsistencyLeafSetOrder, Node: node.ID, Detail: fmt.Sprintf("Node is closer to the current Node than %s, which comes before it on the %s of the leaf set.", prev.ID, side.name)})
+			}
+			prev = node
+		}
+	}
+	return issues
+}
+
+// belongs returns true if a Node with the specified ID isn't in the leafSet, but would be inserted if it were offered: its side of the leafSet has an empty slot, or holds a Node further from the current Node than it.
+func (l *leafSet) belongs(id NodeID) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	side := id.RelPos(l.self.ID)
+	if side == 0 {
+		return false
+	}
+	for _, node := range append(append([]*Node{}, l.left...), l.right...) {
+		if node != nil && node.ID.Equals(id) {
+			return false
+		}
+	}
+	nodes := l.right
+	if side == -1 {
+		nodes = l.left
+	}
+	if countNodes(nodes) < len(nodes) {
+		return true
+	}
+	furthest := nodes[len(nodes)-1]
+	return l.self.ID.Diff(id).Cmp(l.self.ID.Diff(furthest.ID)) < 0
+}
+
+func (node *Node) insertIntoArray(array []*Node, center *Node) ([]*Node, bool, bool) {
+	result := make([]*Node, len(array))
 	result_index := 0
 	src_index := 0
 	pos := -1
@@ -218,7 +448,12 @@ func (node *Node) insertIntoArray(array [16]*Node, center *Node) ([16]*Node, boo
 			break
 		}
 		if node.ID.Equals(array[src_index].ID) {
+			// replace the existing entry, so the Node's latest addresses are kept
 			node.updateVersions(array[src_index].routingTableVersion, array[src_index].leafsetVersion, array[src_index].neighborhoodSetVersion)
+			if node.getRawProximity() < 0 {
+				node.setProximity(array[src_index].getRawProximity())
+			}
+			result[result_index] = node
 			pos = result_index
 			result_index += 1
 			src_index += 1
@@ -239,7 +474,7 @@ func (node *Node) insertIntoArray(array [16]*Node, center *Node) ([16]*Node, boo
 func (l *leafSet) removeNode(id NodeID) (*Node, error) {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	side := l.self.ID.RelPos(id)
+	side := id.RelPos(l.self.ID)
 	if side == 0 {
 		return nil, throwIdentityError("remove", "from", "leaf set")
 	}
@@ -262,7 +497,7 @@ func (l *leafSet) removeNode(id NodeID) (*Node, error) {
 			}
 		}
 	}
-	if pos == -1 || (side == -1 && pos > len(l.left)) || (side == 1 && pos > len(l.right)) {
+	if n == nil || pos == -1 || (side == -1 && pos > len(l.left)) || (side == 1 && pos > len(l.right)) {
 		return nil, nodeNotFoundError
 	}
 	var slice []*Node
@@ -307,18 +542,18 @@ func (l *leafSet) removeNode(id NodeID) (*Node, error) {
 
 func (l *leafSet) debug(format string, v ...interface{}) {
 	if l.logLevel <= LogLevelDebug {
-		l.log.Printf(format, v...)
+		l.log.Debugf(format, v...)
 	}
 }
 
 func (l *leafSet) warn(format string, v ...interface{}) {
 	if l.logLevel <= LogLevelWarn {
-		l.log.Printf(format, v...)
+		l.log.Warnf(format, v...)
 	}
 }
 
 func (l *leafSet) err(format string, v ...interface{}) {
 	if l.logLevel <= LogLevelError {
-		l.log.Printf(format, v...)
+		l.log.Errorf(format, v...)
 	}
 }
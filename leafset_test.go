@@ -1,6 +1,8 @@
 package wendy
 
 import (
+	"errors"
+	"sync"
 	"testing"
 )
 
@@ -40,6 +42,110 @@ func TestLeafSetinsertNode(t *testing.T) {
 	}
 }
 
+// Test that nodes with lesser IDs are inserted on the left and greater IDs on the right, wrapping around the node space
+func TestLeafSetInsertSides(t *testing.T) {
+	self_id := NodeID{0, 0}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	below := NewNode(NodeID{0xffffffffffffffff, 0xffffffffffffffff}, "127.0.0.2", "127.0.0.2", "testing", 55555)
+	above := NewNode(NodeID{0, 1}, "127.0.0.3", "127.0.0.3", "testing", 55555)
+	_, err := leafset.insertNode(*below)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = leafset.insertNode(*above)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if leafset.left[0] == nil || !leafset.left[0].ID.Equals(below.ID) {
+		t.Errorf("Expected %s on the left, got %v.", below.ID, leafset.left[0])
+	}
+	if leafset.right[0] == nil || !leafset.right[0].ID.Equals(above.ID) {
+		t.Errorf("Expected %s on the right, got %v.", above.ID, leafset.right[0])
+	}
+	_, err = leafset.insertNode(*self)
+	if _, ok := err.(IdentityError); !ok {
+		t.Errorf("Expected IdentityError inserting self, got %v.", err)
+	}
+}
+
+// Test that re-inserting a node updates its entry instead of adding another
+func TestLeafSetInsertDuplicate(t *testing.T) {
+	self := NewNode(NodeID{0x8000000000000000, 0}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	id := NodeID{0x9000000000000000, 0}
+	_, err := leafset.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = leafset.insertNode(*NewNode(NodeID{0xa000000000000000, 0}, "127.0.0.2", "127.0.0.2", "testing", 55555))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = leafset.insertNode(*NewNode(id, "127.0.0.3", "127.0.0.3", "testing", 55555))
+	if err != lsDuplicateInsertError {
+		t.Errorf("Expected lsDuplicateInsertError, got %v.", err)
+	}
+	if nodes := leafset.list(); len(nodes) != 2 {
+		t.Errorf("Expected %d nodes in the leafset, got %d.", 2, len(nodes))
+	}
+	node, err := leafset.getNode(id)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if node.LocalIP != "127.0.0.3" {
+		t.Errorf("Expected entry to be updated to %s, got %s.", "127.0.0.3", node.LocalIP)
+	}
+}
+
+// Test that a full side of the leafset drops its furthest node when a closer node is inserted
+func TestLeafSetInsertFull(t *testing.T) {
+	self_id := NodeID{0, 0}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	for i := 2; i < len(leafset.right)+2; i++ {
+		node := NewNode(NodeID{0, uint64(i * 2)}, "127.0.0.2", "127.0.0.2", "testing", 55555)
+		r, err := leafset.insertNode(*node)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if r == nil {
+			t.Fatalf("Insert of %s returned nil.", node.ID)
+		}
+	}
+	furthest := leafset.right[len(leafset.right)-1].ID
+	// a node further away than every node on a full side isn't inserted
+	r, err := leafset.insertNode(*NewNode(NodeID{0, 1000}, "127.0.0.3", "127.0.0.3", "testing", 55555))
+	if !errors.Is(err, ErrTableFull) {
+		t.Errorf("Expected ErrTableFull, got %v.", err)
+	}
+	if r != nil {
+		t.Errorf("Expected a node beyond a full side not to be inserted, got %s.", r.ID)
+	}
+	closer := NewNode(NodeID{0, 1}, "127.0.0.3", "127.0.0.3", "testing", 55555)
+	r, err = leafset.insertNode(*closer)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if r == nil {
+		t.Fatal("Insert of closer node returned nil.")
+	}
+	if !leafset.right[0].ID.Equals(closer.ID) {
+		t.Errorf("Expected %s to be the closest node, got %s.", closer.ID, leafset.right[0].ID)
+	}
+	for i, node := range leafset.right {
+		if node == nil {
+			t.Fatalf("Expected the right side to be full, position %d was empty.", i)
+		}
+		if node.ID.Equals(furthest) {
+			t.Errorf("Expected %s to be dropped from the leafset, found it at position %d.", furthest, i)
+		}
+		if i > 0 && !leafset.right[i-1].ID.Less(node.ID) {
+			t.Errorf("Right side out of order at position %d.", i)
+		}
+	}
+}
+
 // Test deleting the only node from the leafset
 func TestLeafSetDeleteOnly(t *testing.T) {
 	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
@@ -406,6 +512,185 @@ func TestLeafSetScanSplit(t *testing.T) {
 	}
 }
 
+// Test routing to keys inside, exactly at, and beyond the nodes on each side of the leafset
+func TestLeafSetRouteSides(t *testing.T) {
+	self := NewNode(NodeID{0x8000000000000000, 0}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	ids := []NodeID{
+		{0x7000000000000000, 0},
+		{0x6000000000000000, 0},
+		{0x9000000000000000, 0},
+		{0xa000000000000000, 0},
+	}
+	for _, id := range ids {
+		_, err := leafset.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tests := [...]struct {
+		key      NodeID
+		expected NodeID
+		found    bool
+	}{
+		// inside the left side, closest to a member
+		{NodeID{0x6100000000000000, 0}, ids[1], true},
+		// inside the right side, closest to a member
+		{NodeID{0x9f00000000000000, 0}, ids[3], true},
+		// exactly a member
+		{ids[0], ids[0], true},
+		{ids[2], ids[2], true},
+		// beyond the furthest node on either side
+		{NodeID{0x5000000000000000, 0}, NodeID{}, false},
+		{NodeID{0xb000000000000000, 0}, NodeID{}, false},
+	}
+	for i, test := range tests {
+		r, err := leafset.route(test.key)
+		if !test.found {
+			if err != nodeNotFoundError {
+				t.Errorf("test %v: expected nodeNotFoundError routing to %s, got %v", i, test.key, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %v: unexpected error %v", i, err)
+			continue
+		}
+		if !r.ID.Equals(test.expected) {
+			t.Errorf("test %v: expected %s, got %s", i, test.expected, r.ID)
+		}
+	}
+	// a key closer to the current node than to any member is delivered locally
+	_, err := leafset.route(NodeID{0x8100000000000000, 0})
+	if _, ok := err.(IdentityError); !ok {
+		t.Errorf("Expected IdentityError routing to a key closest to self, got %v.", err)
+	}
+}
+
+// Test that the leafset covers keys up to and including its furthest nodes on both sides
+func TestLeafSetCovers(t *testing.T) {
+	self := NewNode(NodeID{0, 0x10}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	left := NodeID{0xffffffffffffffff, 0xfffffffffffffff0}
+	right := NodeID{0, 0x20}
+	for _, id := range []NodeID{left, {0, 1}, right, {0, 0x15}} {
+		_, err := leafset.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tests := [...]struct {
+		key    NodeID
+		covers bool
+	}{
+		{self.ID, true},
+		{NodeID{0, 0}, true},
+		{left, true},
+		{NodeID{0xffffffffffffffff, 0xffffffffffffffef}, false},
+		{right, true},
+		{NodeID{0, 0x21}, false},
+	}
+	for i, test := range tests {
+		if covers := leafset.covers(test.key); covers != test.covers {
+			t.Errorf("test %v: expected covers(%s) to be %v, got %v", i, test.key, test.covers, covers)
+		}
+	}
+}
+
+// Test that listing a partially filled leafset skips empty slots and returns the nodes in ring order
+func TestLeafSetList(t *testing.T) {
+	self := NewNode(NodeID{0x8000000000000000, 0}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	if nodes := leafset.list(); len(nodes) != 0 {
+		t.Errorf("Expected empty leafset to list %d nodes, got %d.", 0, len(nodes))
+	}
+	expected := []NodeID{{0x6000000000000000, 0}, {0x7000000000000000, 0}, {0x9000000000000000, 0}, {0xa000000000000000, 0}, {0xb000000000000000, 0}}
+	for _, id := range []NodeID{expected[3], expected[0], expected[2], expected[4], expected[1]} {
+		if _, err := leafset.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	nodes := leafset.list()
+	if len(nodes) != len(expected) {
+		t.Fatalf("Expected %d nodes, got %d.", len(expected), len(nodes))
+	}
+	for i, node := range nodes {
+		if !node.ID.Equals(expected[i]) {
+			t.Errorf("Expected node %d to be %s, got %s instead.", i, expected[i], node.ID)
+		}
+	}
+}
+
+// Test that the replica set for a key is made of the nodes closest to it, whichever side of the current node they're on
+func TestLeafSetReplicaSet(t *testing.T) {
+	self := NewNode(NodeID{0x8000000000000000, 0}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	for _, id := range []NodeID{{0x6000000000000000, 0}, {0x7000000000000000, 0}, {0x9000000000000000, 0}, {0xa000000000000000, 0}} {
+		if _, err := leafset.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	key := NodeID{0x8100000000000000, 0}
+	tests := [...]struct {
+		k        int
+		expected []NodeID
+	}{
+		{0, []NodeID{}},
+		{1, []NodeID{self.ID}},
+		{3, []NodeID{self.ID, {0x9000000000000000, 0}, {0x7000000000000000, 0}}},
+		{10, []NodeID{self.ID, {0x9000000000000000, 0}, {0x7000000000000000, 0}, {0xa000000000000000, 0}, {0x6000000000000000, 0}}},
+	}
+	for i, test := range tests {
+		nodes := leafset.replicaSet(key, test.k)
+		if len(nodes) != len(test.expected) {
+			t.Errorf("test %v: expected %d nodes, got %d", i, len(test.expected), len(nodes))
+			continue
+		}
+		for j, node := range nodes {
+			if !node.ID.Equals(test.expected[j]) {
+				t.Errorf("test %v: expected node %d to be %s, got %s", i, j, test.expected[j], node.ID)
+			}
+		}
+	}
+}
+
+// Test choosing which node to ask for help repairing the leafset
+func TestLeafSetGetNextNode(t *testing.T) {
+	self := NewNode(NodeID{0x8000000000000000, 0}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	removed := NodeID{0x7f00000000000000, 0}
+	if _, err := leafset.getNextNode(removed); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError from an empty leafset, got %v.", err)
+	}
+	right := []NodeID{{0x9000000000000000, 0}, {0xa000000000000000, 0}}
+	for _, id := range right {
+		if _, err := leafset.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	// with nothing left on the removed node's side, the furthest node on the other side is used
+	r, err := leafset.getNextNode(removed)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !r.ID.Equals(right[1]) {
+		t.Errorf("Expected %s, got %s.", right[1], r.ID)
+	}
+	left := []NodeID{{0x7000000000000000, 0}, {0x6000000000000000, 0}}
+	for _, id := range left {
+		if _, err := leafset.insertNode(*NewNode(id, "127.0.0.3", "127.0.0.3", "testing", 55555)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	r, err = leafset.getNextNode(removed)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !r.ID.Equals(left[1]) {
+		t.Errorf("Expected %s, got %s.", left[1], r.ID)
+	}
+}
+
 // Test routing to the only node in the leafset
 func TestLeafSetRouteOnly(t *testing.T) {
 	self_id, err := NodeIDFromBytes([]byte("1234567890abcdeg"))
@@ -691,3 +976,329 @@ func BenchmarkLeafSetExport(b *testing.B) {
 		benchLeafSet.export()
 	}
 }
+
+// Test estimating the size of the Cluster from the leaf set
+func TestLeafSetEstimateSize(t *testing.T) {
+	self := NewNode(NodeID{0, 0}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	if size := leafset.estimateSize(); size != 1 {
+		t.Errorf("Expected an empty leaf set to estimate %d Nodes, got %d.", 1, size)
+	}
+	// Nodes evenly spaced around a ring of 1024, so each is 2^118 away from the next
+	for i := uint64(1); i <= 16; i++ {
+		_, err := leafset.insertNode(*NewNode(NodeID{i << 54, 0}, "127.0.0.2", "127.0.0.2", "testing", 55555))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if i == 3 {
+			if size := leafset.estimateSize(); size != 6 {
+				t.Errorf("Expected a leaf set that isn't full to estimate %d Nodes, got %d.", 6, size)
+			}
+		}
+		_, err = leafset.insertNode(*NewNode(NodeID{-(i << 54), 0}, "127.0.0.3", "127.0.0.3", "testing", 55555))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if size := leafset.estimateSize(); size != 1024 {
+		t.Errorf("Expected a full leaf set to estimate %d Nodes, got %d.", 1024, size)
+	}
+}
+
+// Test that the closest Node is found whichever side of the leaf set it is on
+func TestLeafSetClosest(t *testing.T) {
+	self := NewNode(NodeID{0, 1000}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	if _, err := leafset.closest(); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError from an empty leaf set, got %v.", err)
+	}
+	tests := []struct {
+		id       NodeID
+		expected NodeID
+	}{
+		{NodeID{0, 1100}, NodeID{0, 1100}},
+		// more Nodes on the left, but all further away than the one on the right
+		{NodeID{0, 800}, NodeID{0, 1100}},
+		{NodeID{0, 850}, NodeID{0, 1100}},
+		{NodeID{0, 880}, NodeID{0, 1100}},
+		{NodeID{0, 950}, NodeID{0, 950}},
+		{NodeID{0, 1050}, NodeID{0, 950}},
+	}
+	for i, test := range tests {
+		_, err := leafset.insertNode(*NewNode(test.id, "127.0.0.2", "127.0.0.2", "testing", 55555))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		closest, err := leafset.closest()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !closest.ID.Equals(test.expected) {
+			t.Errorf("test %v: expected %s to be closest, got %s", i, test.expected, closest.ID)
+		}
+	}
+}
+
+// Test that each side of an asymmetric leaf set reports how many Nodes it holds, and which Node to ask to fill it
+func TestLeafSetSideCounts(t *testing.T) {
+	self := NewNode(NodeID{0, 1000}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	if left, right := leafset.leftCount(), leafset.rightCount(); left != 0 || right != 0 {
+		t.Errorf("Expected an empty leaf set to have no Nodes on either side, got %d and %d.", left, right)
+	}
+	if _, err := leafset.furthest(-1); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError from an empty leaf set, got %v.", err)
+	}
+	for i := uint64(1); i <= 5; i++ {
+		_, err := leafset.insertNode(*NewNode(NodeID{0, 1000 - i}, "127.0.0.2", "127.0.0.2", "testing", 55555))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if left, right := leafset.leftCount(), leafset.rightCount(); left != 5 || right != 0 {
+		t.Errorf("Expected %d Nodes on the left and %d on the right, got %d and %d.", 5, 0, left, right)
+	}
+	// the right side is empty, so the furthest Node on the left is asked instead
+	if furthest, err := leafset.furthest(1); err != nil || !furthest.ID.Equals(NodeID{0, 995}) {
+		t.Errorf("Expected %s to be asked to fill the right side, got %v (%v).", NodeID{0, 995}, furthest, err)
+	}
+	for i := uint64(1); i <= 2; i++ {
+		_, err := leafset.insertNode(*NewNode(NodeID{0, 1000 + i}, "127.0.0.3", "127.0.0.3", "testing", 55555))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if left, right := leafset.leftCount(), leafset.rightCount(); left != 5 || right != 2 {
+		t.Errorf("Expected %d Nodes on the left and %d on the right, got %d and %d.", 5, 2, left, right)
+	}
+	if furthest, err := leafset.furthest(1); err != nil || !furthest.ID.Equals(NodeID{0, 1002}) {
+		t.Errorf("Expected %s to be furthest on the right, got %v (%v).", NodeID{0, 1002}, furthest, err)
+	}
+	_, err := leafset.removeNode(NodeID{0, 997})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if left := leafset.leftCount(); left != 4 {
+		t.Errorf("Expected %d Nodes on the left after removing one, got %d.", 4, left)
+	}
+}
+
+// Test that every leaf set method copes with a leaf set that has no Nodes in it, as on a new Cluster, treating the current Node as the only Node
+func TestLeafSetEmpty(t *testing.T) {
+	self := NewNode(NodeID{0, 1000}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	if !leafset.isEmpty() {
+		t.Errorf("Expected a new leaf set to be empty.")
+	}
+	for _, key := range []NodeID{self.ID, {0, 0}, {0, 999}, {0, 1001}, {0xffffffffffffffff, 0xffffffffffffffff}} {
+		if !leafset.covers(key) {
+			t.Errorf("Expected an empty leaf set to cover %s.", key)
+		}
+		r, err := leafset.route(key)
+		if _, ok := err.(IdentityError); !ok {
+			t.Errorf("Expected IdentityError routing %s in an empty leaf set, got %v (%v).", key, r, err)
+		}
+		if replicas := leafset.replicaSet(key, 3); len(replicas) != 1 || replicas[0] != self {
+			t.Errorf("Expected only the current Node in the replica set of %s, got %v.", key, replicas)
+		}
+	}
+	if _, err := leafset.getNode(NodeID{0, 999}); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError getting a Node, got %v.", err)
+	}
+	if _, err := leafset.getNextNode(NodeID{0, 999}); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError getting the next Node, got %v.", err)
+	}
+	if _, err := leafset.closest(); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError getting the closest Node, got %v.", err)
+	}
+	if pred, succ := leafset.neighbors(); pred != nil || succ != nil {
+		t.Errorf("Expected no neighbors, got %v and %v.", pred, succ)
+	}
+	if left, right := leafset.leftCount(), leafset.rightCount(); left != 0 || right != 0 {
+		t.Errorf("Expected no Nodes on either side, got %d and %d.", left, right)
+	}
+	if estimate := leafset.estimateSize(); estimate != 1 {
+		t.Errorf("Expected a size estimate of 1, got %d.", estimate)
+	}
+	if nodes := leafset.list(); len(nodes) != 0 {
+		t.Errorf("Expected no Nodes listed, got %v.", nodes)
+	}
+	for side, nodes := range leafset.export() {
+		for _, node := range nodes {
+			if node != nil {
+				t.Errorf("Expected an empty export, got %s on side %d.", node.ID, side)
+			}
+		}
+	}
+	version := self.leafsetVersion
+	if r, err := leafset.removeNode(NodeID{0, 999}); err != nodeNotFoundError || r != nil {
+		t.Errorf("Expected nodeNotFoundError removing a Node, got %v (%v).", r, err)
+	}
+	if self.leafsetVersion != version {
+		t.Errorf("Expected removing a missing Node to leave the leaf set version at %d, got %d.", version, self.leafsetVersion)
+	}
+}
+
+// Test every leaf set method against a leaf set that has a single Node in it
+func TestLeafSetOneMember(t *testing.T) {
+	self := NewNode(NodeID{0, 1000}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	other := NewNode(NodeID{0, 1100}, "127.0.0.2", "127.0.0.2", "testing", 55555)
+	if _, err := leafset.insertNode(*other); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if leafset.isEmpty() {
+		t.Errorf("Expected a leaf set with a Node in it not to be empty.")
+	}
+	tests := [...]struct {
+		key    NodeID
+		covers bool
+		target *NodeID
+	}{
+		{self.ID, true, nil},
+		{NodeID{0, 1040}, true, nil},
+		{NodeID{0, 1060}, true, &other.ID},
+		{other.ID, true, &other.ID},
+		{NodeID{0, 1101}, false, nil},
+		{NodeID{0, 999}, false, nil},
+	}
+	for i, test := range tests {
+		if covers := leafset.covers(test.key); covers != test.covers {
+			t.Errorf("test %v: expected covers(%s) to be %v, got %v", i, test.key, test.covers, covers)
+		}
+		r, err := leafset.route(test.key)
+		switch {
+		case !test.covers:
+			if err != nodeNotFoundError {
+				t.Errorf("test %v: expected nodeNotFoundError routing %s, got %v (%v)", i, test.key, r, err)
+			}
+		case test.target == nil:
+			if _, ok := err.(IdentityError); !ok {
+				t.Errorf("test %v: expected IdentityError routing %s, got %v (%v)", i, test.key, r, err)
+			}
+		case err != nil || !r.ID.Equals(*test.target):
+			t.Errorf("test %v: expected %s to route to %s, got %v (%v)", i, test.key, *test.target, r, err)
+		}
+	}
+	if r, err := leafset.getNode(other.ID); err != nil || !r.ID.Equals(other.ID) {
+		t.Errorf("Expected to get %s, got %v (%v).", other.ID, r, err)
+	}
+	// the left side is empty, so the Node on the right is asked to repair it
+	if r, err := leafset.getNextNode(NodeID{0, 999}); err != nil || !r.ID.Equals(other.ID) {
+		t.Errorf("Expected %s to be the next Node, got %v (%v).", other.ID, r, err)
+	}
+	if r, err := leafset.closest(); err != nil || !r.ID.Equals(other.ID) {
+		t.Errorf("Expected %s to be closest, got %v (%v).", other.ID, r, err)
+	}
+	if pred, succ := leafset.neighbors(); pred == nil || succ == nil || !pred.ID.Equals(other.ID) || !succ.ID.Equals(other.ID) {
+		t.Errorf("Expected %s to be both neighbors, got %v and %v.", other.ID, pred, succ)
+	}
+	if left, right := leafset.leftCount(), leafset.rightCount(); left != 0 || right != 1 {
+		t.Errorf("Expected %d Nodes on the left and %d on the right, got %d and %d.", 0, 1, left, right)
+	}
+	if estimate := leafset.estimateSize(); estimate != 2 {
+		t.Errorf("Expected a size estimate of 2, got %d.", estimate)
+	}
+	if replicas := leafset.replicaSet(NodeID{0, 1090}, 3); len(replicas) != 2 || !replicas[0].ID.Equals(other.ID) || replicas[1] != self {
+		t.Errorf("Expected %s and %s in the replica set, got %v.", other.ID, self.ID, replicas)
+	}
+	if nodes := leafset.list(); len(nodes) != 1 || !nodes[0].ID.Equals(other.ID) {
+		t.Errorf("Expected only %s listed, got %v.", other.ID, nodes)
+	}
+	if exported := leafset.export(); exported[1][0] == nil || !exported[1][0].ID.Equals(other.ID) || exported[0][0] != nil {
+		t.Errorf("Expected only %s exported, on the right, got %v.", other.ID, exported)
+	}
+	if r, err := leafset.removeNode(other.ID); err != nil || !r.ID.Equals(other.ID) {
+		t.Errorf("Expected to remove %s, got %v (%v).", other.ID, r, err)
+	}
+	if !leafset.isEmpty() {
+		t.Errorf("Expected the leaf set to be empty after removing its only Node.")
+	}
+}
+
+// Test that shrinking a leaf set drops the furthest Nodes on each side, and that inserting respects the new size
+func TestLeafSetSetSize(t *testing.T) {
+	self := NewNode(NodeID{0, 1000}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	for i := uint64(1); i <= 5; i++ {
+		for _, id := range []NodeID{{0, 1000 - i}, {0, 1000 + i}} {
+			_, err := leafset.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555))
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+	if dropped := leafset.setSize(8); len(dropped) != 0 {
+		t.Errorf("Expected no Nodes to be dropped shrinking to 8, got %v.", dropped)
+	}
+	dropped := leafset.setSize(3)
+	if len(dropped) != 4 {
+		t.Fatalf("Expected 4 Nodes to be dropped shrinking to 3, got %v.", dropped)
+	}
+	for _, node := range dropped {
+		if diff := self.ID.Diff(node.ID).Int64(); diff < 4 {
+			t.Errorf("Expected only the furthest Nodes to be dropped, got %s.", node.ID)
+		}
+	}
+	if left, right := leafset.leftCount(), leafset.rightCount(); left != 3 || right != 3 || leafset.size() != 3 {
+		t.Errorf("Expected 3 Nodes on each side, got %d and %d.", left, right)
+	}
+	if _, err := leafset.insertNode(*NewNode(NodeID{0, 1010}, "127.0.0.2", "127.0.0.2", "testing", 55555)); err != lsFullError {
+		t.Errorf("Expected lsFullError inserting a Node further than a full side, got %v.", err)
+	}
+	if _, err := leafset.insertNode(*NewNode(NodeID{0, 998}, "127.0.0.2", "127.0.0.2", "testing", 55555)); err != lsDuplicateInsertError {
+		t.Errorf("Expected lsDuplicateInsertError, got %v.", err)
+	}
+	leafset.setSize(0)
+	if leafset.size() != 1 || leafset.leftCount() != 1 || leafset.rightCount() != 1 {
+		t.Errorf("Expected a size less than 1 to be treated as 1, got %d.", leafset.size())
+	}
+}
+
+// Test that a leaf set can be inserted into, removed from and routed through concurrently; run with -race to check for data races
+func TestLeafSetConcurrentAccess(t *testing.T) {
+	self := NewNode(NodeID{0, 1000}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	leafset := newLeafSet(self)
+	var wg sync.WaitGroup
+	for worker := uint64(0); worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker uint64) {
+			defer wg.Done()
+			for i := uint64(1); i <= 50; i++ {
+				id := NodeID{0, 1000 - 50*8 + worker*100 + i}
+				_, err := leafset.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555))
+				if err != nil && err != lsFullError && err != lsDuplicateInsertError {
+					t.Errorf(err.Error())
+					return
+				}
+				_, err = leafset.route(NodeID{0, 1000 + i})
+				if _, ok := err.(IdentityError); err != nil && !ok && err != nodeNotFoundError {
+					t.Errorf(err.Error())
+					return
+				}
+				leafset.covers(id)
+				leafset.list()
+				if i%5 == 0 {
+					_, err = leafset.removeNode(id)
+					if err != nil && err != nodeNotFoundError {
+						t.Errorf(err.Error())
+						return
+					}
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	left, right := leafset.leftCount(), leafset.rightCount()
+	if left > leafset.size() || right > leafset.size() {
+		t.Errorf("Expected at most %d Nodes on each side, got %d and %d.", leafset.size(), left, right)
+	}
+	for _, nodes := range [][]*Node{leafset.left, leafset.right} {
+		for i := 1; i < len(nodes); i++ {
+			if nodes[i] != nil && (nodes[i-1] == nil || self.ID.Diff(nodes[i].ID).Cmp(self.ID.Diff(nodes[i-1].ID)) < 0) {
+				t.Errorf("Expected each side to stay ordered from closest to furthest, got %v.", nodes)
+				break
+			}
+		}
+	}
+}
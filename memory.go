@@ -0,0 +1,186 @@
+package wendy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryNetwork is a Transport that connects Clusters in the same process without opening any sockets, e.g., to test routing across many Nodes quickly. Every Cluster using the same MemoryNetwork can reach every other one.
+//
+// Nodes on a MemoryNetwork are told apart by their Port alone, so each must listen on a different Port; their IPs are ignored. A Node that listens on Port 0 is given the lowest Port that is free.
+//
+// A MemoryNetwork can simulate a slow or unreliable network; see SetLatency and SetDropRate. It is safe for concurrent use.
+type MemoryNetwork struct {
+	listeners map[int]*memoryListener
+	latency   time.Duration
+	dropRate  float64
+	random    *rand.Rand
+	clock     Clock
+	lock      *sync.Mutex
+}
+
+// NewMemoryNetwork creates a MemoryNetwork with no Nodes on it, no latency, and no dropped connections.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		listeners: map[int]*memoryListener{},
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		clock:     realClock{},
+		lock:      new(sync.Mutex),
+	}
+}
+
+// SetLatency sets how long it takes to connect to a Node on the MemoryNetwork. A connection that would take longer than the timeout it is dialled with fails instead.
+func (m *MemoryNetwork) SetLatency(latency time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.latency = latency
+}
+
+// SetClock sets the Clock the MemoryNetwork uses to wait out its latency, e.g., the same Clock the Clusters on it use. By default, the wall clock is used. The timeout a connection is dialled with is always measured on the wall clock.
+func (m *MemoryNetwork) SetClock(clock Clock) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if clock == nil {
+		clock = realClock{}
+	}
+	m.clock = clock
+}
+
+// SetDropRate sets the fraction of connections, between 0 and 1, that fail as if the Node being connected to were down. Whether each connection fails is decided at random.
+func (m *MemoryNetwork) SetDropRate(rate float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dropRate = rate
+}
+
+// Listen fulfills the Transport interface.
+func (m *MemoryNetwork) Listen(address string) (net.Listener, error) {
+	port, err := memoryPort(address)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if port == 0 {
+		port = 1
+		for m.listeners[port] != nil {
+			port++
+		}
+	}
+	if m.listeners[port] != nil {
+		return nil, errors.New("Port " + strconv.Itoa(port) + " is already in use on the memory network.")
+	}
+	ln := &memoryListener{
+		network: m,
+		port:    port,
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	m.listeners[port] = ln
+	return ln, nil
+}
+
+// Dial fulfills the Transport interface.
+func (m *MemoryNetwork) Dial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	port, err := memoryPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	m.lock.Lock()
+	latency := m.latency
+	clock := m.clock
+	dropped := m.random.Float64() < m.dropRate
+	m.lock.Unlock()
+	if latency > 0 {
+		select {
+		case <-clock.After(latency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if dropped {
+		return nil, errors.New("Connection to " + address + " was dropped by the memory network.")
+	}
+	m.lock.Lock()
+	ln := m.listeners[port]
+	m.lock.Unlock()
+	if ln == nil {
+		return nil, errors.New("Nothing is listening on " + address + " on the memory network.")
+	}
+	client, server := net.Pipe()
+	select {
+	case ln.conns <- server:
+		return client, nil
+	case <-ln.closed:
+		err = errors.New("Nothing is listening on " + address + " on the memory network.")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	client.Close()
+	server.Close()
+	return nil, err
+}
+
+// memoryPort returns the port in an address on a MemoryNetwork, ignoring its host.
+func memoryPort(address string) (int, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(port)
+}
+
+// memoryListener is the net.Listener a MemoryNetwork returns from Listen.
+type memoryListener struct {
+	network *MemoryNetwork
+	port    int
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.network.lock.Lock()
+		defer l.network.lock.Unlock()
+		if l.network.listeners[l.port] == l {
+			delete(l.network.listeners, l.port)
+		}
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return memoryAddr(l.port)
+}
+
+// memoryAddr is the address of a Node on a MemoryNetwork.
+type memoryAddr int
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return net.JoinHostPort("memory", strconv.Itoa(int(a)))
+}
@@ -0,0 +1,691 @@
+package wendy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// makeMemoryCluster creates a Cluster with the ID on the MemoryNetwork, and starts it listening.
+func makeMemoryCluster(t *testing.T, network *MemoryNetwork, id NodeID) *Cluster {
+	cluster := makeClusterWithID(id)
+	cluster.SetLogLevel(LogLevelWarn)
+	cluster.SetTransport(network)
+	startListening(t, cluster)
+	return cluster
+}
+
+// Test that a Message sent between two Clusters on a MemoryNetwork is routed and delivered
+func TestMemoryNetworkSend(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer one.Kill()
+	two := makeMemoryCluster(t, network, NodeIDWithPrefix(9))
+	defer two.Kill()
+	if one.self.Port == two.self.Port || one.self.Port == 0 {
+		t.Fatalf("Expected different ports to be chosen, got %d and %d.", one.self.Port, two.self.Port)
+	}
+	callback := newTestCallback(t)
+	two.RegisterCallback(callback)
+	_, err := one.leafset.insertNode(*two.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	key := NodeIDWithPrefix(9, 1)
+	err = one.Send(one.NewMessage(NODE_ANN+1, key, []byte("hello")))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	select {
+	case msg := <-callback.onDeliver:
+		if !msg.Key.Equals(key) || string(msg.Value) != "hello" {
+			t.Errorf("Expected Message %s with value %q, got %s with value %q.", key, "hello", msg.Key, msg.Value)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on delivery.")
+	}
+}
+
+// Test that connections dropped by a MemoryNetwork fail like connections to a Node that is down
+func TestMemoryNetworkDrop(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer one.Kill()
+	two := makeMemoryCluster(t, network, NodeIDWithPrefix(9))
+	_, err := one.Ping(*two.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	network.SetDropRate(1)
+	_, err = one.Ping(*two.self)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected an error wrapping ErrUnreachable, got %v.", err)
+	}
+	network.SetDropRate(0)
+	err = two.Kill()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = one.Ping(*two.self)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected an error wrapping ErrUnreachable once two stopped listening, got %v.", err)
+	}
+}
+
+// Test that a MemoryNetwork delays connections by its latency, and fails those that would take longer than the timeout
+func TestMemoryNetworkLatency(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer one.Kill()
+	two := makeMemoryCluster(t, network, NodeIDWithPrefix(9))
+	defer two.Kill()
+	network.SetLatency(50 * time.Millisecond)
+	rtt, err := one.Ping(*two.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if rtt < 50*time.Millisecond {
+		t.Errorf("Expected the round trip to take at least %s, took %s.", 50*time.Millisecond, rtt)
+	}
+	network.SetLatency(2 * time.Duration(one.getNetworkTimeout()) * time.Second)
+	_, err = one.Ping(*two.self)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected an error wrapping ErrUnreachable, got %v.", err)
+	}
+}
+
+// Test that a MemoryNetwork waits out its latency on its Clock, not the wall clock
+func TestMemoryNetworkLatencyClock(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := newFakeClock()
+	network.SetClock(clock)
+	network.SetLatency(time.Hour)
+	ln, err := network.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	dialled := make(chan error, 1)
+	go func() {
+		conn, err := network.Dial(context.Background(), ln.Addr().String(), 0)
+		if err == nil {
+			conn.Close()
+		}
+		dialled <- err
+	}()
+	clock.wait(t, 1)
+	select {
+	case err := <-dialled:
+		t.Fatalf("Expected Dial to wait for the clock, returned %v.", err)
+	default:
+	}
+	clock.advance(time.Hour)
+	select {
+	case err := <-dialled:
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on Dial once the clock was advanced.")
+	}
+}
+
+// Test that a large Message is delivered intact when it is compressed on the way
+func TestMemoryNetworkCompressed(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer one.Kill()
+	one.SetCompressionThreshold(1024)
+	two := makeMemoryCluster(t, network, NodeIDWithPrefix(9))
+	defer two.Kill()
+	callback := newTestCallback(t)
+	two.RegisterCallback(callback)
+	value := []byte(strings.Repeat("a large, repetitive payload. ", 1000))
+	err := one.send(one.NewMessage(NODE_ANN+1, two.self.ID, value), two.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	select {
+	case msg := <-callback.onDeliver:
+		if msg.Compressed || string(msg.Value) != string(value) {
+			t.Errorf("Expected the original %d byte Value, got %d bytes, compressed: %v.", len(value), len(msg.Value), msg.Compressed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on delivery.")
+	}
+}
+
+// Test that forwarding a Message to a Node in the same Region isn't counted as a cross-Region hop, while forwarding it to a Node in another Region is
+func TestMemoryNetworkCrossRegionHop(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer one.Kill()
+	metrics := NewCountingMetrics()
+	one.SetMetrics(metrics)
+	local := makeMemoryCluster(t, network, NodeIDWithPrefix(5))
+	defer local.Kill()
+	remote := makeMemoryCluster(t, network, NodeIDWithPrefix(9))
+	defer remote.Kill()
+	remote.self.Region = "elsewhere"
+	for _, cluster := range []*Cluster{local, remote} {
+		cluster.RegisterCallback(newTestCallback(t))
+		_, err := one.table.insertNode(*cluster.self, 10)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	err := one.Send(one.NewMessage(NODE_ANN+1, local.self.ID, []byte("local")))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if hops, crossed := metrics.Hops(), metrics.CrossRegionHops(); hops != 1 || crossed != 0 {
+		t.Errorf("Expected %d hop and %d cross-Region hops, got %d and %d.", 1, 0, hops, crossed)
+	}
+	err = one.Send(one.NewMessage(NODE_ANN+1, remote.self.ID, []byte("remote")))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if hops, crossed := metrics.Hops(), metrics.CrossRegionHops(); hops != 2 || crossed != 1 {
+		t.Errorf("Expected %d hops and %d cross-Region hop, got %d and %d.", 2, 1, hops, crossed)
+	}
+	if bytes := metrics.CrossRegionBytes(); bytes != uint64(len("remote")) {
+		t.Errorf("Expected %d cross-Region bytes, got %d.", len("remote"), bytes)
+	}
+}
+
+// Test that a gap in one side of a leaf set whose other side is full is filled by asking the furthest Node on that side
+func TestMemoryNetworkRepairLeafsetGaps(t *testing.T) {
+	network := NewMemoryNetwork()
+	self := makeMemoryCluster(t, network, NodeIDWithPrefix(8))
+	defer self.Kill()
+	helper := makeMemoryCluster(t, network, NodeIDWithPrefix(6))
+	defer helper.Kill()
+	for _, id := range []NodeID{NodeIDWithPrefix(5), NodeIDWithPrefix(4)} {
+		_, err := helper.leafset.insertNode(*NewNode(id, "127.0.0.1", "127.0.0.1", "testing", 60000))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	err := self.repairLeafsetGaps()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = self.leafset.insertNode(*helper.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := byte(1); i <= 16; i++ {
+		_, err = self.leafset.insertNode(*NewNode(NodeIDWithPrefix(8, i-1, 1), "127.0.0.1", "127.0.0.1", "testing", 60000))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	err = self.repairLeafsetGaps()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	deadline := time.Now().Add(time.Second)
+	for self.leafset.leftCount() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the left side of the leaf set to be repaired, got %d Nodes on it.", self.leafset.leftCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// requestCallback responds to every request with the request's value, prefixed
+type requestCallback struct {
+	*testCallback
+}
+
+func (r requestCallback) OnRequest(msg Message) []byte {
+	return append([]byte("re: "), msg.Value...)
+}
+
+// Test that a request routed to a Node that can respond gets its response, and one routed to a Node that can't times out
+func TestMemoryNetworkRequest(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer one.Kill()
+	responder := makeMemoryCluster(t, network, NodeIDWithPrefix(5))
+	defer responder.Kill()
+	responder.RegisterCallback(requestCallback{newTestCallback(t)})
+	silent := makeMemoryCluster(t, network, NodeIDWithPrefix(9))
+	defer silent.Kill()
+	silent.RegisterCallback(newTestCallback(t))
+	for _, cluster := range []*Cluster{responder, silent} {
+		_, err := one.table.insertNode(*cluster.self, 10)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	value, err := one.Request(NodeIDWithPrefix(5, 1), []byte("hello"), time.Second)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(value) != "re: hello" {
+		t.Errorf("Expected response %q, got %q.", "re: hello", value)
+	}
+	_, err = one.Request(NodeIDWithPrefix(9, 1), []byte("hello"), 200*time.Millisecond)
+	if timeout, ok := err.(TimeoutError); !ok {
+		t.Errorf("Expected TimeoutError, got %v.", err)
+	} else if timeout.Timeout != 200*time.Millisecond {
+		t.Errorf("Expected the TimeoutError to report a timeout of %s, got %s.", 200*time.Millisecond, timeout.Timeout)
+	}
+	if len(one.requests) != 0 {
+		t.Errorf("Expected no requests to be waiting, got %d.", len(one.requests))
+	}
+}
+
+// Test that Applications can use every purpose greater than NODE_ANN, even alongside requests
+func TestMemoryNetworkRequestPurposes(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer one.Kill()
+	two := makeMemoryCluster(t, network, NodeIDWithPrefix(5))
+	defer two.Kill()
+	callback := newTestCallback(t)
+	two.RegisterCallback(requestCallback{callback})
+	if _, err := one.table.insertNode(*two.self, 10); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, purpose := range []byte{NODE_ANN + 1, 254, 255} {
+		if err := one.Send(one.NewMessage(purpose, NodeIDWithPrefix(5, 1), []byte("hello"))); err != nil {
+			t.Fatalf(err.Error())
+		}
+		select {
+		case msg := <-callback.onDeliver:
+			if msg.Purpose != purpose {
+				t.Errorf("Expected a Message with purpose %d to be delivered, got purpose %d.", purpose, msg.Purpose)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected a Message with purpose %d to be delivered.", purpose)
+		}
+	}
+	if value, err := one.Request(NodeIDWithPrefix(5, 1), []byte("hello"), time.Second); err != nil || string(value) != "re: hello" {
+		t.Errorf("Expected response %q, got %q (%v).", "re: hello", value, err)
+	}
+	select {
+	case msg := <-callback.onDeliver:
+		t.Errorf("Expected the request not to be delivered with OnDeliver, got purpose %d.", msg.Purpose)
+	default:
+	}
+}
+
+// Test that a traced Message comes back with every Node it was routed through, in order, and the state table each Node chose the next one from
+func TestMemoryNetworkSendTraced(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer one.Kill()
+	two := makeMemoryCluster(t, network, NodeIDWithPrefix(5))
+	defer two.Kill()
+	three := makeMemoryCluster(t, network, NodeIDWithPrefix(5, 1))
+	defer three.Kill()
+	for _, cluster := range []*Cluster{one, two, three} {
+		cluster.RegisterCallback(newTestCallback(t))
+	}
+	_, err := one.table.insertNode(*two.self, 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = two.leafset.insertNode(*three.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	trace, err := one.SendTracedMessage(one.NewMessage(NODE_ANN+1, NodeIDWithPrefix(5, 1, 1), []byte("hello")), time.Second)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := []TraceHop{
+		{Node: *one.self, Table: TableRoutingTable},
+		{Node: *two.self, Table: TableLeafSet},
+		{Node: *three.self},
+	}
+	if len(trace) != len(expected) {
+		t.Fatalf("Expected %d hops, got %d: %v", len(expected), len(trace), trace)
+	}
+	for i, hop := range trace {
+		if !hop.Node.ID.Equals(expected[i].Node.ID) || hop.Table != expected[i].Table {
+			t.Errorf("Expected hop %d to be %s from the %q, got %s from the %q.", i, expected[i].Node.ID, expected[i].Table, hop.Node.ID, hop.Table)
+		}
+	}
+	nodes, err := one.SendTraced(NodeIDWithPrefix(5, 1, 1), []byte("hello"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(nodes) != len(expected) {
+		t.Fatalf("Expected %d Nodes, got %d: %v", len(expected), len(nodes), nodes)
+	}
+	for i, node := range nodes {
+		if !node.ID.Equals(expected[i].Node.ID) {
+			t.Errorf("Expected Node %d to be %s, got %s.", i, expected[i].Node.ID, node.ID)
+		}
+	}
+	if len(one.requests) != 0 {
+		t.Errorf("Expected no requests to be waiting, got %d.", len(one.requests))
+	}
+}
+
+// oneWayTransport is a Transport on a MemoryNetwork that can't dial one port, like a Node behind a firewall that lets connections in but not out
+type oneWayTransport struct {
+	*MemoryNetwork
+	blocked int
+}
+
+func (o oneWayTransport) Dial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	if port, err := memoryPort(address); err == nil && port == o.blocked {
+		return nil, errors.New("connection refused")
+	}
+	return o.MemoryNetwork.Dial(ctx, address, timeout)
+}
+
+// Test that a Node that can be reached, but can't reach the current Node back, isn't inserted into the state tables
+func TestMemoryNetworkReachBack(t *testing.T) {
+	network := NewMemoryNetwork()
+	self := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer self.Kill()
+	reachable := makeMemoryCluster(t, network, NodeIDWithPrefix(3))
+	defer reachable.Kill()
+	firewalled := makeFirewalledCluster(t, network, NodeIDWithPrefix(5), self)
+	defer firewalled.Kill()
+	cached := makeFirewalledCluster(t, network, NodeIDWithPrefix(7), self)
+	defer cached.Kill()
+	// a proximity cached from before the firewall went up shouldn't get the Node inserted either
+	self.cacheProximity(cached.self.ID, 10)
+	if _, err := self.Ping(*firewalled.self); err != nil {
+		t.Fatalf("Expected %s to be reachable, got %v.", firewalled.self.ID, err)
+	}
+	for _, node := range []*Node{reachable.self, firewalled.self, cached.self} {
+		err := self.insert(*node, StateMask{Mask: all})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if _, err := self.get(reachable.self.ID); err != nil {
+		t.Errorf("Expected %s to be inserted, got %v.", reachable.self.ID, err)
+	}
+	for _, node := range []*Node{firewalled.self, cached.self} {
+		if found, err := self.get(node.ID); err != nodeNotFoundError {
+			t.Errorf("Expected %s not to be inserted, got %v (%v).", node.ID, found, err)
+		}
+	}
+	if err := self.checkReachableBack(*firewalled.self); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected an error wrapping ErrUnreachable checking %s, got %v.", firewalled.self.ID, err)
+	}
+}
+
+// Test that the state tables in a message listing several Nodes that can't reach the current Node back are checked concurrently, taking about one network timeout rather than one per Node
+func TestMemoryNetworkReachBackConcurrent(t *testing.T) {
+	network := NewMemoryNetwork()
+	self := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer self.Kill()
+	var neighborhood [32]*Node
+	for i := range neighborhood[:3] {
+		firewalled := makeFirewalledCluster(t, network, NodeIDWithPrefix(byte(3+2*i)), self)
+		defer firewalled.Kill()
+		neighborhood[i] = firewalled.self
+	}
+	value, err := json.Marshal(stateTables{NeighborhoodSet: &neighborhood})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	msg := self.NewMessage(STAT_DATA, self.self.ID, value)
+	start := time.Now()
+	if err := self.insertMessage(msg); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if elapsed, timeout := time.Since(start), time.Duration(self.getNetworkTimeout())*time.Second; elapsed >= 2*timeout {
+		t.Errorf("Expected the Nodes to be checked within %s, took %s.", 2*timeout, elapsed)
+	}
+	for _, node := range neighborhood[:3] {
+		if found, err := self.get(node.ID); err != nodeNotFoundError {
+			t.Errorf("Expected %s not to be inserted, got %v (%v).", node.ID, found, err)
+		}
+	}
+}
+
+// Test that sending to a Node in the routing table, or a copy of it, smooths the proximity of, and records hearing from, the routing table's own entry for the Node
+func TestMemoryNetworkSendUpdatesTable(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer one.Kill()
+	two := makeMemoryCluster(t, network, NodeIDWithPrefix(9))
+	defer two.Kill()
+	known := int64(time.Second)
+	if _, err := one.table.insertNode(*two.self, known); err != nil {
+		t.Fatalf(err.Error())
+	}
+	entry, err := one.table.getNode(two.self.ID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	entry.updateLastHeardFrom(time.Time{})
+	if err := one.send(one.NewMessage(HEARTBEAT, two.self.ID, []byte{}), entry.copy()); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if entry, err = one.table.getNode(two.self.ID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if proximity := entry.getRawProximity(); proximity <= 0 || proximity >= known {
+		t.Errorf("Expected the proximity of %s to be smoothed between 0 and %d, got %d.", two.self.ID, known, proximity)
+	}
+	if entry.LastHeardFrom().IsZero() {
+		t.Errorf("Expected the routing table's entry for %s to record hearing from it.", two.self.ID)
+	}
+	// sending to the entry itself updates it in place, rather than swapping it for a new one the sender doesn't hold
+	if err := one.send(one.NewMessage(HEARTBEAT, two.self.ID, []byte{}), entry); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if again, err := one.table.getNode(two.self.ID); err != nil || again != entry {
+		t.Errorf("Expected the routing table's entry for %s to be updated in place, got %v (%v).", two.self.ID, again, err)
+	}
+}
+
+// makeFirewalledCluster returns a Cluster listening on the MemoryNetwork that can't dial the other Cluster's port
+func makeFirewalledCluster(t *testing.T, network *MemoryNetwork, id NodeID, other *Cluster) *Cluster {
+	cluster := makeClusterWithID(id)
+	cluster.SetLogLevel(LogLevelWarn)
+	cluster.SetTransport(oneWayTransport{network, other.self.Port})
+	startListening(t, cluster)
+	return cluster
+}
+
+// flakyTransport is a Transport on a MemoryNetwork that fails to dial the first few times it is asked to
+type flakyTransport struct {
+	*MemoryNetwork
+	failures *int32
+}
+
+func (f flakyTransport) Dial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	if atomic.AddInt32(f.failures, -1) >= 0 {
+		return nil, errors.New("connection reset")
+	}
+	return f.MemoryNetwork.Dial(ctx, address, timeout)
+}
+
+// Test that the round trip time Ping returns doesn't count the attempts that failed or the backoff between them, and that the last error is wrapped in a TimeoutError once the attempts run out
+func TestMemoryNetworkPingRetries(t *testing.T) {
+	network := NewMemoryNetwork()
+	two := makeMemoryCluster(t, network, NodeIDWithPrefix(9))
+	defer two.Kill()
+	failures := int32(2)
+	one := makeClusterWithID(NodeIDWithPrefix(1))
+	one.SetLogLevel(LogLevelWarn)
+	one.SetTransport(flakyTransport{network, &failures})
+	backoff := 100 * time.Millisecond
+	one.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: backoff})
+	startListening(t, one)
+	defer one.Kill()
+	rtt, err := one.Ping(*two.self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if rtt >= backoff {
+		t.Errorf("Expected the round trip time not to include the %s backoff, got %s.", backoff, rtt)
+	}
+	atomic.StoreInt32(&failures, 3)
+	_, err = one.Ping(*two.self)
+	if _, ok := err.(TimeoutError); !ok {
+		t.Errorf("Expected TimeoutError once the attempts ran out, got %v.", err)
+	}
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected the TimeoutError to wrap an error matching ErrUnreachable, got %v.", err)
+	}
+}
+
+// drainCallback reports each call to PreLeave, then waits for release to be closed before returning
+type drainCallback struct {
+	*testCallback
+	preLeave chan struct{}
+	release  chan struct{}
+}
+
+func (d drainCallback) PreLeave() {
+	d.preLeave <- struct{}{}
+	<-d.release
+}
+
+// Test that Stop gives Applications a chance to drain before the other Nodes are told it is leaving, and cuts off a slow drain at the drain timeout
+func TestMemoryNetworkDrain(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	two := makeMemoryCluster(t, network, NodeIDWithPrefix(9))
+	defer two.Kill()
+	if _, err := one.leafset.insertNode(*two.self); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := two.leafset.insertNode(*one.self); err != nil {
+		t.Fatalf(err.Error())
+	}
+	exits := newTestCallback(t)
+	two.RegisterCallback(exits)
+	drain := drainCallback{newTestCallback(t), make(chan struct{}, 1), make(chan struct{})}
+	one.RegisterCallback(drain)
+	one.SetDrainTimeout(time.Minute)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- one.Stop()
+	}()
+	select {
+	case <-drain.preLeave:
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on PreLeave to be called.")
+	}
+	select {
+	case node := <-exits.onNodeExit:
+		t.Fatalf("Expected %s not to be told of the exit while draining.", node.ID)
+	case <-stopped:
+		t.Fatalf("Expected Stop to wait for PreLeave to return.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(drain.release)
+	select {
+	case node := <-exits.onNodeExit:
+		if !node.ID.Equals(one.self.ID) {
+			t.Errorf("Expected %s to leave, got %s.", one.self.ID, node.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting on the exit.")
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// a drain that never finishes is cut off at the drain timeout
+	three := makeMemoryCluster(t, network, NodeIDWithPrefix(5))
+	stuck := drainCallback{newTestCallback(t), make(chan struct{}, 1), make(chan struct{})}
+	defer close(stuck.release)
+	three.RegisterCallback(stuck)
+	three.SetDrainTimeout(100 * time.Millisecond)
+	start := time.Now()
+	if err := three.Stop(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected Stop to give up on draining after 100ms, took %s.", elapsed)
+	}
+	select {
+	case <-stuck.preLeave:
+	default:
+		t.Errorf("Expected PreLeave to be called.")
+	}
+}
+
+// Test that a joining Node keeps handling Messages while it waits to announce its presence
+func TestMemoryNetworkJoinAnnounceWait(t *testing.T) {
+	network := NewMemoryNetwork()
+	one := makeMemoryCluster(t, network, NodeIDWithPrefix(1))
+	defer one.Kill()
+	two := makeClusterWithID(NodeIDWithPrefix(9))
+	two.SetLogLevel(LogLevelWarn)
+	two.SetTransport(network)
+	clock := newFakeClock()
+	two.SetClock(clock)
+	// a single inbound worker, which would be stuck waiting if it announced two's presence itself
+	two.SetInboundWorkers(1, 1)
+	startListening(t, two)
+	defer two.Kill()
+	err := two.Join(one.self.LocalIP, one.self.Port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if two.isJoined() {
+		t.Fatalf("Expected two to wait before announcing its presence.")
+	}
+	_, err = one.Ping(*two.self)
+	if err != nil {
+		t.Fatalf("Expected two to answer a ping while it waits to announce its presence, got %v.", err)
+	}
+	clock.advance(time.Duration(2*two.getNetworkTimeout()) * time.Second)
+	deadline := time.Now().Add(time.Second)
+	for !two.isJoined() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !two.isJoined() {
+		t.Errorf("Expected two to join once the clock was advanced.")
+	}
+}
+
+// Test that Nodes with a single inbound worker can join, though checking a Node can reach the current Node back needs a worker free for the reply
+func TestMemoryNetworkJoinOneWorker(t *testing.T) {
+	network := NewMemoryNetwork()
+	clusters := []*Cluster{}
+	for _, prefix := range []byte{1, 9} {
+		cluster := makeClusterWithID(NodeIDWithPrefix(prefix))
+		cluster.SetLogLevel(LogLevelWarn)
+		cluster.SetTransport(network)
+		cluster.SetInboundWorkers(1, 1)
+		startListening(t, cluster)
+		defer cluster.Kill()
+		clusters = append(clusters, cluster)
+	}
+	one, two := clusters[0], clusters[1]
+	callback := newTestCallback(t)
+	one.RegisterCallback(callback)
+	err := two.Join(one.self.LocalIP, one.self.Port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	select {
+	case <-callback.onNodeJoin:
+	case <-time.After(4 * time.Duration(one.getNetworkTimeout()) * time.Second):
+		t.Fatalf("Timeout waiting on two to join.")
+	}
+	if _, err := two.table.getNode(one.self.ID); err != nil {
+		t.Errorf("Expected two to insert one into its routing table, got %v.", err)
+	}
+	if _, err := one.table.getNode(two.self.ID); err != nil {
+		t.Errorf("Expected one to insert two into its routing table, got %v.", err)
+	}
+}
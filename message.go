@@ -1,18 +1,44 @@
 package wendy
 
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"io"
+)
+
 // Message represents the messages that are sent through the cluster of Nodes
 type Message struct {
 	Purpose     byte
-	Sender      Node   // The Node a message originated at
-	Key         NodeID // The message's ID
-	Value       []byte // The message being passed
-	Credentials []byte // The Credentials used to authenticate the Message
-	LSVersion   uint64 // The version of the leaf set, for join messages
-	RTVersion   uint64 // The version of the routing table, for join messages
-	NSVersion   uint64 // The version of the neighborhood set, for join messages
-	Hop         int    // The number of hops the message has taken
+	Sender      Node       // The Node a message originated at
+	Key         NodeID     // The message's ID
+	Value       []byte     // The message being passed
+	Credentials []byte     // The Credentials used to authenticate the Message
+	LSVersion   uint64     // The version of the leaf set, for join messages
+	RTVersion   uint64     // The version of the routing table, for join messages
+	NSVersion   uint64     // The version of the neighborhood set, for join messages
+	Hop         int        // The number of hops the message has taken
+	Compressed  bool       // Whether the Value is gzip compressed; Messages are decompressed as soon as they're received, so this is never set on a Message passed to an Application
+	Request     bool       // Whether the Message is a request the Cluster handles itself, or the response to one; its Purpose is then one of the request kinds rather than a Message purpose, so it is never taken for an Application's Message
+	RequestID   uint64     // Identifies a request, and the response to it
+	Response    bool       // Whether the Message is the response to a request, rather than the request
+	Traced      bool       // Whether the Message's route is recorded in Trace and sent back to the Sender once it is delivered, as by Cluster.SendTraced and SendTracedMessage
+	Trace       []TraceHop // The Nodes a traced Message has been routed through so far
+}
+
+// TraceHop is a step on the route a Message took through the Cluster, as returned by Cluster.SendTracedMessage.
+type TraceHop struct {
+	Node  Node
+	Table string // The state table Node chose the next Node on the route from; empty if the Message was delivered to Node
 }
 
+// The state tables a TraceHop's Table can name.
+const (
+	TableLeafSet         = "leaf set"
+	TableRoutingTable    = "routing table"
+	TableNeighborhoodSet = "neighborhood set"
+)
+
 const (
 	NODE_JOIN = byte(iota) // Used when a Node wishes to join the cluster
 	NODE_EXIT              // Used when a Node leaves the cluster
@@ -24,25 +50,88 @@ const (
 	NODE_ANN               // Used when a Node broadcasts its presence
 )
 
+// The kinds of request a Message with Request set can be, given by its Purpose. They are kept apart from the other purposes by Request, so every purpose greater than NODE_ANN is left for Applications.
+const (
+	requestApplication = byte(iota) // Used for the requests made with Cluster.Request, and the responses to them
+	requestReachBack                // Used when a Node checks that another Node can reach it back, and for the reply
+	requestTrace                    // Used to send the route of a Message sent with Cluster.SendTraced back; only ever a response
+)
+
 // String returns a string representation of a message.
 func (m *Message) String() string {
 	return m.Key.String() + ": " + string(m.Value)
 }
 
+// encodeMessage writes the Message to the Writer in Wendy's wire format.
+func encodeMessage(w io.Writer, msg Message) error {
+	return gob.NewEncoder(w).Encode(msg)
+}
+
+// compress returns a copy of the Message with its Value gzip compressed. If compressing the Value doesn't make it any smaller, the Message is returned unchanged.
+func (m Message) compress() (Message, error) {
+	if m.Compressed {
+		return m, nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(m.Value)
+	if err != nil {
+		return m, err
+	}
+	err = w.Close()
+	if err != nil {
+		return m, err
+	}
+	if buf.Len() >= len(m.Value) {
+		return m, nil
+	}
+	m.Value = buf.Bytes()
+	m.Compressed = true
+	return m, nil
+}
+
+// decompress returns a copy of the Message with its Value decompressed, if it was compressed.
+func (m Message) decompress() (Message, error) {
+	if !m.Compressed {
+		return m, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(m.Value))
+	if err != nil {
+		return m, err
+	}
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return m, err
+	}
+	m.Value = value
+	m.Compressed = false
+	return m, nil
+}
+
+// decodeMessage reads a single Message in Wendy's wire format from the Reader.
+func decodeMessage(r io.Reader) (Message, error) {
+	var msg Message
+	err := gob.NewDecoder(r).Decode(&msg)
+	return msg, err
+}
+
 func (c *Cluster) NewMessage(purpose byte, key NodeID, value []byte) Message {
 	var credentials []byte
 	if c.credentials != nil {
 		credentials = c.credentials.Marshal()
 	}
+	// the current Node is updated while Messages are being made, so it is copied under its lock
+	self := c.self.copy()
 	return Message{
 		Purpose:     purpose,
-		Sender:      *c.self,
+		Sender:      *self,
 		Key:         key,
 		Value:       value,
 		Credentials: credentials,
-		LSVersion:   c.self.leafsetVersion,
-		RTVersion:   c.self.routingTableVersion,
-		NSVersion:   c.self.neighborhoodSetVersion,
+		LSVersion:   self.leafsetVersion,
+		RTVersion:   self.routingTableVersion,
+		NSVersion:   self.neighborhoodSetVersion,
 		Hop:         0,
 	}
 }
@@ -0,0 +1,121 @@
+package wendy
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Test that messages of every purpose survive being encoded and decoded
+func TestMessageEncodeDecode(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "10.0.0.1", "testing", 55555)
+	cluster := NewCluster(self, Passphrase("I <3 Gophers."))
+	key := NodeID{0x0123456789abcdef, 0xfedcba9876543210}
+	purposes := []byte{NODE_JOIN, NODE_EXIT, HEARTBEAT, STAT_DATA, STAT_REQ, NODE_RACE, NODE_REPR, NODE_ANN, 16}
+	for _, purpose := range purposes {
+		msg := cluster.NewMessage(purpose, key, []byte("some value"))
+		msg.Hop = 3
+		msg.LSVersion, msg.RTVersion, msg.NSVersion = 4, 5, 6
+		var buf bytes.Buffer
+		err := encodeMessage(&buf, msg)
+		if err != nil {
+			t.Fatalf("purpose %d: %s", purpose, err.Error())
+		}
+		decoded, err := decodeMessage(&buf)
+		if err != nil {
+			t.Fatalf("purpose %d: %s", purpose, err.Error())
+		}
+		if decoded.Purpose != purpose {
+			t.Errorf("purpose %d: decoded purpose %d", purpose, decoded.Purpose)
+		}
+		if !decoded.Key.Equals(key) {
+			t.Errorf("purpose %d: expected key %s, got %s", purpose, key, decoded.Key)
+		}
+		if string(decoded.Value) != "some value" || string(decoded.Credentials) != "I <3 Gophers." {
+			t.Errorf("purpose %d: value or credentials changed, got %q and %q", purpose, decoded.Value, decoded.Credentials)
+		}
+		if decoded.Hop != 3 || decoded.LSVersion != 4 || decoded.RTVersion != 5 || decoded.NSVersion != 6 {
+			t.Errorf("purpose %d: hop or versions changed, got %+v", purpose, decoded)
+		}
+		sender := decoded.Sender
+		if !sender.ID.Equals(self.ID) || sender.LocalIP != self.LocalIP || sender.GlobalIP != self.GlobalIP || sender.Region != self.Region || sender.Port != self.Port {
+			t.Errorf("purpose %d: sender changed, got %+v", purpose, sender)
+		}
+	}
+}
+
+// Test that NodeIDs are encoded as exactly 16 bytes, and invalid encodings are rejected
+func TestNodeIDGobEncode(t *testing.T) {
+	id := NodeID{0x0123456789abcdef, 0xfedcba9876543210}
+	encoded, err := id.GobEncode()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(encoded) != 16 {
+		t.Fatalf("Expected 16 bytes, got %d.", len(encoded))
+	}
+	var decoded NodeID
+	err = decoded.GobDecode(encoded)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !decoded.Equals(id) {
+		t.Errorf("Expected %s, got %s.", id, decoded)
+	}
+	if err = decoded.GobDecode(encoded[:15]); err == nil {
+		t.Errorf("Expected an error decoding 15 bytes.")
+	}
+}
+
+// Test that a large Value survives being compressed, encoded and decoded, and that small Values aren't compressed
+func TestMessageCompression(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cluster := NewCluster(NewNode(self_id, "127.0.0.1", "10.0.0.1", "testing", 55555), nil)
+	cluster.SetCompressionThreshold(1024)
+	large := bytes.Repeat([]byte("a large, repetitive payload. "), 1000)
+	msg, err := cluster.compressMessage(cluster.NewMessage(NODE_ANN+1, self_id, large))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !msg.Compressed || len(msg.Value) >= len(large) {
+		t.Errorf("Expected a %d byte Value to be compressed, got %d bytes, compressed: %v.", len(large), len(msg.Value), msg.Compressed)
+	}
+	var buf bytes.Buffer
+	err = encodeMessage(&buf, msg)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	decoded, err := decodeMessage(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	decoded, err = decoded.decompress()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if decoded.Compressed || !bytes.Equal(decoded.Value, large) {
+		t.Errorf("Expected the Value to be decompressed to the original %d bytes, got %d bytes, compressed: %v.", len(large), len(decoded.Value), decoded.Compressed)
+	}
+	small := []byte("a small payload")
+	msg, err = cluster.compressMessage(cluster.NewMessage(NODE_ANN+1, self_id, small))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if msg.Compressed || !bytes.Equal(msg.Value, small) {
+		t.Errorf("Expected a small Value not to be compressed, got %q, compressed: %v.", msg.Value, msg.Compressed)
+	}
+	cluster.SetCompressionThreshold(0)
+	msg, err = cluster.compressMessage(cluster.NewMessage(NODE_ANN+1, self_id, large))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if msg.Compressed {
+		t.Errorf("Expected no Values to be compressed without a threshold.")
+	}
+}
@@ -0,0 +1,136 @@
+package wendy
+
+import (
+	"sync"
+)
+
+// Metrics is an interface that can be fulfilled to collect statistics about how Messages are routed through the Cluster.
+//
+// RouteHop is called each time the current Node forwards a Message towards its key, just before the Message is sent to the next Node.
+//
+// Delivered is called when a Message is delivered at the current Node. It is passed the number of hops the Message took to get there.
+//
+// Timeout is called when a request to another Node times out. It is passed a description of the request, the same as the Action of the TimeoutError that is returned.
+//
+// Dropped is called when an inbound connection is closed without being handled, because the queue of connections waiting for a worker is full.
+//
+// CrossRegionHop is called along with RouteHop when the next Node is in a different Region than the current Node. It is passed the length of the Message's Value, in bytes, to help tune Cluster.SetRegionMultiplier.
+type Metrics interface {
+	RouteHop(key NodeID)
+	Delivered(hops int)
+	Timeout(action string)
+	Dropped()
+	CrossRegionHop(key NodeID, bytes int)
+}
+
+// noopMetrics is the Metrics used until Cluster.SetMetrics is called. It discards everything.
+type noopMetrics struct{}
+
+func (m noopMetrics) RouteHop(key NodeID)                  {}
+func (m noopMetrics) Delivered(hops int)                   {}
+func (m noopMetrics) Timeout(action string)                {}
+func (m noopMetrics) Dropped()                             {}
+func (m noopMetrics) CrossRegionHop(key NodeID, bytes int) {}
+
+// CountingMetrics is an implementation of Metrics that keeps running totals of hops, deliveries, timeouts, dropped connections and hops across Regions. It is safe for concurrent use.
+type CountingMetrics struct {
+	hops             uint64
+	deliveries       uint64
+	deliveredHops    uint64
+	timeouts         uint64
+	drops            uint64
+	crossRegionHops  uint64
+	crossRegionBytes uint64
+	lock             *sync.RWMutex
+}
+
+// NewCountingMetrics creates a CountingMetrics with all its totals set to zero.
+func NewCountingMetrics() *CountingMetrics {
+	return &CountingMetrics{
+		lock: new(sync.RWMutex),
+	}
+}
+
+func (m *CountingMetrics) RouteHop(key NodeID) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.hops += 1
+}
+
+func (m *CountingMetrics) Delivered(hops int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.deliveries += 1
+	m.deliveredHops += uint64(hops)
+}
+
+func (m *CountingMetrics) Timeout(action string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.timeouts += 1
+}
+
+func (m *CountingMetrics) Dropped() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.drops += 1
+}
+
+func (m *CountingMetrics) CrossRegionHop(key NodeID, bytes int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.crossRegionHops += 1
+	m.crossRegionBytes += uint64(bytes)
+}
+
+// Hops returns the number of times the current Node has forwarded a Message.
+func (m *CountingMetrics) Hops() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.hops
+}
+
+// Deliveries returns the number of Messages delivered at the current Node.
+func (m *CountingMetrics) Deliveries() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.deliveries
+}
+
+// AverageHops returns the mean number of hops taken by the Messages delivered at the current Node, or 0 if none have been delivered.
+func (m *CountingMetrics) AverageHops() float64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.deliveries == 0 {
+		return 0
+	}
+	return float64(m.deliveredHops) / float64(m.deliveries)
+}
+
+// Timeouts returns the number of requests from the current Node that have timed out.
+func (m *CountingMetrics) Timeouts() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.timeouts
+}
+
+// Drops returns the number of inbound connections the current Node has dropped because it was too busy to handle them.
+func (m *CountingMetrics) Drops() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.drops
+}
+
+// CrossRegionHops returns the number of times the current Node has forwarded a Message to a Node in a different Region.
+func (m *CountingMetrics) CrossRegionHops() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.crossRegionHops
+}
+
+// CrossRegionBytes returns the total length of the Values of the Messages the current Node has forwarded to Nodes in different Regions.
+func (m *CountingMetrics) CrossRegionBytes() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.crossRegionBytes
+}
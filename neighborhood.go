@@ -2,15 +2,18 @@ package wendy
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"sort"
 	"sync"
 )
 
+// neighborhoodSet holds the Nodes with the closest proximity to the current Node, ordered from closest to furthest when they were inserted. lock is held for every read and change of nodes; each Node guards its own fields, so proximities can be re-measured from other goroutines while the neighborhoodSet is in use.
 type neighborhoodSet struct {
 	self     *Node
 	nodes    [32]*Node
-	log      *log.Logger
+	log      Logger
 	logLevel int
 	lock     *sync.RWMutex
 }
@@ -19,14 +22,16 @@ func newNeighborhoodSet(self *Node) *neighborhoodSet {
 	return &neighborhoodSet{
 		self:     self,
 		nodes:    [32]*Node{},
-		log:      log.New(os.Stdout, "wendy#neighborhoodSet("+self.ID.String()+")", log.LstdFlags),
+		log:      NewLogger(log.New(os.Stdout, "wendy#neighborhoodSet("+self.ID.String()+")", log.LstdFlags)),
 		logLevel: LogLevelWarn,
 		lock:     new(sync.RWMutex),
 	}
 }
 
 var nsDuplicateInsertError = errors.New("Node already exists in neighborhood set.")
+var nsFullError = fmt.Errorf("%w: Node is further than every Node in the neighborhood set.", ErrTableFull)
 
+// insertNode inserts the Node into the neighborhoodSet with its proximity, returning the inserted Node. A Node further than every Node in a full neighborhoodSet isn't inserted, and nsFullError, which wraps ErrTableFull, is returned, so callers can tell it apart from a Node that was inserted; a Node that is already in the neighborhoodSet is re-sorted by its new proximity, and nsDuplicateInsertError is returned.
 func (n *neighborhoodSet) insertNode(node Node, proximity int64) (*Node, error) {
 	return n.insertValues(node.ID, node.LocalIP, node.GlobalIP, node.Region, node.Port, node.routingTableVersion, node.leafsetVersion, node.neighborhoodSetVersion, proximity)
 }
@@ -40,48 +45,44 @@ func (n *neighborhoodSet) insertValues(id NodeID, localIP, globalIP, region stri
 	insertNode := NewNode(id, localIP, globalIP, region, port)
 	insertNode.updateVersions(rTVersion, lSVersion, nSVersion)
 	insertNode.setProximity(proximity)
-	newNS := [32]*Node{}
-	newNSpos := 0
-	score := n.self.Proximity(insertNode)
-	inserted := false
+	// pull out any existing entry for the Node, so it can be re-sorted by its new proximity
+	others := make([]*Node, 0, len(n.nodes))
 	dup := false
 	for _, node := range n.nodes {
-		if newNSpos > 31 {
+		if node == nil {
 			break
 		}
-		if node == nil && !inserted && !dup {
-			newNS[newNSpos] = insertNode
-			newNSpos++
-			inserted = true
-			continue
-		}
-		if node != nil && insertNode.ID.Equals(node.ID) {
+		if insertNode.ID.Equals(node.ID) {
 			insertNode.updateVersions(node.routingTableVersion, node.leafsetVersion, node.neighborhoodSetVersion)
-			newNS[newNSpos] = insertNode
-			newNSpos++
+			if proximity < 0 {
+				insertNode.setProximity(node.getRawProximity())
+			}
 			dup = true
 			continue
 		}
-		if node != nil && n.self.Proximity(node) > score && !inserted && !dup {
-			newNS[newNSpos] = insertNode
-			newNSpos++
-			inserted = true
-			continue
-		}
-		if newNSpos <= 31 {
-			newNS[newNSpos] = node
-			newNSpos++
+		others = append(others, node)
+	}
+	score := n.self.Proximity(insertNode)
+	pos := len(others)
+	for i, node := range others {
+		if proximityLess(score, n.self.Proximity(node)) {
+			pos = i
+			break
 		}
 	}
+	if pos >= len(n.nodes) {
+		return nil, nsFullError
+	}
+	newNS := [32]*Node{}
+	copy(newNS[:pos], others[:pos])
+	newNS[pos] = insertNode
+	copy(newNS[pos+1:], others[pos:])
 	n.nodes = newNS
 	if dup {
 		return nil, nsDuplicateInsertError
 	}
-	if inserted {
-		n.self.incrementNSVersion()
-		return insertNode, nil
-	}
-	return nil, nil
+	n.self.incrementNSVersion()
+	return insertNode, nil
 }
 
 func (n *neighborhoodSet) getNode(id NodeID) (*Node, error) {
@@ -101,12 +102,29 @@ func (n *neighborhoodSet) getNode(id NodeID) (*Node, error) {
 	return nil, nodeNotFoundError
 }
 
+// closest returns the Node in the neighborhoodSet with the closest proximity to the current Node.
+func (n *neighborhoodSet) closest() (*Node, error) {
+	nodes := n.list()
+	if len(nodes) < 1 {
+		return nil, nodeNotFoundError
+	}
+	return nodes[0], nil
+}
+
+// export returns a copy of the neighborhoodSet. The Nodes are copies too, so changing them doesn't change the neighborhoodSet.
 func (n *neighborhoodSet) export() [32]*Node {
 	n.lock.RLock()
 	defer n.lock.RUnlock()
-	return n.nodes
+	nodes := [32]*Node{}
+	for i, node := range n.nodes {
+		if node != nil {
+			nodes[i] = node.copy()
+		}
+	}
+	return nodes
 }
 
+// list returns the Nodes in the neighborhoodSet, skipping empty slots, ordered from the closest proximity to the furthest as adjusted for Regions. Nodes are sorted when they are inserted, but their proximity can be re-measured after that, so list sorts them again; Nodes with equal proximity keep their order.
 func (n *neighborhoodSet) list() []*Node {
 	n.lock.RLock()
 	defer n.lock.RUnlock()
@@ -116,6 +134,9 @@ func (n *neighborhoodSet) list() []*Node {
 			nodes = append(nodes, node)
 		}
 	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return proximityLess(n.self.Proximity(nodes[i]), n.self.Proximity(nodes[j]))
+	})
 	return nodes
 }
 
@@ -160,18 +181,18 @@ func (n *neighborhoodSet) removeNode(id NodeID) (*Node, error) {
 
 func (n *neighborhoodSet) debug(format string, v ...interface{}) {
 	if n.logLevel <= LogLevelDebug {
-		n.log.Printf(format, v...)
+		n.log.Debugf(format, v...)
 	}
 }
 
 func (n *neighborhoodSet) warn(format string, v ...interface{}) {
 	if n.logLevel <= LogLevelWarn {
-		n.log.Printf(format, v...)
+		n.log.Warnf(format, v...)
 	}
 }
 
 func (n *neighborhoodSet) err(format string, v ...interface{}) {
 	if n.logLevel <= LogLevelError {
-		n.log.Printf(format, v...)
+		n.log.Errorf(format, v...)
 	}
 }
@@ -1,6 +1,8 @@
 package wendy
 
 import (
+	"errors"
+	"sync"
 	"testing"
 )
 
@@ -39,6 +41,156 @@ func TestNeighborhoodSetInsertNode(t *testing.T) {
 	}
 }
 
+// Test that inserting the current node into the neighborhood set is refused and leaves it unchanged
+func TestNeighborhoodSetInsertSelf(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is just a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 0)
+	neighborhood := newNeighborhoodSet(self)
+	_, err = neighborhood.insertNode(*self, 0)
+	if _, ok := err.(IdentityError); !ok {
+		t.Errorf("Expected IdentityError inserting self, got %v.", err)
+	}
+	if nodes := neighborhood.list(); len(nodes) != 0 {
+		t.Errorf("Expected %d nodes in the neighborhood set, got %d.", 0, len(nodes))
+	}
+	if self.neighborhoodSetVersion != 0 {
+		t.Errorf("Expected neighborhood set version to be %d, got %d.", 0, self.neighborhoodSetVersion)
+	}
+}
+
+// Test that re-inserting a node with a new proximity moves its entry instead of adding another
+func TestNeighborhoodSetInsertDuplicate(t *testing.T) {
+	self := NewNode(NodeID{0x8000000000000000, 0}, "127.0.0.1", "127.0.0.1", "testing", 0)
+	neighborhood := newNeighborhoodSet(self)
+	ids := []NodeID{{1, 0}, {2, 0}, {3, 0}}
+	for i, id := range ids {
+		_, err := neighborhood.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 0), int64(i+1)*10)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	_, err := neighborhood.insertNode(*NewNode(ids[0], "127.0.0.3", "127.0.0.3", "testing", 0), 25)
+	if err != nsDuplicateInsertError {
+		t.Errorf("Expected nsDuplicateInsertError, got %v.", err)
+	}
+	nodes := neighborhood.list()
+	expected := []NodeID{ids[1], ids[0], ids[2]}
+	if len(nodes) != len(expected) {
+		t.Fatalf("Expected %d nodes in the neighborhood set, got %d.", len(expected), len(nodes))
+	}
+	for i, node := range nodes {
+		if !node.ID.Equals(expected[i]) {
+			t.Errorf("Expected node %d to be %s, got %s.", i, expected[i], node.ID)
+		}
+	}
+	if nodes[1].LocalIP != "127.0.0.3" || nodes[1].getRawProximity() != 25 {
+		t.Errorf("Expected entry to be updated to %s with proximity %d, got %s with proximity %d.", "127.0.0.3", 25, nodes[1].LocalIP, nodes[1].getRawProximity())
+	}
+}
+
+// Test that the neighborhood set stays ordered by proximity and keeps only the closest nodes when full
+func TestNeighborhoodSetInsertOrdering(t *testing.T) {
+	self := NewNode(NodeID{0, 0}, "127.0.0.1", "127.0.0.1", "testing", 0)
+	neighborhood := newNeighborhoodSet(self)
+	if _, err := neighborhood.closest(); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError from an empty neighborhood set, got %v.", err)
+	}
+	for i := 0; i < len(neighborhood.nodes); i++ {
+		node := NewNode(NodeID{0, uint64(i + 1)}, "127.0.0.2", "127.0.0.2", "testing", 0)
+		// insert in descending proximity, so every insert has to displace the others
+		r, err := neighborhood.insertNode(*node, int64(100-i))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if r == nil {
+			t.Fatalf("Nil response returned inserting node %d.", i)
+		}
+	}
+	if len(neighborhood.list()) != len(neighborhood.nodes) {
+		t.Fatalf("Expected a full neighborhood set, got %d nodes.", len(neighborhood.list()))
+	}
+	// an unmeasured node doesn't displace anything
+	r, err := neighborhood.insertNode(*NewNode(NodeID{0, 100}, "127.0.0.3", "127.0.0.3", "testing", 0), -1)
+	if !errors.Is(err, ErrTableFull) || r != nil {
+		t.Errorf("Expected an unmeasured node not to be inserted into a full set, got %v, %v.", r, err)
+	}
+	closer := NewNode(NodeID{0, 101}, "127.0.0.3", "127.0.0.3", "testing", 0)
+	r, err = neighborhood.insertNode(*closer, 1)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if r == nil {
+		t.Fatal("Nil response returned inserting the closest node.")
+	}
+	closest, err := neighborhood.closest()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !closest.ID.Equals(closer.ID) {
+		t.Errorf("Expected %s to be closest, got %s.", closer.ID, closest.ID)
+	}
+	for i, node := range neighborhood.nodes {
+		if node == nil {
+			t.Fatalf("Expected the neighborhood set to be full, position %d was empty.", i)
+		}
+		if node.ID.Equals(NodeID{0, 1}) {
+			t.Errorf("Expected the furthest node to be dropped, found it at position %d.", i)
+		}
+		if i > 0 && self.Proximity(neighborhood.nodes[i-1]) > self.Proximity(node) {
+			t.Errorf("Neighborhood set out of order at position %d.", i)
+		}
+	}
+	// re-inserting a node with a new proximity re-sorts it without duplicating it
+	_, err = neighborhood.insertNode(*NewNode(NodeID{0, 2}, "127.0.0.2", "127.0.0.2", "testing", 0), 0)
+	if err != nsDuplicateInsertError {
+		t.Errorf("Expected nsDuplicateInsertError, got %v.", err)
+	}
+	seen := 0
+	for _, node := range neighborhood.nodes {
+		if node != nil && node.ID.Equals(NodeID{0, 2}) {
+			seen++
+		}
+	}
+	if seen != 1 {
+		t.Errorf("Expected re-inserted node once, saw it %d times.", seen)
+	}
+	if closest, _ = neighborhood.closest(); !closest.ID.Equals(NodeID{0, 2}) {
+		t.Errorf("Expected re-inserted node to be closest, got %s.", closest.ID)
+	}
+}
+
+// Test that nodes in the same region are favoured over closer nodes in other regions, according to the region multiplier
+func TestNeighborhoodSetRegionMultiplier(t *testing.T) {
+	tests := [...]struct {
+		multiplier float64
+		first      NodeID
+	}{
+		{0, NodeID{0, 1}},
+		{5, NodeID{0, 1}},
+		{1.5, NodeID{0, 1}},
+		{1, NodeID{0, 2}},
+	}
+	for i, test := range tests {
+		self := NewNode(NodeID{0, 0}, "127.0.0.1", "127.0.0.1", "local", 0)
+		self.setRegionMultiplier(test.multiplier)
+		neighborhood := newNeighborhoodSet(self)
+		local := NewNode(NodeID{0, 1}, "127.0.0.2", "127.0.0.2", "local", 0)
+		remote := NewNode(NodeID{0, 2}, "127.0.0.3", "127.0.0.3", "remote", 0)
+		if _, err := neighborhood.insertNode(*local, 10); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if _, err := neighborhood.insertNode(*remote, 7); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !neighborhood.nodes[0].ID.Equals(test.first) {
+			t.Errorf("test %v: expected %s to be closest with a multiplier of %v, got %s", i, test.first, test.multiplier, neighborhood.nodes[0].ID)
+		}
+	}
+}
+
 // Test deleting the only node from the neighborhood set
 func TestNeighborhoodSetDeleteOnly(t *testing.T) {
 	self_id, err := NodeIDFromBytes([]byte("this is just a test Node for testing purposes only."))
@@ -391,3 +543,86 @@ func BenchmarkNeighborhoodSetExport(b *testing.B) {
 		benchNeighborhood.export()
 	}
 }
+
+// Test that listing a half-full neighborhood set skips the empty slots and orders the Nodes by proximity, even after their proximity changes
+func TestNeighborhoodSetList(t *testing.T) {
+	self := NewNode(NodeID{0, 0}, "127.0.0.1", "127.0.0.1", "testing", 0)
+	self.setRegionMultiplier(5)
+	neighborhood := newNeighborhoodSet(self)
+	if nodes := neighborhood.list(); len(nodes) != 0 {
+		t.Errorf("Expected an empty list, got %d nodes.", len(nodes))
+	}
+	for i := 0; i < len(neighborhood.nodes)/2; i++ {
+		region := "testing"
+		if i%2 == 1 {
+			region = "elsewhere"
+		}
+		_, err := neighborhood.insertNode(*NewNode(NodeID{0, uint64(i + 1)}, "127.0.0.2", "127.0.0.2", region, 0), int64(10*(i+1)))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	// the furthest Node gets closer than all the others
+	furthest := neighborhood.nodes[len(neighborhood.nodes)/2-1]
+	furthest.setProximity(1)
+	nodes := neighborhood.list()
+	if len(nodes) != len(neighborhood.nodes)/2 {
+		t.Fatalf("Expected %d nodes, got %d.", len(neighborhood.nodes)/2, len(nodes))
+	}
+	if nodes[0] != furthest {
+		t.Errorf("Expected %s to be listed first, got %s.", furthest.ID, nodes[0].ID)
+	}
+	for i, node := range nodes {
+		if node == nil {
+			t.Fatalf("Expected no empty slots, position %d was empty.", i)
+		}
+		if i > 0 && proximityLess(self.Proximity(node), self.Proximity(nodes[i-1])) {
+			t.Errorf("List out of order at position %d: %d before %d.", i, self.Proximity(nodes[i-1]), self.Proximity(node))
+		}
+	}
+	if closest, err := neighborhood.closest(); err != nil || closest != furthest {
+		t.Errorf("Expected %s to be closest, got %v, %v.", furthest.ID, closest, err)
+	}
+}
+
+// Test that a neighborhood set's Nodes can be inserted, listed and re-measured concurrently; run with -race to check for data races
+func TestNeighborhoodSetConcurrentAccess(t *testing.T) {
+	self := NewNode(NodeID{0, 1000}, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	neighborhood := newNeighborhoodSet(self)
+	var wg sync.WaitGroup
+	for worker := uint64(0); worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker uint64) {
+			defer wg.Done()
+			for i := uint64(1); i <= 50; i++ {
+				id := NodeID{worker + 1, i}
+				_, err := neighborhood.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555), int64(i))
+				if err != nil && err != nsFullError && err != nsDuplicateInsertError {
+					t.Errorf(err.Error())
+					return
+				}
+				// re-measure whatever is in the set, as updateProximity does in the background
+				for _, node := range neighborhood.list() {
+					node.setProximity(node.getRawProximity() + 1)
+				}
+				if i%5 == 0 {
+					_, err = neighborhood.removeNode(id)
+					if err != nil && err != nodeNotFoundError {
+						t.Errorf(err.Error())
+						return
+					}
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	nodes := neighborhood.list()
+	if len(nodes) > len(neighborhood.nodes) {
+		t.Errorf("Expected at most %d Nodes, got %d.", len(neighborhood.nodes), len(nodes))
+	}
+	for i := 1; i < len(nodes); i++ {
+		if proximityLess(self.Proximity(nodes[i]), self.Proximity(nodes[i-1])) {
+			t.Errorf("Expected the list to be ordered by proximity, got %d before %d.", self.Proximity(nodes[i-1]), self.Proximity(nodes[i]))
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package wendy
 
 import (
+	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +17,8 @@ type Node struct {
 	Region                 string // A string that allows you to intelligently route between local and global requests for, e.g., EC2 regions
 	ID                     NodeID
 	proximity              int64
+	regionMultiplier       float64       // the multiplier applied to the proximity of Nodes in other Regions
+	strictRegions          bool          // whether Regions must match exactly, instead of ignoring case and surrounding whitespace
 	mutex                  *sync.RWMutex // lock and unlock a Node for concurrency safety
 	lastHeardFrom          time.Time     // The last time we heard from this node
 	leafsetVersion         uint64        // the version number of the leafset
@@ -22,6 +26,20 @@ type Node struct {
 	neighborhoodSetVersion uint64        // the version number of the neighborhood set
 }
 
+// NodeStatus is a read-only snapshot of a Node, including the state that Node keeps unexported, for reporting through admin and status APIs. Its JSON encoding is stable.
+type NodeStatus struct {
+	ID            NodeID    `json:"id"`
+	LocalIP       string    `json:"local_ip"`
+	GlobalIP      string    `json:"global_ip"`
+	Port          int       `json:"port"`
+	Region        string    `json:"region"`
+	Proximity     int64     `json:"proximity"` // The raw proximity score of the Node, or -1 if it isn't known
+	LastHeardFrom time.Time `json:"last_heard_from"`
+}
+
+// defaultRegionMultiplier is the multiplier applied to the proximity of Nodes outside the current Node's Region, unless SetRegionMultiplier is used.
+const defaultRegionMultiplier = 5
+
 // NewNode initialises a new Node and its associated mutexes. It does *not* update the proximity of the Node.
 func NewNode(id NodeID, local, global, region string, port int) *Node {
 	return &Node{
@@ -31,6 +49,7 @@ func NewNode(id NodeID, local, global, region string, port int) *Node {
 		Port:                   port,
 		Region:                 region,
 		proximity:              -1,
+		regionMultiplier:       defaultRegionMultiplier,
 		mutex:                  new(sync.RWMutex),
 		lastHeardFrom:          time.Now(),
 		leafsetVersion:         0,
@@ -39,30 +58,100 @@ func NewNode(id NodeID, local, global, region string, port int) *Node {
 	}
 }
 
-// IsZero returns whether or the given Node has been initialised or if it's an empty Node struct. IsZero returns true if the Node has been initialised, false if it's an empty struct.
+// IsZero returns whether the given Node is an empty Node struct, rather than one that has been initialised, e.g., an empty slot in a state table that was sent over the network. IsZero returns true if the Node is an empty struct, false if it has been initialised. Only the Node's addresses are checked, as the zero NodeID is a valid ID.
 func (self Node) IsZero() bool {
+	return self.isZero()
+}
+
+// isZero is IsZero for a Node the Cluster may be using, reading its addresses under its lock instead of copying it.
+func (self *Node) isZero() bool {
+	if self.mutex != nil {
+		self.mutex.RLock()
+		defer self.mutex.RUnlock()
+	}
 	return self.LocalIP == "" && self.GlobalIP == "" && self.Port == 0
 }
 
-// GetIP returns the IP and port that should be used when communicating with a Node, to respect Regions.
-func (self Node) GetIP(other Node) string {
-	self.mutex.RLock()
-	defer self.mutex.RUnlock()
-	if other.mutex != nil {
-		other.mutex.RLock()
-		defer other.mutex.RUnlock()
+// GetIP returns the IP and port that should be used when communicating with a Node, to respect Regions. If the Node is in another Region and has no GlobalIP, it can't be reached and an UnreachableError is returned, as from ReachableFrom.
+func (self Node) GetIP(other Node) (string, error) {
+	return other.ReachableFrom(&self)
+}
+
+// ReachableFrom returns the IP and port that the caller should use to reach the Node, to respect Regions. If the Node is in another Region and has no GlobalIP, the caller can't reach it and an UnreachableError is returned. Both Nodes are read under their own locks, so either may be one the Cluster is using.
+func (self *Node) ReachableFrom(caller *Node) (string, error) {
+	if caller.mutex != nil {
+		caller.mutex.RLock()
 	}
-	ip := ""
-	if self.Region == other.Region {
-		ip = other.LocalIP
-	} else {
-		ip = other.GlobalIP
+	region := caller.Region
+	strict := caller.strictRegions
+	if caller.mutex != nil {
+		caller.mutex.RUnlock()
 	}
-	ip = ip + ":" + strconv.Itoa(other.Port)
-	return ip
+	if self.mutex != nil {
+		self.mutex.RLock()
+	}
+	unreachable := self.GlobalIP == "" && (!sameRegion(self.Region, region, strict) || self.LocalIP == "")
+	if self.mutex != nil {
+		self.mutex.RUnlock()
+	}
+	if unreachable {
+		return "", throwUnreachableError(self.ID, region)
+	}
+	return self.addr(region, strict), nil
+}
+
+// Addr returns the IP and port that a Node in the specified Region should use to reach the Node: the LocalIP if the Regions match, the GlobalIP otherwise. If the Node has no LocalIP, the GlobalIP is always used. Regions are compared ignoring case and surrounding whitespace.
+func (self Node) Addr(region string) string {
+	return self.addr(region, false)
+}
+
+func (self *Node) addr(region string, strict bool) string {
+	if self.mutex != nil {
+		self.mutex.RLock()
+		defer self.mutex.RUnlock()
+	}
+	ip := self.GlobalIP
+	if sameRegion(self.Region, region, strict) && self.LocalIP != "" {
+		ip = self.LocalIP
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(self.Port))
 }
 
-// Proximity returns the proximity score for the Node, adjusted for the Region. The proximity score of a Node reflects how close it is to the current Node; a lower proximity score means a closer Node. Nodes outside the current Region are penalised by a multiplier.
+// Validate returns an InvalidArgumentError if the Node has neither a LocalIP nor a GlobalIP, if either of them isn't a valid IPv4 or IPv6 address, or if its Port is outside the range of valid ports. A Node without a GlobalIP is valid, but it can only be reached from within its Region.
+func (self Node) Validate() error {
+	if self.mutex != nil {
+		self.mutex.RLock()
+		defer self.mutex.RUnlock()
+	}
+	if self.LocalIP != "" && net.ParseIP(self.LocalIP) == nil {
+		return throwInvalidArgumentError("Node " + self.ID.String() + " has an invalid LocalIP \"" + self.LocalIP + "\".")
+	}
+	if self.LocalIP == "" && self.GlobalIP == "" {
+		return throwInvalidArgumentError("Node " + self.ID.String() + " has neither a LocalIP nor a GlobalIP.")
+	}
+	if self.GlobalIP != "" && net.ParseIP(self.GlobalIP) == nil {
+		return throwInvalidArgumentError("Node " + self.ID.String() + " has an invalid GlobalIP \"" + self.GlobalIP + "\".")
+	}
+	if self.Port < 0 || self.Port > 65535 {
+		return throwInvalidArgumentError("Node " + self.ID.String() + " has an invalid Port " + strconv.Itoa(self.Port) + ".")
+	}
+	return nil
+}
+
+// String returns a human-readable representation of the Node, made up of its ID, its Region, and the IP and port it can be reached on from outside its Region, or from inside it if it has no GlobalIP.
+func (self Node) String() string {
+	if self.mutex != nil {
+		self.mutex.RLock()
+		defer self.mutex.RUnlock()
+	}
+	ip := self.GlobalIP
+	if ip == "" {
+		ip = self.LocalIP
+	}
+	return self.ID.String() + " (" + self.Region + ", " + net.JoinHostPort(ip, strconv.Itoa(self.Port)) + ")"
+}
+
+// Proximity returns the proximity score for the Node, adjusted for the Region. The proximity score of a Node reflects how close it is to the current Node; a lower proximity score means a closer Node. Nodes outside the current Region are penalised by a multiplier, which can be changed with Cluster.SetRegionMultiplier.
 func (self *Node) Proximity(n *Node) int64 {
 	if n == nil {
 		return -1
@@ -70,14 +159,102 @@ func (self *Node) Proximity(n *Node) int64 {
 	if self.mutex == nil {
 		self.mutex = new(sync.RWMutex)
 	}
-	n.mutex.RLock()
-	defer n.mutex.RUnlock()
-	multiplier := int64(1)
-	if n.Region != self.Region {
-		multiplier = 5
+	self.mutex.RLock()
+	region := self.Region
+	multiplier := self.regionMultiplier
+	strict := self.strictRegions
+	self.mutex.RUnlock()
+	if multiplier < 1 {
+		// the Node wasn't created with NewNode, so it has no multiplier set
+		multiplier = defaultRegionMultiplier
+	}
+	return n.adjustedProximity(region, strict, multiplier)
+}
+
+// AdjustedProximity returns the Node's proximity score as seen from the other Node, multiplied by the region multiplier if the Node is in a different Region. Multipliers less than 1 are treated as 1. It is the score Proximity returns, with the multiplier passed in rather than taken from the other Node.
+func (n *Node) AdjustedProximity(self *Node, regionMultiplier float64) int64 {
+	if self.mutex != nil {
+		self.mutex.RLock()
+	}
+	region := self.Region
+	strict := self.strictRegions
+	if self.mutex != nil {
+		self.mutex.RUnlock()
 	}
-	score := n.proximity * multiplier
-	return score
+	if regionMultiplier < 1 {
+		regionMultiplier = 1
+	}
+	return n.adjustedProximity(region, strict, regionMultiplier)
+}
+
+// adjustedProximity does the work for Proximity and AdjustedProximity, multiplying the Node's proximity if it isn't in the Region.
+func (n *Node) adjustedProximity(region string, strict bool, multiplier float64) int64 {
+	if n.mutex != nil {
+		n.mutex.RLock()
+		defer n.mutex.RUnlock()
+	}
+	if sameRegion(n.Region, region, strict) {
+		return n.proximity
+	}
+	return int64(float64(n.proximity) * multiplier)
+}
+
+func (self *Node) setRegionMultiplier(multiplier float64) {
+	if self.mutex == nil {
+		self.mutex = new(sync.RWMutex)
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.regionMultiplier = multiplier
+}
+
+func (self *Node) setStrictRegions(strict bool) {
+	if self.mutex == nil {
+		self.mutex = new(sync.RWMutex)
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.strictRegions = strict
+}
+
+func (self *Node) setPort(port int) {
+	if self.mutex == nil {
+		self.mutex = new(sync.RWMutex)
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.Port = port
+}
+
+// regionMatches returns true if the other Node is in the same Region as the Node, comparing their Regions as set with Cluster.SetStrictRegions.
+func (self *Node) regionMatches(other *Node) bool {
+	if self.mutex == nil {
+		self.mutex = new(sync.RWMutex)
+	}
+	self.mutex.RLock()
+	region, strict := self.Region, self.strictRegions
+	self.mutex.RUnlock()
+	if other.mutex != nil {
+		other.mutex.RLock()
+		defer other.mutex.RUnlock()
+	}
+	return sameRegion(other.Region, region, strict)
+}
+
+// sameRegion returns true if the Regions a and b are the same Region. Unless strict is set, Regions that only differ in case or surrounding whitespace, e.g., "us-east-1" and " US-East-1", are considered the same.
+func sameRegion(a, b string, strict bool) bool {
+	if strict {
+		return a == b
+	}
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// proximityLess returns true if the proximity score a is closer than the proximity score b. Negative scores mean the proximity is unknown, and are considered further than any known score.
+func proximityLess(a, b int64) bool {
+	if a < 0 {
+		return false
+	}
+	return b < 0 || a < b
 }
 
 func (self *Node) getRawProximity() int64 {
@@ -98,13 +275,28 @@ func (self *Node) setProximity(proximity int64) {
 	self.proximity = proximity
 }
 
-func (self *Node) updateLastHeardFrom() {
+// smoothProximity folds a new sample into the Node's proximity as an exponential moving average, so a single noisy sample doesn't reorder the state tables. The sample is weighted by alpha, which must be between 0 and 1; an alpha of 1 replaces the proximity with the sample. If the proximity isn't known yet, the sample is used as is. It returns the new proximity.
+func (self *Node) smoothProximity(sample int64, alpha float64) int64 {
+	if self.mutex == nil {
+		self.mutex = new(sync.RWMutex)
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.proximity < 0 || sample < 0 {
+		self.proximity = sample
+	} else {
+		self.proximity = int64(alpha*float64(sample) + (1-alpha)*float64(self.proximity))
+	}
+	return self.proximity
+}
+
+func (self *Node) updateLastHeardFrom(now time.Time) {
 	if self.mutex == nil {
 		self.mutex = new(sync.RWMutex)
 	}
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
-	self.lastHeardFrom = time.Now()
+	self.lastHeardFrom = now
 }
 
 func (self *Node) LastHeardFrom() time.Time {
@@ -139,3 +331,45 @@ func (self *Node) updateVersions(RTVersion, LSVersion, NSVersion uint64) {
 		self.incrementNSVersion()
 	}
 }
+
+// Status returns a NodeStatus describing the Node as it is now.
+func (self *Node) Status() NodeStatus {
+	if self.mutex == nil {
+		self.mutex = new(sync.RWMutex)
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return NodeStatus{
+		ID:            self.ID,
+		LocalIP:       self.LocalIP,
+		GlobalIP:      self.GlobalIP,
+		Port:          self.Port,
+		Region:        self.Region,
+		Proximity:     self.proximity,
+		LastHeardFrom: self.lastHeardFrom,
+	}
+}
+
+// copy returns a new Node with the same values as the Node, so the copy can be modified without affecting the original.
+func (self *Node) copy() *Node {
+	if self.mutex == nil {
+		self.mutex = new(sync.RWMutex)
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return &Node{
+		ID:                     self.ID,
+		LocalIP:                self.LocalIP,
+		GlobalIP:               self.GlobalIP,
+		Port:                   self.Port,
+		Region:                 self.Region,
+		proximity:              self.proximity,
+		regionMultiplier:       self.regionMultiplier,
+		strictRegions:          self.strictRegions,
+		mutex:                  new(sync.RWMutex),
+		lastHeardFrom:          self.lastHeardFrom,
+		leafsetVersion:         atomic.LoadUint64(&self.leafsetVersion),
+		routingTableVersion:    atomic.LoadUint64(&self.routingTableVersion),
+		neighborhoodSetVersion: atomic.LoadUint64(&self.neighborhoodSetVersion),
+	}
+}
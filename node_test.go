@@ -1,6 +1,8 @@
 package wendy
 
 import (
+	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -51,3 +53,298 @@ func TestNodeVersionUpdateMixed(t *testing.T) {
 		t.Errorf("Neighborhood Set version was supposed to be %d, was %d instead.", 4, self.neighborhoodSetVersion)
 	}
 }
+
+// Test that the address of a Node depends on the Region it's reached from
+func TestNodeAddr(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	other_id, err := NodeIDFromBytes([]byte("this is some other Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "10.0.0.1", "1.2.3.4", "testing", 8080)
+	other := NewNode(other_id, "10.0.0.2", "5.6.7.8", "testing", 8081)
+	if addr := self.Addr("testing"); addr != "10.0.0.1:8080" {
+		t.Errorf("Expected address in the same region to be %s, got %s instead.", "10.0.0.1:8080", addr)
+	}
+	if addr := self.Addr("elsewhere"); addr != "1.2.3.4:8080" {
+		t.Errorf("Expected address in a different region to be %s, got %s instead.", "1.2.3.4:8080", addr)
+	}
+	if addr, err := self.GetIP(*other); err != nil || addr != "10.0.0.2:8081" {
+		t.Errorf("Expected address of a node in the same region to be %s, got %s instead (%v).", "10.0.0.2:8081", addr, err)
+	}
+	other.Region = "elsewhere"
+	if addr, err := self.GetIP(*other); err != nil || addr != "5.6.7.8:8081" {
+		t.Errorf("Expected address of a node in a different region to be %s, got %s instead (%v).", "5.6.7.8:8081", addr, err)
+	}
+}
+
+// Test that a Node's string representation includes its ID, Region and address
+func TestNodeString(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "10.0.0.1", "1.2.3.4", "testing", 8080)
+	expected := self_id.String() + " (testing, 1.2.3.4:8080)"
+	if self.String() != expected {
+		t.Errorf("Expected %s, got %s instead.", expected, self.String())
+	}
+}
+
+// Test that IPv6 addresses are bracketed in a Node's address
+func TestNodeAddrIPv6(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "::1", "2001:db8::1", "testing", 8080)
+	if addr := self.Addr("testing"); addr != "[::1]:8080" {
+		t.Errorf("Expected address in the same region to be %s, got %s instead.", "[::1]:8080", addr)
+	}
+	if addr := self.Addr("elsewhere"); addr != "[2001:db8::1]:8080" {
+		t.Errorf("Expected address in a different region to be %s, got %s instead.", "[2001:db8::1]:8080", addr)
+	}
+	if err = self.Validate(); err != nil {
+		t.Errorf("Expected IPv6 node to be valid, got %v.", err)
+	}
+}
+
+// Test that Nodes with malformed IPs or out of range ports are invalid
+func TestNodeValidate(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tests := [...]struct {
+		local, global string
+		port          int
+		valid         bool
+	}{
+		{"127.0.0.1", "127.0.0.1", 0, true},
+		{"10.0.0.1", "2001:db8::1", 65535, true},
+		{"127.0.0.1.1", "127.0.0.1", 8080, false},
+		{"127.0.0.1", "not an ip", 8080, false},
+		{"", "127.0.0.1", 8080, true},
+		{"127.0.0.1", "", 8080, true},
+		{"", "", 8080, false},
+		{"127.0.0.1", "127.0.0.1", -1, false},
+		{"127.0.0.1", "127.0.0.1", 65536, false},
+	}
+	for i, test := range tests {
+		err := NewNode(self_id, test.local, test.global, "testing", test.port).Validate()
+		if test.valid && err != nil {
+			t.Errorf("test %v: expected node to be valid, got %v", i, err)
+		}
+		if !test.valid {
+			if _, ok := err.(InvalidArgumentError); !ok {
+				t.Errorf("test %v: expected InvalidArgumentError, got %v", i, err)
+			}
+			if errors.Is(err, ErrInvalidNodeID) {
+				t.Errorf("test %v: expected an invalid address not to match ErrInvalidNodeID, got %v", i, err)
+			}
+		}
+	}
+}
+
+// Test that a Node and its status survive a round trip through JSON
+func TestNodeJSON(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "10.0.0.1", "1.2.3.4", "testing", 8080)
+	self.setProximity(42)
+	data, err := json.Marshal(self)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var node Node
+	err = json.Unmarshal(data, &node)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !node.ID.Equals(self.ID) || node.Region != self.Region || node.GlobalIP != self.GlobalIP || node.Port != self.Port {
+		t.Errorf("Expected %s, got %s.", self, node)
+	}
+	data, err = json.Marshal(self.Status())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var status NodeStatus
+	err = json.Unmarshal(data, &status)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !status.ID.Equals(self.ID) || status.Region != self.Region || status.Proximity != 42 {
+		t.Errorf("Expected status of %s with proximity %d, got %+v.", self, 42, status)
+	}
+	if !status.LastHeardFrom.Equal(self.LastHeardFrom()) {
+		t.Errorf("Expected last heard from to be %s, got %s.", self.LastHeardFrom(), status.LastHeardFrom)
+	}
+}
+
+// Test choosing between the LocalIP and GlobalIP based on the caller's Region
+func TestNodeReachableFrom(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	other_id, err := NodeIDFromBytes([]byte("this is some other Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tests := [...]struct {
+		local, region, expected string
+	}{
+		{"10.0.0.1", "testing", "10.0.0.1:8080"},
+		{"10.0.0.1", "elsewhere", "1.2.3.4:8080"},
+		{"", "testing", "1.2.3.4:8080"},
+		{"", "elsewhere", "1.2.3.4:8080"},
+	}
+	for i, test := range tests {
+		self := NewNode(self_id, test.local, "1.2.3.4", "testing", 8080)
+		caller := NewNode(other_id, "10.0.0.2", "5.6.7.8", test.region, 8081)
+		addr, err := self.ReachableFrom(caller)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if addr != test.expected {
+			t.Errorf("test %v: expected %s, got %s", i, test.expected, addr)
+		}
+	}
+}
+
+// Test that a Node without a GlobalIP can only be reached from its own Region
+func TestNodeReachableFromNoGlobalIP(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	other_id, err := NodeIDFromBytes([]byte("this is some other Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "10.0.0.1", "", "testing", 8080)
+	local := NewNode(other_id, "10.0.0.2", "5.6.7.8", "testing", 8081)
+	addr, err := self.ReachableFrom(local)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if addr != "10.0.0.1:8080" {
+		t.Errorf("Expected %s, got %s.", "10.0.0.1:8080", addr)
+	}
+	remote := NewNode(other_id, "10.0.0.2", "5.6.7.8", "elsewhere", 8081)
+	_, err = self.ReachableFrom(remote)
+	if e, ok := err.(UnreachableError); !ok || !e.Node.Equals(self_id) || e.Region != "elsewhere" {
+		t.Errorf("Expected UnreachableError for %s from the elsewhere region, got %v.", self_id, err)
+	}
+	if addr, err := remote.GetIP(*self); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected GetIP to return ErrUnreachable for %s from the elsewhere region, got %s (%v).", self_id, addr, err)
+	}
+}
+
+// Test that noisy proximity samples are smoothed into a steady score
+func TestNodeSmoothProximity(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	node := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 8080)
+	if proximity := node.smoothProximity(100, 0.25); proximity != 100 {
+		t.Errorf("Expected the first sample to be used as is, got %d.", proximity)
+	}
+	// samples jitter between 60 and 140 around a true proximity of 100
+	samples := []int64{60, 140}
+	min, max := int64(-1), int64(-1)
+	for i := 0; i < 100; i++ {
+		proximity := node.smoothProximity(samples[i%2], 0.25)
+		if i < 50 {
+			continue
+		}
+		if min < 0 || proximity < min {
+			min = proximity
+		}
+		if proximity > max {
+			max = proximity
+		}
+	}
+	if min < 80 || max > 120 {
+		t.Errorf("Expected the smoothed proximity to stay between 80 and 120, got %d to %d.", min, max)
+	}
+	if proximity := node.smoothProximity(500, 1); proximity != 500 {
+		t.Errorf("Expected an alpha of 1 to replace the proximity, got %d.", proximity)
+	}
+}
+
+// Test that Regions that only differ in case or whitespace are the same Region, unless strict Regions are set
+func TestNodeRegionCase(t *testing.T) {
+	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	other_id, err := NodeIDFromBytes([]byte("this is some other Node for testing purposes only."))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "10.0.0.1", "1.2.3.4", "us-east-1", 8080)
+	other := NewNode(other_id, "10.0.0.2", "5.6.7.8", " US-East-1", 8081)
+	other.setProximity(10)
+	if addr, err := self.GetIP(*other); err != nil || addr != "10.0.0.2:8081" {
+		t.Errorf("Expected address of a node in the same region to be %s, got %s instead (%v).", "10.0.0.2:8081", addr, err)
+	}
+	if addr, err := other.ReachableFrom(self); err != nil || addr != "10.0.0.2:8081" {
+		t.Errorf("Expected %s, got %s (%v).", "10.0.0.2:8081", addr, err)
+	}
+	if proximity := self.Proximity(other); proximity != 10 {
+		t.Errorf("Expected proximity in the same region to be %d, got %d.", 10, proximity)
+	}
+	self.setStrictRegions(true)
+	if addr, err := self.GetIP(*other); err != nil || addr != "5.6.7.8:8081" {
+		t.Errorf("Expected address of a node in a different region to be %s, got %s instead (%v).", "5.6.7.8:8081", addr, err)
+	}
+	if proximity := self.Proximity(other); proximity != 10*defaultRegionMultiplier {
+		t.Errorf("Expected proximity in a different region to be %d, got %d.", 10*defaultRegionMultiplier, proximity)
+	}
+}
+
+// Test that AdjustedProximity multiplies the proximity of Nodes in other Regions only, treating multipliers less than 1 as 1
+func TestNodeAdjustedProximity(t *testing.T) {
+	self := NewNode(NodeID{0, 0}, "10.0.0.1", "1.2.3.4", "local", 8080)
+	local := NewNode(NodeID{0, 1}, "10.0.0.2", "5.6.7.8", "local", 8081)
+	remote := NewNode(NodeID{0, 2}, "10.0.0.3", "5.6.7.9", "remote", 8081)
+	local.setProximity(10)
+	remote.setProximity(10)
+	tests := []struct {
+		node       *Node
+		multiplier float64
+		expected   int64
+	}{
+		{local, 3, 10},
+		{remote, 3, 30},
+		{remote, 1.5, 15},
+		{remote, 0.5, 10},
+	}
+	for i, test := range tests {
+		if proximity := test.node.AdjustedProximity(self, test.multiplier); proximity != test.expected {
+			t.Errorf("test %v: expected proximity of %s with a multiplier of %v to be %d, got %d", i, test.node.ID, test.multiplier, test.expected, proximity)
+		}
+	}
+	cluster := NewCluster(self, nil)
+	cluster.SetRegionMultiplier(0.5)
+	if proximity := self.Proximity(remote); proximity != 10 {
+		t.Errorf("Expected a region multiplier less than 1 to be treated as 1, got proximity %d.", proximity)
+	}
+}
+
+// Test that empty Node structs are zero, and initialised Nodes aren't, even with the zero NodeID
+func TestNodeIsZero(t *testing.T) {
+	if !(Node{}).IsZero() {
+		t.Errorf("Expected an empty Node to be zero.")
+	}
+	if NewNode(NodeID{}, "127.0.0.1", "", "testing", 8080).IsZero() {
+		t.Errorf("Expected an initialised Node with the zero NodeID not to be zero.")
+	}
+}
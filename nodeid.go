@@ -1,6 +1,7 @@
 package wendy
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
@@ -8,25 +9,75 @@ import (
 	"fmt"
 	"math"
 	"math/big"
+	"strconv"
 )
 
-const idLen = 32
+// IDDigits is the number of digits in a NodeID, and IDBase is the number of values each digit can take. They set the dimensions of the routing table, which has a row for each digit and a column for each value.
+const (
+	IDDigits = 32
+	IDBase   = 1 << digitBits
+)
+
+// digitBits is the number of bits in each digit of a NodeID, and wordDigits is the number of digits in each of the NodeID's uint64 words.
+const (
+	digitBits  = 4
+	wordDigits = 64 / digitBits
+)
 
 // NodeID is a unique address for a node in the network.
+// NodeIDs are comparable with ==, so they can be used as map keys directly.
 type NodeID [2]uint64
 
 // NodeIDFromBytes creates a NodeID from an array of bytes.
-// It returns the created NodeID, trimmed to the first 32 digits, or nil and an error if there are not enough bytes to yield 32 digits.
+// It returns the created NodeID, trimmed to the first 32 digits, or nil and an error wrapping ErrInvalidNodeID if there are not enough bytes to yield 32 digits.
 func NodeIDFromBytes(source []byte) (NodeID, error) {
 	var result NodeID
 	if len(source) < 16 {
-		return result, errors.New("Not enough bytes to create a NodeID.")
+		return result, fmt.Errorf("%w: Not enough bytes to create a NodeID.", ErrInvalidNodeID)
 	}
 	result[0] = binary.BigEndian.Uint64(source)
 	result[1] = binary.BigEndian.Uint64(source[8:])
 	return result, nil
 }
 
+// HashToNodeID maps arbitrary data, like an application's key for an object, onto a NodeID, so it can be used as the key of a Message.
+// The NodeID is the first 128 bits of the SHA-256 hash of the data. This will not change, so the same data always yields the same NodeID.
+func HashToNodeID(data []byte) NodeID {
+	sum := sha256.Sum256(data)
+	var result NodeID
+	result[0] = binary.BigEndian.Uint64(sum[:8])
+	result[1] = binary.BigEndian.Uint64(sum[8:16])
+	return result
+}
+
+// NodeIDWithPrefix creates a NodeID whose leading base-16 digits are the digits passed to it, with the rest of its digits set to 0. It is meant for tests that need NodeIDs sharing a specific number of digits.
+// Only the low 4 bits of each digit are used, and any digits after the 32nd are ignored.
+func NodeIDWithPrefix(digits ...byte) NodeID {
+	var result NodeID
+	for i, digit := range digits {
+		if i >= IDDigits {
+			break
+		}
+		shift := uint(digitBits * (wordDigits - 1 - i%wordDigits))
+		result[i/wordDigits] |= uint64(digit&(IDBase-1)) << shift
+	}
+	return result
+}
+
+// NodeIDFromString creates a NodeID from its hexadecimal string encoding, as returned by String.
+// Both upper- and lowercase digits are accepted. It returns a NodeIDError, which wraps ErrInvalidNodeID, if the string is not exactly 32 hexadecimal digits.
+func NodeIDFromString(source string) (NodeID, error) {
+	var result NodeID
+	if len(source) != IDDigits {
+		return result, throwNodeIDError("NodeID strings must be exactly " + strconv.Itoa(IDDigits) + " hexadecimal digits, got \"" + source + "\".")
+	}
+	dec, err := hex.DecodeString(source)
+	if err != nil {
+		return result, throwNodeIDError("NodeID string \"" + source + "\" is not valid hexadecimal: " + err.Error())
+	}
+	return NodeIDFromBytes(dec)
+}
+
 // String returns the hexadecimal string encoding of the NodeID.
 func (id NodeID) String() string {
 	return fmt.Sprintf("%016x%016x", id[0], id[1])
@@ -37,7 +88,17 @@ func (id NodeID) Equals(other NodeID) bool {
 	return id[0] == other[0] && id[1] == other[1]
 }
 
-// Less tests two NodeIDs to determine if the ID the method is called on is less than the ID passed as an argument. An ID is considered to be less if the first inequal digit between the two IDs is considered to be less.
+// IsZero returns true if the NodeID is the zero value, e.g., the ID of an empty Node struct. The zero NodeID is a valid NodeID, so IsZero only tells an ID that was never set apart from one that was when the IDs come from somewhere real Nodes can't have the zero ID.
+func (id NodeID) IsZero() bool {
+	return id[0] == 0 && id[1] == 0
+}
+
+// Equal is the same as Equals, and exists for consistency with other packages' Equal methods.
+func (id NodeID) Equal(other NodeID) bool {
+	return id == other
+}
+
+// Less tests two NodeIDs to determine if the ID the method is called on is less than the ID passed as an argument. Because the node space is circular, an ID is considered to be less if the other ID is reached sooner by moving clockwise (counting up) from it than by moving counter-clockwise (counting down). When the two IDs are exactly half the node space (2^127) apart, neither arc is shorter, and the ID with the lower absolute value is considered to be less.
 func (id NodeID) Less(other NodeID) bool {
 	return id.RelPos(other) < 0
 }
@@ -84,7 +145,7 @@ func digitSet(x uint64) int {
 			}
 			return 9
 		}
-		if x&0x00000000f0000000 != 0 {
+		if x&0x0000000000f00000 != 0 {
 			return 10
 		}
 		return 11
@@ -101,15 +162,15 @@ func digitSet(x uint64) int {
 	return 15
 }
 
-// CommonPrefixLen returns the number of leading digits that are equal in the two NodeIDs.
+// CommonPrefixLen returns the number of leading digits that are equal in the two NodeIDs. It returns 0 if the first digits differ and 32 if the NodeIDs are identical.
 func (id NodeID) CommonPrefixLen(other NodeID) int {
 	if xor := id[0] ^ other[0]; xor != 0 {
 		return digitSet(xor)
 	}
 	if xor := id[1] ^ other[1]; xor != 0 {
-		return digitSet(xor) | 16
+		return digitSet(xor) + wordDigits
 	}
-	return idLen
+	return IDDigits
 }
 
 // differences returns the difference between the two NodeIDs in both directions.
@@ -123,7 +184,7 @@ func (id NodeID) differences(other NodeID) (NodeID, NodeID) {
 			b = 1
 		}
 		d1[0] = other[0] - (id[0] + uint64(b))
-		d2[0], d2[1] = math.MaxUint64-d1[0], math.MaxUint64-d1[1]+1
+		d2 = d1.negate()
 	} else {
 		d2[1] = id[1] - other[1]
 		// check for borrow
@@ -132,11 +193,22 @@ func (id NodeID) differences(other NodeID) (NodeID, NodeID) {
 			b = 1
 		}
 		d2[0] = id[0] - (other[0] + uint64(b))
-		d1[0], d1[1] = math.MaxUint64-d2[0], math.MaxUint64-d2[1]+1
+		d1 = d2.negate()
 	}
 	return d2, d1
 }
 
+// negate returns the two's complement of the NodeID, i.e., (2^128 - id) mod 2^128.
+func (id NodeID) negate() NodeID {
+	var result NodeID
+	result[0], result[1] = ^id[0], ^id[1]+1
+	// check for carry
+	if result[1] == 0 {
+		result[0]++
+	}
+	return result
+}
+
 // Diff returns the difference between two NodeIDs as an absolute value. It performs the modular arithmetic necessary to find the shortest distance between the IDs in the (2^128)-1 item nodespace.
 func (id NodeID) Diff(other NodeID) *big.Int {
 	d1, d2 := id.differences(other)
@@ -146,7 +218,80 @@ func (id NodeID) Diff(other NodeID) *big.Int {
 	return d2.Base10()
 }
 
-// RelPos uses modular arithmetic to determine whether the NodeID passed as an argument is to the left of the NodeID it is called on (-1), the same as the NodeID it is called on (0), or to the right of the NodeID it is called on (1) in the circular node space.
+// closer returns true if a is numerically closer to the NodeID than b, as measured by Diff. If a and b are exactly as close, which happens when the NodeID is halfway between them, a is closer if it is less than b, as defined by Less.
+//
+// Every Node must break ties the same way for Messages to be routed consistently; a Message whose key is equidistant from two Nodes could otherwise be passed back and forth between them. All routing decisions, and Cluster.Owns, use closer.
+func (id NodeID) closer(a, b NodeID) bool {
+	cmp := id.Diff(a).Cmp(id.Diff(b))
+	if cmp != 0 {
+		return cmp < 0
+	}
+	return a.Less(b)
+}
+
+// XORDistance returns the bitwise XOR of the two NodeIDs, which is the distance between them as Kademlia measures it. Unlike Diff, it isn't circular: NodeIDs that share a longer prefix are always closer, however near they are numerically.
+func (id NodeID) XORDistance(other NodeID) NodeID {
+	return NodeID{id[0] ^ other[0], id[1] ^ other[1]}
+}
+
+// DistanceMetric is a way of measuring how far apart two NodeIDs are, as used by Cluster.Distance.
+type DistanceMetric int
+
+const (
+	DistanceCircular DistanceMetric = iota // The shortest distance between the NodeIDs around the circular node space, as returned by NodeID.Diff
+	DistanceXOR                            // The bitwise XOR of the NodeIDs, as returned by NodeID.XORDistance
+)
+
+// Midpoint returns the NodeID halfway along the shorter arc between the two NodeIDs in the circular node space, rounding towards the start of the arc. Antipodal NodeIDs are ordered as in Less, so the arc that starts at the NodeID with the lower absolute value is used.
+func (id NodeID) Midpoint(other NodeID) NodeID {
+	start, end := id, other
+	if other.Less(id) {
+		start, end = other, id
+	}
+	return arcMidpoint(start, end)
+}
+
+// arcMidpoint returns the NodeID halfway along the arc from start to end, counting up and wrapping around, rounding towards start. Unlike Midpoint, the arc may be the longer one.
+func arcMidpoint(start, end NodeID) NodeID {
+	// the distance from start to end, counting up and wrapping around
+	var arc NodeID
+	arc[1] = end[1] - start[1]
+	borrow := uint64(0)
+	if end[1] < start[1] {
+		borrow = 1
+	}
+	arc[0] = end[0] - start[0] - borrow
+	arc[1] = arc[1]>>1 | arc[0]<<63
+	arc[0] >>= 1
+	var result NodeID
+	result[1] = start[1] + arc[1]
+	carry := uint64(0)
+	if result[1] < start[1] {
+		carry = 1
+	}
+	result[0] = start[0] + arc[0] + carry
+	return result
+}
+
+// Next returns the NodeID one greater than the NodeID, wrapping around from the greatest NodeID to 0. It is useful for turning an inclusive bound on a range of NodeIDs into an exclusive one, and vice versa.
+func (id NodeID) Next() NodeID {
+	id[1]++
+	if id[1] == 0 {
+		id[0]++
+	}
+	return id
+}
+
+// Prev returns the NodeID one less than the NodeID, wrapping around from 0 to the greatest NodeID.
+func (id NodeID) Prev() NodeID {
+	if id[1] == 0 {
+		id[0]--
+	}
+	id[1]--
+	return id
+}
+
+// RelPos uses modular arithmetic to compare the NodeID it is called on to the NodeID passed as an argument in the circular node space. It returns -1 if the NodeID it is called on is less than (to the left of) the argument, 0 if they are the same, and 1 if it is greater than (to the right of) the argument. See Less for how exactly antipodal NodeIDs are ordered.
 func (id NodeID) RelPos(other NodeID) int {
 	if id.Equals(other) {
 		return 0
@@ -155,6 +300,13 @@ func (id NodeID) RelPos(other NodeID) int {
 	if d1.absLess(d2) {
 		return 1
 	}
+	if d2.absLess(d1) {
+		return -1
+	}
+	// the IDs are antipodal; fall back on their absolute values
+	if other.absLess(id) {
+		return 1
+	}
 	return -1
 }
 
@@ -199,11 +351,31 @@ func (id *NodeID) UnmarshalJSON(source []byte) error {
 	if err != nil {
 		return err
 	}
-	dec, err := hex.DecodeString(str)
+	new_id, err := NodeIDFromString(str)
 	if err != nil {
 		return err
 	}
-	new_id, err := NodeIDFromBytes([]byte(dec))
+	*id = new_id
+	return nil
+}
+
+// GobEncode fulfills the GobEncoder interface, allowing NodeIDs to be serialised as 16 bytes by encoding/gob.
+func (id NodeID) GobEncode() ([]byte, error) {
+	result := make([]byte, 16)
+	binary.BigEndian.PutUint64(result, id[0])
+	binary.BigEndian.PutUint64(result[8:], id[1])
+	return result, nil
+}
+
+// GobDecode fulfills the GobDecoder interface, allowing NodeIDs to be unserialised by encoding/gob.
+func (id *NodeID) GobDecode(source []byte) error {
+	if id == nil {
+		return errors.New("GobDecode on nil NodeID.")
+	}
+	if len(source) != 16 {
+		return throwNodeIDError("Encoded NodeIDs must be exactly 16 bytes.")
+	}
+	new_id, err := NodeIDFromBytes(source)
 	if err != nil {
 		return err
 	}
@@ -211,16 +383,16 @@ func (id *NodeID) UnmarshalJSON(source []byte) error {
 	return nil
 }
 
-// Digit returns the ith 4-bit digit in the NodeID. If i >= 32, Digit panics.
-func (id NodeID) Digit(i int) byte {
-	if uint(i) >= 32 {
-		panic("invalid digit index")
+// Digit returns the ith 4-bit digit in the NodeID, counting from the most significant digit. It returns an InvalidArgumentError if i is not between 0 and 31, inclusive.
+func (id NodeID) Digit(i int) (byte, error) {
+	if uint(i) >= IDDigits {
+		return 0, throwInvalidArgumentError("Digit index must be between 0 and " + strconv.Itoa(IDDigits-1) + ", got " + strconv.Itoa(i) + ".")
 	}
 	n := id[0]
-	if i >= 16 {
+	if i >= wordDigits {
 		n = id[1]
-		i &= 15
+		i -= wordDigits
 	}
-	k := 4 * uint(15-i)
-	return byte((n >> k) & 0xf)
+	k := digitBits * uint(wordDigits-1-i)
+	return byte((n >> k) & (IDBase - 1)), nil
 }
@@ -2,7 +2,9 @@ package wendy
 
 import (
 	"bytes"
+	"errors"
 	"math/big"
+	"strconv"
 	"testing"
 )
 
@@ -32,6 +34,73 @@ func TestNodeIDString(t *testing.T) {
 	}
 }
 
+func TestNodeIDFromString(t *testing.T) {
+	tests := [...]struct {
+		str   string
+		id    NodeID
+		valid bool
+	}{
+		{
+			"00000000000000000000000000000000",
+			NodeID{0, 0},
+			true,
+		},
+		{
+			"0123456789abcdeffedcba9876543210",
+			NodeID{0x0123456789abcdef, 0xfedcba9876543210},
+			true,
+		},
+		{
+			"0123456789ABCDEFFEDCBA9876543210",
+			NodeID{0x0123456789abcdef, 0xfedcba9876543210},
+			true,
+		},
+		{
+			"0123456789abcdeffedcba987654321",
+			NodeID{},
+			false,
+		},
+		{
+			"0123456789abcdeffedcba98765432100",
+			NodeID{},
+			false,
+		},
+		{
+			"0123456789abcdeffedcba987654321g",
+			NodeID{},
+			false,
+		},
+		{
+			"",
+			NodeID{},
+			false,
+		},
+	}
+	for i, test := range tests {
+		id, err := NodeIDFromString(test.str)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("test %v: expected error for %q, got NodeID %v", i, test.str, id)
+			} else if _, ok := err.(NodeIDError); !ok {
+				t.Errorf("test %v: expected NodeIDError, got %v", i, err)
+			} else if !errors.Is(err, ErrInvalidNodeID) {
+				t.Errorf("test %v: expected NodeIDError to match ErrInvalidNodeID, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %v: unexpected error %v", i, err)
+			continue
+		}
+		if !id.Equals(test.id) {
+			t.Errorf("test %v: expected %v, got %v", i, test.id, id)
+		}
+		if rt, err := NodeIDFromString(id.String()); err != nil || !rt.Equals(id) {
+			t.Errorf("test %v: %v did not round-trip through String", i, id)
+		}
+	}
+}
+
 func TestNodeIDRelPos(t *testing.T) {
 	tests := [...]struct {
 		bytes1, bytes2 []byte
@@ -84,6 +153,35 @@ func TestNodeIDRelPos(t *testing.T) {
 	}
 }
 
+// Make sure IDs just below and just above a reference wrap onto the correct side, and antipodal IDs are ordered consistently
+func TestNodeIDRelPosWrap(t *testing.T) {
+	max := NodeID{0xffffffffffffffff, 0xffffffffffffffff}
+	tests := [...]struct {
+		ref, other NodeID
+		less       bool
+	}{
+		// just below zero wraps around to the maximum ID, which is to the left of zero
+		{NodeID{0, 0}, max, false},
+		// just above the maximum ID wraps around to zero, which is to the right of the maximum
+		{max, NodeID{0, 0}, true},
+		{NodeID{0, 0}, NodeID{0, 1}, true},
+		{NodeID{0, 1}, NodeID{0, 0}, false},
+		// exactly antipodal: the lower absolute value is less, from both sides
+		{NodeID{0, 0}, NodeID{0x8000000000000000, 0}, true},
+		{NodeID{0x8000000000000000, 0}, NodeID{0, 0}, false},
+		{NodeID{0x4000000000000000, 5}, NodeID{0xc000000000000000, 5}, true},
+		{NodeID{0xc000000000000000, 5}, NodeID{0x4000000000000000, 5}, false},
+	}
+	for i, test := range tests {
+		if less := test.ref.Less(test.other); less != test.less {
+			t.Errorf("test %v: expected %s.Less(%s) to be %v, got %v", i, test.ref, test.other, test.less, less)
+		}
+		if rev := test.ref.RelPos(test.other); rev != -test.other.RelPos(test.ref) {
+			t.Errorf("test %v: RelPos was not antisymmetric for %s and %s", i, test.ref, test.other)
+		}
+	}
+}
+
 func TestNodeIDBase10(t *testing.T) {
 	tests := [...]struct {
 		bytes  []byte
@@ -168,17 +266,58 @@ func TestNodeIDIterDigit(t *testing.T) {
 		t.Fatal("unexpected error", err)
 	}
 	for i := 0; i < 16; i++ {
-		if digit := id.Digit(i); digit != byte(i) {
+		digit, err := id.Digit(i)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if digit != byte(i) {
 			t.Errorf("expected digit %#x, got %#x", i, digit)
 		}
 	}
 	for i := 0; i < 16; i++ {
-		if digit := id.Digit(16 + i); digit != byte(15-i) {
+		digit, err := id.Digit(16 + i)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if digit != byte(15-i) {
 			t.Errorf("expected digit %#x, got %#x", 15-i, digit)
 		}
 	}
 }
 
+// Make sure the boundary digits are readable and out-of-range indices return an error.
+func TestNodeIDDigitBounds(t *testing.T) {
+	id, err := NodeIDFromString("a000000000000000000000000000000b")
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	tests := [...]struct {
+		index int
+		digit byte
+		valid bool
+	}{
+		{0, 0xa, true},
+		{31, 0xb, true},
+		{-1, 0, false},
+		{32, 0, false},
+	}
+	for i, test := range tests {
+		digit, err := id.Digit(test.index)
+		if !test.valid {
+			if _, ok := err.(InvalidArgumentError); !ok {
+				t.Errorf("test %v: expected InvalidArgumentError for index %v, got %v", i, test.index, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %v: unexpected error %v", i, err)
+		}
+		if digit != test.digit {
+			t.Errorf("test %v: expected digit %#x, got %#x", i, test.digit, digit)
+		}
+	}
+}
+
 // Make sure an error is thrown if a NodeID is created from less than 32 bytes
 func TestNodeIDFromBytesWithInsufficientBytes(t *testing.T) {
 	bytes := []byte("123456789012345")
@@ -232,14 +371,40 @@ func TestNodeIDCommonPrefixLen(t *testing.T) {
 			t.Logf("First significant digit: %v vs. %v", n3[n3.CommonPrefixLen(n4)], n4[n3.CommonPrefixLen(n4)])
 		}
 	}
-	if n4.CommonPrefixLen(n4) != idLen {
+	if n4.CommonPrefixLen(n4) != IDDigits {
 		t.Errorf("Common prefix length should be %v, is %v instead.", len(n4), n4.CommonPrefixLen(n4))
-		if n4.CommonPrefixLen(n4) < idLen {
+		if n4.CommonPrefixLen(n4) < IDDigits {
 			t.Logf("First significant digit: %v vs. %v", n4[n4.CommonPrefixLen(n4)], n4[n4.CommonPrefixLen(n4)])
 		}
 	}
 }
 
+// Make sure the common prefix length is correct when the NodeIDs first differ at each digit
+func TestNodeIDCommonPrefixLenEachDigit(t *testing.T) {
+	base := NodeID{0x0123456789abcdef, 0xfedcba9876543210}
+	if base.CommonPrefixLen(base) != IDDigits {
+		t.Errorf("Common prefix length of identical IDs should be %v, is %v instead.", IDDigits, base.CommonPrefixLen(base))
+	}
+	for i := 0; i < IDDigits; i++ {
+		other := base
+		if i < 16 {
+			other[0] ^= 0x1 << uint(4*(15-i))
+		} else {
+			other[1] ^= 0x1 << uint(4*(31-i))
+		}
+		if base.CommonPrefixLen(other) != i {
+			t.Errorf("Common prefix length of %s and %s should be %v, is %v instead.", base, other, i, base.CommonPrefixLen(other))
+		}
+		if other.CommonPrefixLen(base) != i {
+			t.Errorf("Common prefix length of %s and %s should be %v, is %v instead.", other, base, i, other.CommonPrefixLen(base))
+		}
+	}
+	inverse := NodeID{^base[0], ^base[1]}
+	if base.CommonPrefixLen(inverse) != 0 {
+		t.Errorf("Common prefix length of %s and %s should be 0, is %v instead.", base, inverse, base.CommonPrefixLen(inverse))
+	}
+}
+
 // Make sure the correct difference is reported between NodeIDs
 func TestNodeIDDiff(t *testing.T) {
 	n1 := NodeID{0xfdfdfdfdfdfdfdfd, 0xfdfdfdfdfdfdfdfd}
@@ -282,6 +447,42 @@ func TestNodeIDDiffWrap(t *testing.T) {
 	}
 }
 
+// Make sure Diff agrees with modular big.Int arithmetic when the difference crosses the 0/2^128 boundary
+func TestNodeIDDiffAcrossBoundary(t *testing.T) {
+	tests := [...]struct {
+		id1, id2 NodeID
+	}{
+		{NodeID{0xffffffffffffffff, 0xfffffffffffffff0}, NodeID{0, 0x10}},
+		{NodeID{0xfffffffffffffff0, 0}, NodeID{0x10, 0}},
+		{NodeID{0xffffffffffffffff, 0}, NodeID{0, 0xffffffffffffffff}},
+		{NodeID{0x8000000000000000, 0}, NodeID{0, 0}},
+		{NodeID{0x8000000000000000, 1}, NodeID{0, 0}},
+		{NodeID{0x7fffffffffffffff, 0xffffffffffffffff}, NodeID{0, 0}},
+		{NodeID{0x0123456789abcdef, 0xfedcba9876543210}, NodeID{0xfedcba9876543210, 0x0123456789abcdef}},
+	}
+	ring := new(big.Int).Lsh(big.NewInt(1), 128)
+	for i, test := range tests {
+		a, b := test.id1.Base10(), test.id2.Base10()
+		forward := new(big.Int).Sub(a, b)
+		forward.Mod(forward, ring)
+		backward := new(big.Int).Sub(ring, forward)
+		backward.Mod(backward, ring)
+		expected := forward
+		if backward.Cmp(forward) < 0 {
+			expected = backward
+		}
+		if diff := test.id1.Diff(test.id2); diff.Cmp(expected) != 0 {
+			t.Errorf("test %v: expected %v, got %v", i, expected, diff)
+		}
+		if diff := test.id2.Diff(test.id1); diff.Cmp(expected) != 0 {
+			t.Errorf("test %v: expected %v in reverse, got %v", i, expected, diff)
+		}
+		if diff := test.id1.Diff(test.id2); diff.Sign() < 0 {
+			t.Errorf("test %v: expected non-negative difference, got %v", i, diff)
+		}
+	}
+}
+
 // Quick benchmark to test how expensive diffing nodes is
 func BenchmarkNodeIDDiff(b *testing.B) {
 	b.StopTimer()
@@ -299,3 +500,195 @@ func BenchmarkNodeIDDiff(b *testing.B) {
 		n1.Diff(n2)
 	}
 }
+
+// Test that hashing data always yields the same NodeID, and that NodeIDs are spread evenly across the first digit
+func TestNodeIDHash(t *testing.T) {
+	id := HashToNodeID([]byte("hello"))
+	// the first 128 bits of sha256("hello")
+	if id.String() != "2cf24dba5fb0a30e26e83b2ac5b9e29e" {
+		t.Errorf("Expected %s, got %s.", "2cf24dba5fb0a30e26e83b2ac5b9e29e", id)
+	}
+	if !HashToNodeID([]byte("hello")).Equals(id) {
+		t.Errorf("Expected hashing the same data to yield the same NodeID.")
+	}
+	if HashToNodeID([]byte("hello!")).Equals(id) {
+		t.Errorf("Expected hashing different data to yield a different NodeID.")
+	}
+	counts := [16]int{}
+	samples := 16000
+	for i := 0; i < samples; i++ {
+		digit, err := HashToNodeID([]byte(strconv.Itoa(i))).Digit(0)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		counts[digit] += 1
+	}
+	for digit, count := range counts {
+		if count < samples/16*3/4 || count > samples/16*5/4 {
+			t.Errorf("Expected around %d NodeIDs starting with %x, got %d.", samples/16, digit, count)
+		}
+	}
+}
+
+// Test that NodeIDs can be used as map keys, and that they compare equal after being stringified and parsed
+func TestNodeIDMapKey(t *testing.T) {
+	first := HashToNodeID([]byte("first"))
+	second := HashToNodeID([]byte("second"))
+	seen := map[NodeID]int{first: 1, second: 2}
+	parsed, err := NodeIDFromString(first.String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !parsed.Equal(first) || !first.Equal(parsed) {
+		t.Errorf("Expected %s to equal %s.", parsed, first)
+	}
+	if parsed.Equal(second) {
+		t.Errorf("Expected %s not to equal %s.", parsed, second)
+	}
+	if seen[parsed] != 1 {
+		t.Errorf("Expected lookup of %s to return 1, got %d.", parsed, seen[parsed])
+	}
+	if _, ok := seen[HashToNodeID([]byte("third"))]; ok {
+		t.Errorf("Expected lookup of an unknown NodeID to fail.")
+	}
+}
+
+// Test that NodeIDs built from a prefix have the expected digits, and share exactly as many digits as their prefixes do
+func TestNodeIDWithPrefix(t *testing.T) {
+	tests := []struct {
+		digits   []byte
+		expected string
+	}{
+		{[]byte{}, "00000000000000000000000000000000"},
+		{[]byte{0xa, 0xb, 0xc}, "abc00000000000000000000000000000"},
+		{[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf, 0, 1}, "123456789abcdef01000000000000000"},
+	}
+	for _, test := range tests {
+		if id := NodeIDWithPrefix(test.digits...); id.String() != test.expected {
+			t.Errorf("Expected NodeID with prefix %v to be %s, got %s.", test.digits, test.expected, id)
+		}
+	}
+	first := NodeIDWithPrefix(1, 2, 3, 4)
+	second := NodeIDWithPrefix(1, 2, 3, 5)
+	if l := first.CommonPrefixLen(second); l != 3 {
+		t.Errorf("Expected %s and %s to share %d digits, got %d.", first, second, 3, l)
+	}
+}
+
+// Test finding the midpoint of the shorter arc between two NodeIDs, including across the wrap-around
+func TestNodeIDMidpoint(t *testing.T) {
+	tests := []struct {
+		a, b     NodeID
+		expected NodeID
+	}{
+		{NodeID{0, 1}, NodeID{0, 1}, NodeID{0, 1}},
+		{NodeID{0, 1}, NodeID{0, 2}, NodeID{0, 1}},
+		{NodeID{0, 1}, NodeID{0, 3}, NodeID{0, 2}},
+		{NodeID{0, 0xffffffffffffffff}, NodeID{1, 1}, NodeID{1, 0}},
+		{NodeID{0xffffffffffffffff, 0xffffffffffffffff}, NodeID{0, 1}, NodeID{0, 0}},
+		{NodeID{0xffffffffffffffff, 0xfffffffffffffffe}, NodeID{0, 0}, NodeID{0xffffffffffffffff, 0xffffffffffffffff}},
+		{NodeID{0, 0}, NodeID{0x8000000000000000, 0}, NodeID{0x4000000000000000, 0}},
+		{NodeID{0x4000000000000000, 0}, NodeID{0xc000000000000000, 0}, NodeID{0x8000000000000000, 0}},
+	}
+	for _, test := range tests {
+		if mid := test.a.Midpoint(test.b); mid != test.expected {
+			t.Errorf("Expected the midpoint of %s and %s to be %s, got %s.", test.a, test.b, test.expected, mid)
+		}
+		if mid := test.b.Midpoint(test.a); mid != test.expected {
+			t.Errorf("Expected the midpoint of %s and %s to be %s, got %s.", test.b, test.a, test.expected, mid)
+		}
+	}
+}
+
+// Test that the closer of two NodeIDs to a key is decided by Less when they're exactly as close
+func TestNodeIDCloser(t *testing.T) {
+	tests := []struct {
+		key, a, b NodeID
+		expected  bool
+	}{
+		{NodeID{0, 2}, NodeID{0, 1}, NodeID{0, 4}, true},
+		{NodeID{0, 2}, NodeID{0, 4}, NodeID{0, 1}, false},
+		{NodeID{0, 2}, NodeID{0, 1}, NodeID{0, 3}, true},
+		{NodeID{0, 2}, NodeID{0, 3}, NodeID{0, 1}, false},
+		{NodeID{0, 0}, NodeID{0xffffffffffffffff, 0xffffffffffffffff}, NodeID{0, 1}, true},
+		{NodeID{0, 0}, NodeID{0, 1}, NodeID{0xffffffffffffffff, 0xffffffffffffffff}, false},
+		{NodeID{0, 2}, NodeID{0, 1}, NodeID{0, 1}, false},
+	}
+	for _, test := range tests {
+		if closer := test.key.closer(test.a, test.b); closer != test.expected {
+			t.Errorf("Expected %s to be closer to %s than %s: %v, got %v.", test.a, test.key, test.b, test.expected, closer)
+		}
+	}
+}
+
+// Test that only the all-zero NodeID is zero
+func TestNodeIDIsZero(t *testing.T) {
+	zero, err := NodeIDFromString("00000000000000000000000000000000")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !zero.IsZero() || !(NodeID{}).IsZero() {
+		t.Errorf("Expected %s to be zero.", zero)
+	}
+	id, err := NodeIDFromString("00000000000000000000000000000001")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if id.IsZero() || NodeIDWithPrefix(1).IsZero() {
+		t.Errorf("Expected %s and %s not to be zero.", id, NodeIDWithPrefix(1))
+	}
+}
+
+// Test that XOR distance is symmetric, and zero between identical NodeIDs
+func TestNodeIDXORDistance(t *testing.T) {
+	ids := []NodeID{
+		{0, 0},
+		{0, 1},
+		{0x8000000000000000, 0},
+		{0xffffffffffffffff, 0xffffffffffffffff},
+		NodeIDWithPrefix(3, 7),
+		HashToNodeID([]byte("xor")),
+	}
+	for _, a := range ids {
+		if d := a.XORDistance(a); !d.IsZero() {
+			t.Errorf("Expected %s to be no distance from itself, got %s.", a, d)
+		}
+		for _, b := range ids {
+			if ab, ba := a.XORDistance(b), b.XORDistance(a); ab != ba {
+				t.Errorf("Expected the distance from %s to %s to be symmetric, got %s and %s.", a, b, ab, ba)
+			}
+		}
+	}
+	// numerically adjacent, but differing in every bit
+	a, b := NodeID{0x7fffffffffffffff, 0xffffffffffffffff}, NodeID{0x8000000000000000, 0}
+	if d := a.XORDistance(b); d != (NodeID{0xffffffffffffffff, 0xffffffffffffffff}) {
+		t.Errorf("Expected %s and %s to be as far apart as possible, got %s.", a, b, d)
+	}
+	if d := a.Diff(b); d.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("Expected %s and %s to be 1 apart around the node space, got %s.", a, b, d)
+	}
+}
+
+// Test that Next and Prev step to the adjacent NodeIDs, carrying between the halves and wrapping around the node space
+func TestNodeIDNextPrev(t *testing.T) {
+	max := NodeID{^uint64(0), ^uint64(0)}
+	cases := []struct {
+		id, next NodeID
+	}{
+		{NodeID{0, 0}, NodeID{0, 1}},
+		{NodeID{0, ^uint64(0)}, NodeID{1, 0}},
+		{NodeID{5, 7}, NodeID{5, 8}},
+		{max, NodeID{0, 0}},
+	}
+	for _, c := range cases {
+		if next := c.id.Next(); next != c.next {
+			t.Errorf("Expected %s after %s, got %s.", c.next, c.id, next)
+		}
+		if prev := c.next.Prev(); prev != c.id {
+			t.Errorf("Expected %s before %s, got %s.", c.id, c.next, prev)
+		}
+	}
+	if prev := (NodeID{}).Prev(); prev != max {
+		t.Errorf("Expected %s before 0, got %s.", max, prev)
+	}
+}
@@ -0,0 +1,57 @@
+package wendy
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RetryPolicy controls how many times the Cluster tries to send a Message to another Node before giving up, and how long it waits between attempts. The wait starts at BaseDelay and doubles after each failed attempt, up to MaxDelay.
+//
+// A MaxAttempts of less than 2 means every Message is only sent once, which is the default. Retrying a Message whose acknowledgement timed out may deliver it twice.
+type RetryPolicy struct {
+	MaxAttempts int           // The number of times a Message is sent before the last error is returned
+	BaseDelay   time.Duration // How long to wait after the first failed attempt
+	MaxDelay    time.Duration // The longest to wait between attempts; zero means there is no limit
+}
+
+// delay returns how long to wait after the specified failed attempt, counting from 1.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// retry calls f until it succeeds, the policy runs out of attempts, or the context is done, using the Clock to wait between attempts. It returns the context's error if it is done while waiting for the next attempt. If f fails every time the policy allows it to be retried, its last error is returned wrapped in a TimeoutError, unless it already is one; if the policy only allows one attempt, f's error is returned as is.
+func (p RetryPolicy) retry(ctx context.Context, clock Clock, f func() error) error {
+	start := clock.Now()
+	attempt := 1
+	for {
+		err := f()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			if _, ok := err.(TimeoutError); ok || attempt < 2 {
+				return err
+			}
+			timeout := throwTimeout(fmt.Sprintf("Sending message %d times", attempt), clock.Now().Sub(start))
+			timeout.Err = err
+			return timeout
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(p.delay(attempt)):
+		}
+		attempt++
+	}
+}
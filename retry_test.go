@@ -0,0 +1,98 @@
+package wendy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test that the delay between attempts doubles until it reaches the maximum
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 6, BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 50 * time.Millisecond},
+		{5, 50 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if delay := policy.delay(test.attempt); delay != test.expected {
+			t.Errorf("Expected delay after attempt %d to be %s, got %s.", test.attempt, test.expected, delay)
+		}
+	}
+}
+
+// Test that a call that fails twice succeeds when it is retried
+func TestRetryPolicyFlaky(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	attempts := 0
+	err := policy.retry(context.Background(), realClock{}, func() error {
+		attempts++
+		if attempts < 3 {
+			return deadNodeError
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d.", attempts)
+	}
+}
+
+// Test that the last error is returned, wrapped in a TimeoutError, once the attempts run out
+func TestRetryPolicyExhausted(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+	attempts := 0
+	err := policy.retry(context.Background(), realClock{}, func() error {
+		attempts++
+		return throwTimeout("Testing", time.Second)
+	})
+	if _, ok := err.(TimeoutError); !ok {
+		t.Errorf("Expected TimeoutError, got %v.", err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d.", attempts)
+	}
+	err = policy.retry(context.Background(), realClock{}, func() error {
+		return deadNodeError
+	})
+	if timeout, ok := err.(TimeoutError); !ok || timeout.Err != deadNodeError || !errors.Is(err, deadNodeError) {
+		t.Errorf("Expected a TimeoutError wrapping deadNodeError, got %v.", err)
+	}
+	attempts = 0
+	err = RetryPolicy{}.retry(context.Background(), realClock{}, func() error {
+		attempts++
+		return deadNodeError
+	})
+	if err != deadNodeError || attempts != 1 {
+		t.Errorf("Expected a single attempt returning deadNodeError with the zero RetryPolicy, got %d attempts returning %v.", attempts, err)
+	}
+}
+
+// Test that retrying stops when the context is cancelled
+func TestRetryPolicyCancel(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+	}()
+	err := policy.retry(ctx, realClock{}, func() error {
+		attempts++
+		return errors.New("Always fails.")
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v.", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt, got %d.", attempts)
+	}
+}
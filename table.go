@@ -1,32 +1,130 @@
 package wendy
 
 import (
+	"encoding/gob"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
+// routingTable holds the Nodes that share a prefix of their ID with the current Node, for routing Messages towards keys. The Node in row r, column c shares the first r digits of its ID with the current Node and has c as its next digit. Each cell holds up to maxEntries Nodes, ordered from closest to furthest in proximity; the closest Node is the one Messages are routed to. Pinned Nodes are ordered ahead of the others, and are kept even if that takes the cell over maxEntries.
 type routingTable struct {
-	self     *Node
-	nodes    [32][16]*Node
-	log      *log.Logger
-	logLevel int
-	lock     *sync.RWMutex
+	self       *Node
+	nodes      [IDDigits][IDBase][]*Node
+	maxEntries int
+	pinned     map[NodeID]bool
+	log        Logger
+	logLevel   int
+	lock       *sync.RWMutex
 }
 
+// defaultMaxEntries is the number of Nodes kept in each cell of the routingTable, unless Cluster.SetMaxColumnEntries is used.
+const defaultMaxEntries = 8
+
 func newRoutingTable(self *Node) *routingTable {
 	return &routingTable{
-		self:     self,
-		nodes:    [32][16]*Node{},
-		log:      log.New(os.Stdout, "wendy#routingTable("+self.ID.String()+")", log.LstdFlags),
-		logLevel: LogLevelWarn,
-		lock:     new(sync.RWMutex),
+		self:       self,
+		nodes:      [IDDigits][IDBase][]*Node{},
+		maxEntries: defaultMaxEntries,
+		pinned:     map[NodeID]bool{},
+		log:        NewLogger(log.New(os.Stdout, "wendy#routingTable("+self.ID.String()+")", log.LstdFlags)),
+		logLevel:   LogLevelWarn,
+		lock:       new(sync.RWMutex),
 	}
 }
 
 var rtDuplicateInsertError = errors.New("Node already exists in routing table.")
+var rtFullError = fmt.Errorf("%w: Node is further than every Node in its routing table cell.", ErrTableFull)
+
+// setMaxEntries sets the number of Nodes kept in each cell of the routingTable, dropping the furthest Nodes from any cells that hold more. Values less than 1 are treated as 1.
+func (t *routingTable) setMaxEntries(max int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if max < 1 {
+		max = 1
+	}
+	t.maxEntries = max
+	for row := range t.nodes {
+		for col := range t.nodes[row] {
+			if limit := t.capacity(t.nodes[row][col]); len(t.nodes[row][col]) > limit {
+				t.nodes[row][col] = t.nodes[row][col][:limit]
+				t.self.incrementRTVersion()
+			}
+		}
+	}
+}
+
+// setPinned sets whether the Node with the specified ID is pinned, re-ordering its cell. The Node doesn't have to be in the routingTable; if it is inserted later, it is pinned then. Unpinning a Node may drop the furthest Node from a cell that is over maxEntries.
+func (t *routingTable) setPinned(id NodeID, pinned bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	row, col, err := t.cell(id, "pin", "in")
+	if err != nil {
+		return err
+	}
+	if pinned {
+		t.pinned[id] = true
+	} else {
+		delete(t.pinned, id)
+	}
+	entries := append([]*Node{}, t.nodes[row][col]...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return t.before(entries[i], entries[j])
+	})
+	if limit := t.capacity(entries); len(entries) > limit {
+		entries = entries[:limit]
+		t.self.incrementRTVersion()
+	}
+	t.nodes[row][col] = entries
+	return nil
+}
+
+// before returns true if a belongs ahead of b in their cell: pinned Nodes first, then by proximity, treating unknown (negative) proximities as the furthest. The caller must hold the lock.
+func (t *routingTable) before(a, b *Node) bool {
+	if pinnedA, pinnedB := t.pinned[a.ID], t.pinned[b.ID]; pinnedA != pinnedB {
+		return pinnedA
+	}
+	return proximityLess(t.self.Proximity(a), t.self.Proximity(b))
+}
 
+// capacity returns how many of the entries, which belong in the same cell, the cell can hold: maxEntries, or more if more of them than that are pinned. The caller must hold the lock.
+func (t *routingTable) capacity(entries []*Node) int {
+	pinned := 0
+	for _, node := range entries {
+		if t.pinned[node.ID] {
+			pinned++
+		}
+	}
+	if pinned > t.maxEntries {
+		return pinned
+	}
+	return t.maxEntries
+}
+
+// cell returns the row and column of the routingTable that the Node with the specified ID belongs in.
+func (t *routingTable) cell(id NodeID, action, preposition string) (int, int, error) {
+	row := t.self.ID.CommonPrefixLen(id)
+	if row >= len(t.nodes) {
+		return 0, 0, throwIdentityError(action, preposition, "routing table")
+	}
+	digit, err := id.Digit(row)
+	if err != nil {
+		return 0, 0, err
+	}
+	col := int(digit)
+	if col >= len(t.nodes[row]) {
+		return 0, 0, impossibleError
+	}
+	return row, col, nil
+}
+
+// insertNode inserts the Node into its cell of the routingTable with its proximity, returning the inserted Node. A Node further than every Node in a full cell isn't inserted, and rtFullError, which wraps ErrTableFull, is returned, so callers can tell it apart from a Node that was inserted; a Node that is already in the routingTable is re-sorted by its new proximity, and rtDuplicateInsertError is returned.
 func (t *routingTable) insertNode(node Node, proximity int64) (*Node, error) {
 	return t.insertValues(node.ID, node.LocalIP, node.GlobalIP, node.Region, node.Port, node.routingTableVersion, node.leafsetVersion, node.neighborhoodSetVersion, proximity)
 }
@@ -37,86 +135,195 @@ func (t *routingTable) insertValues(id NodeID, localIP, globalIP, region string,
 	node := NewNode(id, localIP, globalIP, region, port)
 	node.updateVersions(rtVersion, lsVersion, nsVersion)
 	node.setProximity(proximity)
-	row := t.self.ID.CommonPrefixLen(node.ID)
-	if row >= len(t.nodes) {
-		return nil, throwIdentityError("insert", "into", "routing table")
+	return t.insert(node)
+}
+
+// insert does the work for insertValues and replace. The caller must hold the lock.
+func (t *routingTable) insert(node *Node) (*Node, error) {
+	row, col, err := t.cell(node.ID, "insert", "into")
+	if err != nil {
+		return nil, err
 	}
-	col := int(node.ID.Digit(row))
-	if col >= len(t.nodes[row]) {
-		return nil, impossibleError
-	}
-	if t.nodes[row][col] != nil {
-		if node.ID.Equals(t.nodes[row][col].ID) {
-			t.debug("Node %s already in routing table. Versions before insert:\nrouting table: %d\nleaf set: %d\nneighborhood set: %d\n", t.nodes[row][col].ID.String(), t.nodes[row][col].routingTableVersion, t.nodes[row][col].leafsetVersion, t.nodes[row][col].neighborhoodSetVersion)
-			node.updateVersions(t.nodes[row][col].routingTableVersion, t.nodes[row][col].leafsetVersion, t.nodes[row][col].neighborhoodSetVersion)
-			t.nodes[row][col] = node
-			t.debug("Versions after insert:\nrouting table: %d\nleaf set: %d\nneighborhood set: %d\n", t.nodes[row][col].routingTableVersion, t.nodes[row][col].leafsetVersion, t.nodes[row][col].neighborhoodSetVersion)
-			return nil, rtDuplicateInsertError
-		}
-		// keep the node that has the closest proximity
-		if t.self.Proximity(t.nodes[row][col]) > t.self.Proximity(node) {
-			t.nodes[row][col] = node
-			t.debug("Inserted node %s into routing table.", node.ID.String())
-			return node, nil
+	// pull out any existing entry for the Node, so it can be re-sorted by its new proximity
+	others := make([]*Node, 0, len(t.nodes[row][col]))
+	dup := false
+	for _, existing := range t.nodes[row][col] {
+		if node.ID.Equals(existing.ID) {
+			t.debug("Node %s already in routing table. Versions before insert:\nrouting table: %d\nleaf set: %d\nneighborhood set: %d\n", existing.ID.String(), existing.routingTableVersion, existing.leafsetVersion, existing.neighborhoodSetVersion)
+			node.updateVersions(existing.routingTableVersion, existing.leafsetVersion, existing.neighborhoodSetVersion)
+			if node.getRawProximity() < 0 {
+				node.setProximity(existing.getRawProximity())
+			}
+			t.debug("Versions after insert:\nrouting table: %d\nleaf set: %d\nneighborhood set: %d\n", node.routingTableVersion, node.leafsetVersion, node.neighborhoodSetVersion)
+			dup = true
+			continue
 		}
-	} else {
-		t.nodes[row][col] = node
-		t.debug("Inserted node %s into routing table.", node.ID.String())
+		others = append(others, existing)
+	}
+	// keep the cell ordered, pinned Nodes first and then by proximity
+	pos := len(others)
+	for i, existing := range others {
+		if t.before(node, existing) {
+			pos = i
+			break
+		}
+	}
+	entries := make([]*Node, 0, len(others)+1)
+	entries = append(entries, others[:pos]...)
+	entries = append(entries, node)
+	entries = append(entries, others[pos:]...)
+	limit := t.capacity(entries)
+	if pos >= limit {
+		return nil, rtFullError
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	t.nodes[row][col] = entries
+	if dup {
+		return nil, rtDuplicateInsertError
+	}
+	t.debug("Inserted node %s into routing table.", node.ID.String())
+	t.self.incrementRTVersion()
+	return node, nil
+}
+
+// insertBatch inserts the Nodes into the routingTable with their proximity, like insertNode would one at a time, but only takes the lock once and sorts each cell the Nodes belong in once, e.g., to load a whole routingTable. Nodes that can't be inserted, like the current Node itself, are skipped. It returns the number of Nodes that are in the routingTable afterwards that weren't before.
+func (t *routingTable) insertBatch(nodes []Node) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	type position struct{ row, col int }
+	cells := map[position][]*Node{}
+	order := []position{}
+	for i := range nodes {
+		row, col, err := t.cell(nodes[i].ID, "insert", "into")
+		if err != nil {
+			t.debug("Skipping inserting node %s: %s", nodes[i].ID, err.Error())
+			continue
+		}
+		node := NewNode(nodes[i].ID, nodes[i].LocalIP, nodes[i].GlobalIP, nodes[i].Region, nodes[i].Port)
+		node.updateVersions(nodes[i].routingTableVersion, nodes[i].leafsetVersion, nodes[i].neighborhoodSetVersion)
+		node.setProximity(nodes[i].getRawProximity())
+		pos := position{row, col}
+		entries, ok := cells[pos]
+		if !ok {
+			entries = append([]*Node{}, t.nodes[row][col]...)
+			order = append(order, pos)
+		}
+		// a Node inserted again is moved to the end, behind any Nodes exactly as close, as insertNode does
+		for j, existing := range entries {
+			if node.ID.Equals(existing.ID) {
+				node.updateVersions(existing.routingTableVersion, existing.leafsetVersion, existing.neighborhoodSetVersion)
+				if node.getRawProximity() < 0 {
+					node.setProximity(existing.getRawProximity())
+				}
+				entries = append(entries[:j], entries[j+1:]...)
+				break
+			}
+		}
+		cells[pos] = append(entries, node)
+	}
+	inserted := 0
+	for _, pos := range order {
+		entries := cells[pos]
+		sort.SliceStable(entries, func(i, j int) bool {
+			return t.before(entries[i], entries[j])
+		})
+		if limit := t.capacity(entries); len(entries) > limit {
+			entries = entries[:limit]
+		}
+		for _, node := range entries {
+			inserted++
+			for _, existing := range t.nodes[pos.row][pos.col] {
+				if node.ID.Equals(existing.ID) {
+					inserted--
+					break
+				}
+			}
+		}
+		t.nodes[pos.row][pos.col] = entries
+	}
+	if inserted > 0 {
+		t.debug("Inserted %d nodes into routing table.", inserted)
 		t.self.incrementRTVersion()
-		return node, nil
 	}
-	return nil, nil
+	return inserted
 }
 
 func (t *routingTable) getNode(id NodeID) (*Node, error) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
-	row := t.self.ID.CommonPrefixLen(id)
-	if row >= idLen {
-		return nil, throwIdentityError("get", "from", "routing table")
+	row, col, err := t.cell(id, "get", "from")
+	if err != nil {
+		return nil, err
 	}
-	col := int(id.Digit(row))
-	if col >= len(t.nodes[row]) {
-		return nil, impossibleError
-	}
-	if t.nodes[row][col] == nil {
-		return nil, nodeNotFoundError
-	}
-	if !t.nodes[row][col].ID.Equals(id) {
-		t.debug("Node not found. Expected %s, got %s.", id.String(), t.nodes[row][col].ID.String())
-		return nil, nodeNotFoundError
+	for _, node := range t.nodes[row][col] {
+		if node.ID.Equals(id) {
+			return node, nil
+		}
 	}
-	return t.nodes[row][col], nil
+	t.debug("Node %s not found in routing table.", id.String())
+	return nil, nodeNotFoundError
 }
 
 func (t *routingTable) route(id NodeID) (*Node, error) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
-	row := t.self.ID.CommonPrefixLen(id)
-	if row >= idLen {
-		return nil, throwIdentityError("route to", "in", "routing table")
-	}
-	col := int(id.Digit(row))
-	if col >= len(t.nodes[row]) {
-		return nil, impossibleError
+	row, col, err := t.cell(id, "route to", "in")
+	if err != nil {
+		return nil, err
 	}
-	if t.nodes[row][col] != nil {
-		return t.nodes[row][col], nil
+	if len(t.nodes[row][col]) > 0 {
+		return t.nodes[row][col][0], nil
 	}
-	diff := t.self.ID.Diff(id)
 	for scan_row := row; scan_row < len(t.nodes); scan_row++ {
-		for c, n := range t.nodes[scan_row] {
-			if c == int(t.self.ID.Digit(row)) {
-				continue
-			}
-			if n == nil {
-				continue
+		for _, entries := range t.nodes[scan_row] {
+			for _, n := range entries {
+				if id.closer(n.ID, t.self.ID) {
+					return n, nil
+				}
 			}
-			entry_diff := n.ID.Diff(id).Cmp(diff)
-			if entry_diff == -1 || (entry_diff == 0 && !t.self.ID.Less(n.ID)) {
-				return n, nil
+		}
+	}
+	return nil, nodeNotFoundError
+}
+
+// nearest returns the Node in the routingTable that is numerically closest to the key, regardless of the prefix it shares with the key. Ties go to the lesser ID. Unlike route, the current Node is never considered. If the routingTable is empty, nodeNotFoundError is returned.
+func (t *routingTable) nearest(key NodeID) (*Node, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	var best *Node
+	t.cells([]int{}, []int{}, func(row, col int, entries []*Node) {
+		for _, node := range entries {
+			if best == nil || key.closer(node.ID, best.ID) {
+				best = node
 			}
 		}
+	})
+	if best == nil {
+		return nil, nodeNotFoundError
+	}
+	return best, nil
+}
+
+// resample folds a new proximity sample into the routingTable's own entry for the Node with the ID, in place, as smoothProximity does, and re-sorts the Node's cell by its new proximity. It returns the routingTable's entry, or nodeNotFoundError if the Node isn't in the routingTable.
+func (t *routingTable) resample(id NodeID, sample int64, alpha float64) (*Node, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	row, col, err := t.cell(id, "update", "in")
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range t.nodes[row][col] {
+		if node.ID.Equals(id) {
+			node.smoothProximity(sample, alpha)
+			entries := append([]*Node{}, t.nodes[row][col]...)
+			sort.SliceStable(entries, func(i, j int) bool {
+				return t.before(entries[i], entries[j])
+			})
+			t.nodes[row][col] = entries
+			return node, nil
+		}
 	}
 	return nil, nodeNotFoundError
 }
@@ -124,103 +331,216 @@ func (t *routingTable) route(id NodeID) (*Node, error) {
 func (t *routingTable) removeNode(id NodeID) (*Node, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	row := t.self.ID.CommonPrefixLen(id)
-	if row >= idLen {
-		return nil, throwIdentityError("remove", "from", "routing table")
+	return t.remove(id)
+}
+
+// replace removes the Node with the old ID and inserts the new Node, with its proximity, in one step, so nothing routed through the routingTable in between finds the old Node's cell without either of them, e.g., to swap a Node that has failed for one that is known to be alive. It returns true if the old Node was in the routingTable. The new Node is inserted whether it was or not; if the new Node can't be inserted, the old Node isn't removed.
+func (t *routingTable) replace(old NodeID, node Node) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, _, err := t.cell(node.ID, "insert", "into"); err != nil {
+		return false, err
 	}
-	col := int(id.Digit(row))
-	if col > len(t.nodes[row]) {
-		return nil, impossibleError
+	removed, err := t.remove(old)
+	if err != nil && err != nodeNotFoundError {
+		return false, err
 	}
-	if t.nodes[row][col] != nil && t.nodes[row][col].ID.Equals(id) {
-		resp := t.nodes[row][col]
-		t.nodes[row][col] = nil
-		t.self.incrementRTVersion()
-		return resp, nil
-	} else {
-		return nil, nodeNotFoundError
+	replacement := NewNode(node.ID, node.LocalIP, node.GlobalIP, node.Region, node.Port)
+	replacement.updateVersions(node.routingTableVersion, node.leafsetVersion, node.neighborhoodSetVersion)
+	replacement.setProximity(node.getRawProximity())
+	_, err = t.insert(replacement)
+	if err != nil && err != rtDuplicateInsertError {
+		if removed != nil {
+			t.insert(removed)
+		}
+		return removed != nil, err
 	}
-	return nil, nil
+	return removed != nil, nil
 }
 
-func (t *routingTable) list(rows, cols []int) []*Node {
-	t.lock.RLock()
-	defer t.lock.RUnlock()
-	nodes := []*Node{}
-	if len(rows) > 0 {
-		for _, row := range rows {
-			if len(cols) > 0 {
-				for _, col := range cols {
-					if t.nodes[row][col] != nil {
-						nodes = append(nodes, t.nodes[row][col])
-					}
-				}
-			} else {
-				for _, col := range t.nodes[row] {
-					if col != nil {
-						nodes = append(nodes, col)
-					}
-				}
+// remove does the work for removeNode and replace. The caller must hold the lock.
+func (t *routingTable) remove(id NodeID) (*Node, error) {
+	row, col, err := t.cell(id, "remove", "from")
+	if err != nil {
+		return nil, err
+	}
+	for i, node := range t.nodes[row][col] {
+		if node.ID.Equals(id) {
+			entries := make([]*Node, 0, len(t.nodes[row][col])-1)
+			entries = append(entries, t.nodes[row][col][:i]...)
+			entries = append(entries, t.nodes[row][col][i+1:]...)
+			t.nodes[row][col] = entries
+			t.self.incrementRTVersion()
+			return node, nil
+		}
+	}
+	return nil, nodeNotFoundError
+}
+
+// cells calls f with the row, column and Nodes of each of the specified cells of the routingTable. If no rows are specified, every cell is included; if no columns are specified, every cell in the specified rows is included. Out of range rows and columns are skipped. The caller must hold the routingTable's lock.
+func (t *routingTable) cells(rows, cols []int, f func(row, col int, entries []*Node)) {
+	if len(rows) == 0 {
+		for row := range t.nodes {
+			rows = append(rows, row)
+		}
+		cols = []int{}
+	}
+	for _, row := range rows {
+		if row < 0 || row >= len(t.nodes) {
+			continue
+		}
+		if len(cols) == 0 {
+			for col, entries := range t.nodes[row] {
+				f(row, col, entries)
 			}
+			continue
 		}
-	} else {
-		for _, row := range t.nodes {
-			for _, col := range row {
-				if col != nil {
-					nodes = append(nodes, col)
+		for _, col := range cols {
+			if col < 0 || col >= len(t.nodes[row]) {
+				continue
+			}
+			f(row, col, t.nodes[row][col])
+		}
+	}
+}
+
+// iterate calls f with the row, column and position within the cell of each Node in the routingTable, until f returns false. The routingTable is locked for reading while iterate runs, so f must not modify it.
+func (t *routingTable) iterate(f func(row, col, entry int, node *Node) bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for row := range t.nodes {
+		for col := range t.nodes[row] {
+			for entry, node := range t.nodes[row][col] {
+				if !f(row, col, entry, node) {
+					return
 				}
 			}
 		}
 	}
+}
+
+// list returns every Node in the specified rows and columns of the routingTable, or in the whole routingTable if no rows are specified.
+func (t *routingTable) list(rows, cols []int) []*Node {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	nodes := []*Node{}
+	t.cells(rows, cols, func(row, col int, entries []*Node) {
+		nodes = append(nodes, entries...)
+	})
 	return nodes
 }
 
-func (t *routingTable) export(rows, cols []int) [32][16]*Node {
+// count returns the number of Nodes in the routingTable.
+func (t *routingTable) count() int {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
-	nodes := [32][16]*Node{}
-	if len(rows) > 0 {
-		for _, row := range rows {
-			if len(cols) > 0 {
-				for _, col := range cols {
-					if t.nodes[row][col] != nil {
-						nodes[row][col] = t.nodes[row][col]
-					}
-				}
-			} else {
-				for col, node := range t.nodes[row] {
-					if node != nil {
-						nodes[row][col] = node
-					}
-				}
+	count := 0
+	t.cells([]int{}, []int{}, func(row, col int, entries []*Node) {
+		count += len(entries)
+	})
+	return count
+}
+
+// export returns a copy of the closest Node in each of the specified rows and columns of the routingTable, or in the whole routingTable if no rows are specified. The Nodes are copies too, so changing them doesn't change the routingTable.
+func (t *routingTable) export(rows, cols []int) [IDDigits][IDBase]*Node {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	nodes := [IDDigits][IDBase]*Node{}
+	t.cells(rows, cols, func(row, col int, entries []*Node) {
+		if len(entries) > 0 {
+			nodes[row][col] = entries[0].copy()
+		}
+	})
+	return nodes
+}
+
+// status returns a NodeStatus for every Node in the routingTable, in the same rows, columns and order as the Nodes themselves.
+func (t *routingTable) status() [IDDigits][IDBase][]NodeStatus {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	statuses := [IDDigits][IDBase][]NodeStatus{}
+	t.cells([]int{}, []int{}, func(row, col int, entries []*Node) {
+		for _, node := range entries {
+			statuses[row][col] = append(statuses[row][col], node.Status())
+		}
+	})
+	return statuses
+}
+
+// save writes every Node in the routingTable to w, using encoding/gob, so it can be restored with load.
+func (t *routingTable) save(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(t.status())
+}
+
+// load reads Nodes written by save from r and inserts them into the routingTable, keeping their proximity. The Nodes don't have to have been saved by the same Node; each is placed according to the prefix it shares with the current Node. Any that can't be inserted, like the current Node itself, are skipped.
+func (t *routingTable) load(r io.Reader) error {
+	var statuses [IDDigits][IDBase][]NodeStatus
+	err := gob.NewDecoder(r).Decode(&statuses)
+	if err != nil {
+		return err
+	}
+	nodes := []Node{}
+	for _, row := range statuses {
+		for _, entries := range row {
+			for _, status := range entries {
+				node := NewNode(status.ID, status.LocalIP, status.GlobalIP, status.Region, status.Port)
+				node.setProximity(status.Proximity)
+				nodes = append(nodes, *node)
 			}
 		}
-	} else {
-		for rowNo, row := range t.nodes {
-			for colNo, node := range row {
-				if node != nil {
-					nodes[rowNo][colNo] = node
-				}
+	}
+	t.insertBatch(nodes)
+	return nil
+}
+
+// render writes the routingTable to w as a grid with a line per row, for debugging. Each line starts with the row number and the prefix the row's Nodes share with the current Node, followed by the number of Nodes in each column, or a dot if the column is empty.
+func (t *routingTable) render(w io.Writer) error {
+	counts := [IDDigits][IDBase]int{}
+	t.lock.RLock()
+	t.cells([]int{}, []int{}, func(row, col int, entries []*Node) {
+		counts[row][col] = len(entries)
+	})
+	t.lock.RUnlock()
+	self := t.self.ID.String()
+	header := []string{}
+	for col := range counts[0] {
+		header = append(header, fmt.Sprintf("%x", col))
+	}
+	_, err := fmt.Fprintf(w, "%3s %-32s %s\n", "row", "prefix", strings.Join(header, " "))
+	if err != nil {
+		return err
+	}
+	for row := range counts {
+		cells := []string{}
+		for _, count := range counts[row] {
+			if count == 0 {
+				cells = append(cells, ".")
+			} else {
+				cells = append(cells, strconv.Itoa(count))
 			}
 		}
+		_, err = fmt.Fprintf(w, "%3d %-32s %s\n", row, self[:row], strings.Join(cells, " "))
+		if err != nil {
+			return err
+		}
 	}
-	return nodes
+	return nil
 }
 
 func (t *routingTable) debug(format string, v ...interface{}) {
 	if t.logLevel <= LogLevelDebug {
-		t.log.Printf(format, v...)
+		t.log.Debugf(format, v...)
 	}
 }
 
 func (t *routingTable) warn(format string, v ...interface{}) {
 	if t.logLevel <= LogLevelWarn {
-		t.log.Printf(format, v...)
+		t.log.Warnf(format, v...)
 	}
 }
 
 func (t *routingTable) err(format string, v ...interface{}) {
 	if t.logLevel <= LogLevelError {
-		t.log.Printf(format, v...)
+		t.log.Errorf(format, v...)
 	}
 }
@@ -1,10 +1,37 @@
 package wendy
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"math/rand"
+	"runtime"
+	"strings"
 	"testing"
 )
 
+// Test that a routing table is usable as soon as it is constructed, and doesn't start any goroutines that would need to be stopped
+func TestRoutingTableNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	self := NewNode(NodeIDWithPrefix(1), "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	other := NewNode(NodeIDWithPrefix(9), "127.0.0.2", "127.0.0.2", "testing", 55555)
+	_, err := table.insertNode(*other, self.Proximity(other))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	node, err := table.getNode(other.ID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !node.ID.Equals(other.ID) {
+		t.Errorf("Expected %s, got %s.", other.ID, node.ID)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected no goroutines to be started, went from %d to %d.", before, after)
+	}
+}
+
 // Test insertion of a node into the routing table
 func TestRoutingTableInsert(t *testing.T) {
 	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
@@ -20,7 +47,10 @@ func TestRoutingTableInsert(t *testing.T) {
 	}
 	other := NewNode(other_id, "127.0.0.2", "127.0.0.2", "testing", 55555)
 	row := self_id.CommonPrefixLen(other_id)
-	col := other_id.Digit(row)
+	col, err := other_id.Digit(row)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
 	t.Logf("%s\n", other_id.String())
 	t.Logf("%v\n", row)
 	t.Logf("%v\n", int(col))
@@ -44,6 +74,531 @@ func TestRoutingTableInsert(t *testing.T) {
 	}
 }
 
+// Test that inserted nodes land in the row and column determined by their IDs, and that self and duplicates are rejected
+func TestRoutingTableInsertPlacement(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	ids := []string{
+		"f123456789abcdef0123456789abcdef",
+		"0f23456789abcdef0123456789abcdef",
+		"012345678fabcdef0123456789abcdef",
+		"0123456789abcdef0123456789abcdee",
+	}
+	expected := [][2]int{{0, 15}, {1, 15}, {9, 15}, {31, 14}}
+	for i, str := range ids {
+		id, err := NodeIDFromString(str)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		node := NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+		r, err := table.insertNode(*node, self.Proximity(node))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if r == nil {
+			t.Fatalf("Nil response returned for %s.", id)
+		}
+		row, col := expected[i][0], expected[i][1]
+		if len(table.nodes[row][col]) != 1 || !table.nodes[row][col][0].ID.Equals(id) {
+			t.Errorf("Expected %s at row %d, column %d.", id, row, col)
+		}
+		r2, err := table.getNode(id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !r2.ID.Equals(id) {
+			t.Errorf("Expected %s, got %s.", id, r2.ID)
+		}
+		_, err = table.insertNode(*node, self.Proximity(node))
+		if err != rtDuplicateInsertError {
+			t.Errorf("Expected rtDuplicateInsertError re-inserting %s, got %v.", id, err)
+		}
+	}
+	if len(table.list([]int{}, []int{})) != len(ids) {
+		t.Errorf("Expected %d nodes in the routing table, got %d.", len(ids), len(table.list([]int{}, []int{})))
+	}
+	_, err = table.insertNode(*self, 0)
+	if _, ok := err.(IdentityError); !ok {
+		t.Errorf("Expected IdentityError inserting self, got %v.", err)
+	}
+}
+
+// Test that out-of-range rows and columns are ignored instead of causing a panic
+func TestRoutingTableListOutOfBounds(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	other_id, err := NodeIDFromString("f123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	other := NewNode(other_id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+	_, err = table.insertNode(*other, self.Proximity(other))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tests := [...]struct {
+		rows, cols []int
+	}{
+		{[]int{32}, []int{}},
+		{[]int{-1}, []int{}},
+		{[]int{0}, []int{16}},
+		{[]int{0}, []int{-1}},
+		{[]int{32, -1}, []int{16, -1}},
+	}
+	for i, test := range tests {
+		if nodes := table.list(test.rows, test.cols); len(nodes) != 0 {
+			t.Errorf("test %v: expected no nodes from list, got %d", i, len(nodes))
+		}
+		exported := table.export(test.rows, test.cols)
+		for _, row := range exported {
+			for _, node := range row {
+				if node != nil {
+					t.Errorf("test %v: expected an empty export, got %s", i, node.ID)
+				}
+			}
+		}
+	}
+	if nodes := table.list([]int{0, 32}, []int{15, 16}); len(nodes) != 1 {
+		t.Errorf("Expected valid indices to still be listed alongside invalid ones, got %d nodes.", len(nodes))
+	}
+}
+
+// Test that changing an exported routing table doesn't change the routing table
+func TestRoutingTableExportCopy(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	other_id, err := NodeIDFromString("f123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	other := NewNode(other_id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+	_, err = table.insertNode(*other, self.Proximity(other))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	exported := table.export([]int{}, []int{})
+	if exported[0][15] == nil {
+		t.Fatalf("Expected node to be exported at row %d, column %d.", 0, 15)
+	}
+	exported[0][15].LocalIP = "127.0.0.3"
+	exported[0][15].setProximity(1)
+	exported[0][14] = other
+	node, err := table.getNode(other_id)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if node.LocalIP != "127.0.0.2" {
+		t.Errorf("Expected LocalIP to be %s, got %s instead.", "127.0.0.2", node.LocalIP)
+	}
+	if node.getRawProximity() == 1 {
+		t.Errorf("Expected proximity to be unaffected by changes to the export.")
+	}
+	if nodes := table.list([]int{0}, []int{14}); len(nodes) != 0 {
+		t.Errorf("Expected no node at row %d, column %d, got %d.", 0, 14, len(nodes))
+	}
+}
+
+// Test that the count of nodes follows inserts and removes, and ignores duplicates
+func TestRoutingTableCount(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	if count := table.count(); count != 0 {
+		t.Errorf("Expected empty table to have %d nodes, got %d.", 0, count)
+	}
+	ids := []string{"f123456789abcdef0123456789abcdef", "0f23456789abcdef0123456789abcdef", "01f3456789abcdef0123456789abcdef"}
+	for i, id := range ids {
+		other_id, err := NodeIDFromString(id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		other := NewNode(other_id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+		_, err = table.insertNode(*other, self.Proximity(other))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = table.insertNode(*other, self.Proximity(other))
+		if err != rtDuplicateInsertError {
+			t.Errorf("Expected duplicate insert to return rtDuplicateInsertError, got %v.", err)
+		}
+		if count := table.count(); count != i+1 {
+			t.Errorf("Expected %d nodes after inserting %s, got %d.", i+1, id, count)
+		}
+	}
+	for i, id := range ids {
+		other_id, err := NodeIDFromString(id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		_, err = table.removeNode(other_id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if count := table.count(); count != len(ids)-i-1 {
+			t.Errorf("Expected %d nodes after removing %s, got %d.", len(ids)-i-1, id, count)
+		}
+	}
+}
+
+// Test rendering a routing table with a couple of nodes in it
+func TestRoutingTableRender(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	for _, id := range []string{"f123456789abcdef0123456789abcdef", "01f3456789abcdef0123456789abcdef"} {
+		other_id, err := NodeIDFromString(id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		other := NewNode(other_id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+		_, err = table.insertNode(*other, self.Proximity(other))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	var buf bytes.Buffer
+	err = table.render(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 33 {
+		t.Fatalf("Expected %d lines, got %d.", 33, len(lines))
+	}
+	tests := [...]struct {
+		line     int
+		expected string
+	}{
+		{0, "row prefix                           0 1 2 3 4 5 6 7 8 9 a b c d e f"},
+		{1, "  0                                  . . . . . . . . . . . . . . . 1"},
+		{2, "  1 0                                . . . . . . . . . . . . . . . ."},
+		{3, "  2 01                               . . . . . . . . . . . . . . . 1"},
+		{32, " 31 0123456789abcdef0123456789abcde  . . . . . . . . . . . . . . . ."},
+	}
+	for i, test := range tests {
+		if lines[test.line] != test.expected {
+			t.Errorf("test %v: expected line %d to be %q, got %q", i, test.line, test.expected, lines[test.line])
+		}
+	}
+}
+
+// Test that re-inserting a node updates its entry instead of adding another
+func TestRoutingTableInsertDuplicate(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	other_id, err := NodeIDFromString("f123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = table.insertNode(*NewNode(other_id, "127.0.0.2", "127.0.0.2", "testing", 55555), 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = table.insertNode(*NewNode(other_id, "127.0.0.3", "127.0.0.3", "testing", 55555), 20)
+	if err != rtDuplicateInsertError {
+		t.Errorf("Expected rtDuplicateInsertError, got %v.", err)
+	}
+	if count := table.count(); count != 1 {
+		t.Errorf("Expected %d node in the routing table, got %d.", 1, count)
+	}
+	node, err := table.getNode(other_id)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if node.LocalIP != "127.0.0.3" || node.getRawProximity() != 20 {
+		t.Errorf("Expected entry to be updated to %s with proximity %d, got %s with proximity %d.", "127.0.0.3", 20, node.LocalIP, node.getRawProximity())
+	}
+	// an unknown proximity shouldn't overwrite a known one
+	_, err = table.insertNode(*NewNode(other_id, "127.0.0.4", "127.0.0.4", "testing", 55555), -1)
+	if err != rtDuplicateInsertError {
+		t.Errorf("Expected rtDuplicateInsertError, got %v.", err)
+	}
+	node, err = table.getNode(other_id)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if node.LocalIP != "127.0.0.4" || node.getRawProximity() != 20 {
+		t.Errorf("Expected entry to be updated to %s with proximity %d, got %s with proximity %d.", "127.0.0.4", 20, node.LocalIP, node.getRawProximity())
+	}
+}
+
+// Test that a capped cell keeps the closest nodes, evicting the furthest for closer ones and rejecting further ones
+func TestRoutingTableInsertCapped(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	table.setMaxEntries(2)
+	tests := [...]struct {
+		id        string
+		proximity int64
+		kept      bool
+		expected  []string
+	}{
+		{"f123456789abcdef0123456789abcdef", 30, true, []string{"f123456789abcdef0123456789abcdef"}},
+		{"f223456789abcdef0123456789abcdef", 10, true, []string{"f223456789abcdef0123456789abcdef", "f123456789abcdef0123456789abcdef"}},
+		{"f323456789abcdef0123456789abcdef", 20, true, []string{"f223456789abcdef0123456789abcdef", "f323456789abcdef0123456789abcdef"}},
+		{"f423456789abcdef0123456789abcdef", 40, false, []string{"f223456789abcdef0123456789abcdef", "f323456789abcdef0123456789abcdef"}},
+	}
+	for i, test := range tests {
+		id, err := NodeIDFromString(test.id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		r, err := table.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555), test.proximity)
+		if err != nil && (test.kept || !errors.Is(err, ErrTableFull)) {
+			t.Fatalf(err.Error())
+		}
+		if test.kept != (r != nil) {
+			t.Errorf("test %v: expected kept to be %v, got %v", i, test.kept, r != nil)
+		}
+		if len(table.nodes[0][15]) != len(test.expected) {
+			t.Errorf("test %v: expected %d nodes in row 0, column 15, got %d", i, len(test.expected), len(table.nodes[0][15]))
+			continue
+		}
+		for j, node := range table.nodes[0][15] {
+			if node.ID.String() != test.expected[j] {
+				t.Errorf("test %v: expected entry %d to be %s, got %s", i, j, test.expected[j], node.ID)
+			}
+		}
+	}
+	key, err := NodeIDFromString("f523456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	r, err := table.route(key)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if r.ID.String() != "f223456789abcdef0123456789abcdef" {
+		t.Errorf("Expected to route to the closest node, got %s.", r.ID)
+	}
+	// removing the closest node leaves the next closest to route to
+	_, err = table.removeNode(r.ID)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	r, err = table.route(key)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if r.ID.String() != "f323456789abcdef0123456789abcdef" {
+		t.Errorf("Expected to route to the remaining node, got %s.", r.ID)
+	}
+}
+
+// Test that a cell never holds more than the default number of nodes, and that the closest are kept
+func TestRoutingTableInsertDefaultCap(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	inserts := defaultMaxEntries * 2
+	for i := 0; i < inserts; i++ {
+		id, err := NodeIDFromString(fmt.Sprintf("f%031x", i))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		// insert from furthest to closest, so every insert past the cap evicts a node
+		_, err = table.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555), int64(inserts-i))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if count := table.count(); count != defaultMaxEntries {
+		t.Fatalf("Expected %d nodes in the routing table, got %d.", defaultMaxEntries, count)
+	}
+	for i, node := range table.nodes[0][15] {
+		if proximity := node.getRawProximity(); proximity != int64(i+1) {
+			t.Errorf("Expected entry %d to have proximity %d, got %d.", i, i+1, proximity)
+		}
+	}
+}
+
+// Test finding the node numerically closest to a key, wherever it is in the routing table
+func TestRoutingTableNearest(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	key, err := NodeIDFromString("7fffffffffffffffffffffffffffffff")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = table.nearest(key); err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError from an empty table, got %v.", err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		id := NodeID{uint64(r.Int63()) << 1, uint64(r.Int63())}
+		if _, err = table.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555), int64(i)); err != nil && !errors.Is(err, ErrTableFull) {
+			t.Fatalf(err.Error())
+		}
+	}
+	nearest, err := table.nearest(key)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, node := range table.list([]int{}, []int{}) {
+		if key.Diff(node.ID).Cmp(key.Diff(nearest.ID)) < 0 {
+			t.Errorf("Expected %s to be the nearest node to %s, but %s is nearer.", nearest.ID, key, node.ID)
+		}
+	}
+}
+
+// Test that saving and loading a routing table keeps every node, in proximity order
+func TestRoutingTableSaveLoad(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	table.setMaxEntries(3)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		id := NodeID{uint64(r.Int63()) << 1, uint64(r.Int63())}
+		if _, err = table.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555), r.Int63n(1000)); err != nil && !errors.Is(err, ErrTableFull) {
+			t.Fatalf(err.Error())
+		}
+	}
+	var buf bytes.Buffer
+	err = table.save(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	loaded := newRoutingTable(NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555))
+	loaded.setMaxEntries(3)
+	err = loaded.load(&buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if loaded.count() != table.count() {
+		t.Fatalf("Expected %d nodes after loading, got %d.", table.count(), loaded.count())
+	}
+	for row := range table.nodes {
+		for col := range table.nodes[row] {
+			for i, node := range table.nodes[row][col] {
+				other := loaded.nodes[row][col][i]
+				if !other.ID.Equals(node.ID) || other.getRawProximity() != node.getRawProximity() || other.LocalIP != node.LocalIP {
+					t.Errorf("Expected %s with proximity %d at row %d, column %d, entry %d, got %s with proximity %d.", node.ID, node.getRawProximity(), row, col, i, other.ID, other.getRawProximity())
+				}
+			}
+		}
+	}
+}
+
+// Test that iterating over the routing table visits every node once, and stops when asked to
+func TestRoutingTableIterate(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		id := NodeID{uint64(r.Int63()) << 1, uint64(r.Int63())}
+		if _, err = table.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555), int64(i)); err != nil && !errors.Is(err, ErrTableFull) {
+			t.Fatalf(err.Error())
+		}
+	}
+	seen := map[NodeID]int{}
+	table.iterate(func(row, col, entry int, node *Node) bool {
+		seen[node.ID] += 1
+		if !table.nodes[row][col][entry].ID.Equals(node.ID) {
+			t.Errorf("Expected %s at row %d, column %d, entry %d.", node.ID, row, col, entry)
+		}
+		return true
+	})
+	if len(seen) != table.count() {
+		t.Errorf("Expected to visit %d nodes, visited %d.", table.count(), len(seen))
+	}
+	for id, visits := range seen {
+		if visits != 1 {
+			t.Errorf("Expected to visit %s once, visited it %d times.", id, visits)
+		}
+	}
+	visits := 0
+	table.iterate(func(row, col, entry int, node *Node) bool {
+		visits += 1
+		return visits < 3
+	})
+	if visits != 3 {
+		t.Errorf("Expected iteration to stop after %d nodes, visited %d.", 3, visits)
+	}
+}
+
+// Test that the closest of several nodes competing for the same row and column is kept
+func TestRoutingTableInsertProximity(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	table.setMaxEntries(1)
+	tests := [...]struct {
+		id        string
+		proximity int64
+		kept      bool
+	}{
+		{"f123456789abcdef0123456789abcdef", 50, true},
+		{"f223456789abcdef0123456789abcdef", 10, true},
+		{"f323456789abcdef0123456789abcdef", 30, false},
+		{"f423456789abcdef0123456789abcdef", -1, false},
+	}
+	best := ""
+	for i, test := range tests {
+		id, err := NodeIDFromString(test.id)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		node := NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+		r, err := table.insertNode(*node, test.proximity)
+		if err != nil && (test.kept || !errors.Is(err, ErrTableFull)) {
+			t.Fatalf(err.Error())
+		}
+		if test.kept != (r != nil) {
+			t.Errorf("test %v: expected kept to be %v, got %v", i, test.kept, r != nil)
+		}
+		if test.kept {
+			best = test.id
+		}
+		if len(table.nodes[0][15]) != 1 || table.nodes[0][15][0].ID.String() != best {
+			t.Errorf("test %v: expected %s in row 0, column 15, got %v", i, best, table.nodes[0][15])
+		}
+	}
+}
+
 // Test deleting the only node from column of the routing table
 func TestRoutingTableDeleteOnly(t *testing.T) {
 	self_id, err := NodeIDFromBytes([]byte("this is a test Node for testing purposes only."))
@@ -334,6 +889,107 @@ const randSeed = 42
 
 var benchRand = rand.New(rand.NewSource(0))
 
+// Test routing to a node in a lower row whose column matches the current node's digit in the key's row
+func TestRoutingTableRouteLowerRowSelfColumn(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	other_id, err := NodeIDFromString("01111111111111111111111111111111")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	other := NewNode(other_id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+	_, err = table.insertNode(*other, self.Proximity(other))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	key, err := NodeIDFromString("00ffffffffffffffffffffffffffffff")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	r, err := table.route(key)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if r == nil || !r.ID.Equals(other_id) {
+		t.Errorf("Expected %s, got %v.", other_id, r)
+	}
+}
+
+// Test routing to a node in another column of the key's row when the key's column is empty
+func TestRoutingTableRouteEmptyColumn(t *testing.T) {
+	self_id, err := NodeIDFromString("0fedcba9876543210fedcba987654321")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	other_id, err := NodeIDFromString("01111111111111111111111111111111")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	other := NewNode(other_id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+	_, err = table.insertNode(*other, self.Proximity(other))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	key, err := NodeIDFromString("00ffffffffffffffffffffffffffffff")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	row := self_id.CommonPrefixLen(key)
+	col, err := key.Digit(row)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(table.list([]int{row}, []int{int(col)})) > 0 {
+		t.Fatalf("Expected the key's column to be empty.")
+	}
+	r, err := table.route(key)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if r == nil || !r.ID.Equals(other_id) {
+		t.Errorf("Expected %s, got %v.", other_id, r)
+	}
+}
+
+// Test that routing returns nodeNotFoundError when no node in the scanned rows is closer to the key than the current node
+func TestRoutingTableRouteOnlySelfCloser(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	other_id, err := NodeIDFromString("0f000000000000000000000000000000")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	other := NewNode(other_id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+	_, err = table.insertNode(*other, self.Proximity(other))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	key, err := NodeIDFromString("00ffffffffffffffffffffffffffffff")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if self_id.CommonPrefixLen(other_id) != self_id.CommonPrefixLen(key) {
+		t.Fatalf("Expected the node to be in the key's row.")
+	}
+	r, err := table.route(key)
+	if err != nodeNotFoundError {
+		t.Errorf("Expected nodeNotFoundError, got %v.", err)
+	}
+	if r != nil {
+		t.Errorf("Expected no node, got %s.", r.ID)
+	}
+}
+
 func randomNodeID() NodeID {
 	r := benchRand
 	lo := uint64(r.Uint32())<<32 | uint64(r.Uint32())
@@ -468,3 +1124,291 @@ func BenchmarkRoutingTableExportPartial(b *testing.B) {
 		benchTable.export([]int{0, 1, 2, 3, 4, 5, 6}, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
 	}
 }
+
+// Test that the routing table has a row for every digit of a NodeID and a column for every value a digit can take
+func TestRoutingTableDimensions(t *testing.T) {
+	self := NewNode(NodeIDWithPrefix(1, 2, 3), "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	if len(table.nodes) != IDDigits {
+		t.Fatalf("Expected %d rows, got %d.", IDDigits, len(table.nodes))
+	}
+	for row := range table.nodes {
+		if len(table.nodes[row]) != IDBase {
+			t.Fatalf("Expected %d columns in row %d, got %d.", IDBase, row, len(table.nodes[row]))
+		}
+	}
+	// a Node that differs from self in each digit in turn, with each possible value, lands in the row and column its prefix and digit pick
+	for row := 0; row < IDDigits; row++ {
+		for col := 0; col < IDBase; col++ {
+			digits := make([]byte, IDDigits)
+			for i := range digits {
+				digit, err := self.ID.Digit(i)
+				if err != nil {
+					t.Fatalf(err.Error())
+				}
+				digits[i] = digit
+			}
+			if byte(col) == digits[row] {
+				continue
+			}
+			digits[row] = byte(col)
+			id := NodeIDWithPrefix(digits...)
+			if l := self.ID.CommonPrefixLen(id); l != row {
+				t.Fatalf("Expected %s to share %d digits with %s, got %d.", id, row, self.ID, l)
+			}
+			r, err := table.insertNode(*NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555), 10)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(table.nodes[row][col]) != 1 || table.nodes[row][col][0] != r {
+				t.Errorf("Expected %s in row %d, column %d.", id, row, col)
+			}
+		}
+	}
+	if count := table.count(); count != IDDigits*(IDBase-1) {
+		t.Errorf("Expected %d Nodes in the routing table, got %d.", IDDigits*(IDBase-1), count)
+	}
+}
+
+// Test that every operation on the current Node's own ID is rejected, and that the cell for each of its own digits stays empty
+func TestRoutingTableSelf(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	if row, col, err := table.cell(self_id, "insert", "into"); err == nil {
+		t.Errorf("Expected an error for the cell of self, got row %d, column %d.", row, col)
+	}
+	if _, err = table.insertNode(*self, 0); !isIdentityError(err) {
+		t.Errorf("Expected IdentityError inserting self, got %v.", err)
+	}
+	if _, err = table.getNode(self_id); !isIdentityError(err) {
+		t.Errorf("Expected IdentityError getting self, got %v.", err)
+	}
+	if _, err = table.route(self_id); !isIdentityError(err) {
+		t.Errorf("Expected IdentityError routing to self, got %v.", err)
+	}
+	if _, err = table.removeNode(self_id); !isIdentityError(err) {
+		t.Errorf("Expected IdentityError removing self, got %v.", err)
+	}
+	// a Node differing from self only in the last digit goes in the last row
+	last, err := NodeIDFromString("0123456789abcdef0123456789abcde0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = table.insertNode(*NewNode(last, "127.0.0.2", "127.0.0.2", "testing", 55555), 10)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(table.nodes[IDDigits-1][0]) != 1 {
+		t.Errorf("Expected %s in row %d, column 0.", last, IDDigits-1)
+	}
+	if count := table.count(); count != 1 {
+		t.Errorf("Expected 1 Node in the routing table, got %d.", count)
+	}
+	for row := 0; row < IDDigits; row++ {
+		digit, err := self_id.Digit(row)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(table.nodes[row][digit]) != 0 {
+			t.Errorf("Expected row %d, column %d to be empty.", row, digit)
+		}
+	}
+	cluster := NewCluster(self, nil)
+	if err = cluster.repairTable(self_id); !isIdentityError(err) {
+		t.Errorf("Expected IdentityError repairing the cell of self, got %v.", err)
+	}
+}
+
+func isIdentityError(err error) bool {
+	_, ok := err.(IdentityError)
+	return ok
+}
+
+// Test that inserting a batch of nodes leaves the routing table the same as inserting them one at a time
+func TestRoutingTableInsertBatch(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	one, batch := newRoutingTable(self), newRoutingTable(self)
+	for _, table := range []*routingTable{one, batch} {
+		table.setMaxEntries(3)
+	}
+	r := rand.New(rand.NewSource(1))
+	nodes := []Node{*self}
+	for i := 0; i < 100; i++ {
+		id := NodeID{uint64(r.Int63()) << 1, uint64(r.Int63())}
+		if i%10 == 9 {
+			// insert some nodes again, with a new proximity
+			id = nodes[1+r.Intn(len(nodes)-1)].ID
+		}
+		node := NewNode(id, "127.0.0.2", "127.0.0.2", "testing", 55555)
+		// some proximities tie, and some are unknown
+		node.setProximity(r.Int63n(50) - 5)
+		nodes = append(nodes, *node)
+	}
+	for _, node := range nodes {
+		if _, err = one.insertNode(node, node.getRawProximity()); err != nil && err != rtDuplicateInsertError && !errors.Is(err, ErrTableFull) {
+			if _, ok := err.(IdentityError); !ok {
+				t.Fatalf(err.Error())
+			}
+		}
+	}
+	inserted := batch.insertBatch(nodes)
+	if count := len(batch.list([]int{}, []int{})); inserted != count {
+		t.Errorf("Expected %d nodes to be reported inserted, got %d.", count, inserted)
+	}
+	for row := range one.nodes {
+		for col := range one.nodes[row] {
+			expected, got := one.nodes[row][col], batch.nodes[row][col]
+			if len(expected) != len(got) {
+				t.Errorf("Expected %d nodes in row %d, column %d, got %d.", len(expected), row, col, len(got))
+				continue
+			}
+			for i := range expected {
+				if !expected[i].ID.Equals(got[i].ID) || expected[i].getRawProximity() != got[i].getRawProximity() {
+					t.Errorf("Expected %s with proximity %d at %d in row %d, column %d, got %s with proximity %d.", expected[i].ID, expected[i].getRawProximity(), i, row, col, got[i].ID, got[i].getRawProximity())
+				}
+			}
+		}
+	}
+	if inserted = batch.insertBatch(nodes[:1]); inserted != 0 {
+		t.Errorf("Expected inserting the current Node to be skipped, got %d inserted.", inserted)
+	}
+}
+
+// Test that a pinned node stays first in its column while many closer nodes are inserted into it, until it is removed
+func TestRoutingTablePinned(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	relay := NewNode(NodeIDWithPrefix(5), "127.0.0.2", "127.0.0.2", "testing", 55555)
+	err = table.setPinned(relay.ID, true)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = table.insertNode(*relay, 1000); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 1; i <= 50; i++ {
+		node := NewNode(NodeIDWithPrefix(5, byte(i%16), byte(i/16)+1), "127.0.0.3", "127.0.0.3", "testing", 55555)
+		if _, err = table.insertNode(*node, int64(i)); err != nil && !errors.Is(err, ErrTableFull) {
+			t.Fatalf(err.Error())
+		}
+	}
+	entries := table.nodes[0][5]
+	if len(entries) != defaultMaxEntries {
+		t.Fatalf("Expected %d nodes in the column, got %d.", defaultMaxEntries, len(entries))
+	}
+	if !entries[0].ID.Equals(relay.ID) {
+		t.Errorf("Expected the pinned node %s first, got %s.", relay.ID, entries[0].ID)
+	}
+	for i, node := range entries[1:] {
+		if node.getRawProximity() != int64(i+1) {
+			t.Errorf("Expected the closest nodes after the pinned node, got proximity %d at %d.", node.getRawProximity(), i+1)
+		}
+	}
+	if target, err := table.route(NodeIDWithPrefix(5, 15)); err != nil || !target.ID.Equals(relay.ID) {
+		t.Errorf("Expected %s to be routed to, got %v (%v).", relay.ID, target, err)
+	}
+	// unpinning returns the node to its place by proximity, so the next closer node pushes it out
+	if err = table.setPinned(relay.ID, false); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if entries = table.nodes[0][5]; !entries[len(entries)-1].ID.Equals(relay.ID) {
+		t.Errorf("Expected the unpinned node %s last, got %s.", relay.ID, entries[len(entries)-1].ID)
+	}
+	if _, err = table.insertNode(*NewNode(NodeIDWithPrefix(5, 0, 15), "127.0.0.3", "127.0.0.3", "testing", 55555), 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = table.getNode(relay.ID); err != nodeNotFoundError {
+		t.Errorf("Expected the unpinned node to be dropped, got %v.", err)
+	}
+	if err = table.setPinned(relay.ID, true); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = table.insertNode(*relay, 1000); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = table.removeNode(relay.ID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = table.getNode(relay.ID); err != nodeNotFoundError {
+		t.Errorf("Expected the pinned node to be removed, got %v.", err)
+	}
+	if _, ok := table.setPinned(self.ID, true).(IdentityError); !ok {
+		t.Errorf("Expected IdentityError pinning the current Node.")
+	}
+}
+
+// Test that replacing a node in the routing table puts the new node in its place by proximity, and restores the old node if the new one can't be inserted
+func TestRoutingTableReplace(t *testing.T) {
+	self_id, err := NodeIDFromString("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	self := NewNode(self_id, "127.0.0.1", "127.0.0.1", "testing", 55555)
+	table := newRoutingTable(self)
+	table.setMaxEntries(4)
+	for i := 1; i <= 4; i++ {
+		node := NewNode(NodeIDWithPrefix(5, byte(i)), "127.0.0.2", "127.0.0.2", "testing", 55555)
+		if _, err = table.insertNode(*node, int64(i*10)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	dead := NodeIDWithPrefix(5, 1)
+	replacement := NewNode(NodeIDWithPrefix(5, 9), "127.0.0.3", "127.0.0.3", "testing", 55555)
+	replacement.setProximity(25)
+	existed, err := table.replace(dead, *replacement)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !existed {
+		t.Errorf("Expected %s to have been in the routing table.", dead)
+	}
+	expected := []NodeID{NodeIDWithPrefix(5, 2), replacement.ID, NodeIDWithPrefix(5, 3), NodeIDWithPrefix(5, 4)}
+	entries := table.nodes[0][5]
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d nodes in the column, got %d.", len(expected), len(entries))
+	}
+	for i, id := range expected {
+		if !entries[i].ID.Equals(id) {
+			t.Errorf("Expected %s at %d, got %s.", id, i, entries[i].ID)
+		}
+	}
+	if entries[1].getRawProximity() != 25 {
+		t.Errorf("Expected the replacement to keep its proximity of 25, got %d.", entries[1].getRawProximity())
+	}
+	// the old node isn't there anymore, so the new one is just inserted, pushing out the furthest
+	closest := NewNode(NodeIDWithPrefix(5, 10), "127.0.0.3", "127.0.0.3", "testing", 55555)
+	closest.setProximity(5)
+	existed, err = table.replace(dead, *closest)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if existed {
+		t.Errorf("Expected %s not to be in the routing table anymore.", dead)
+	}
+	if entries = table.nodes[0][5]; !entries[0].ID.Equals(closest.ID) || len(entries) != 4 {
+		t.Errorf("Expected %s first in a full column, got %s of %d.", closest.ID, entries[0].ID, len(entries))
+	}
+	if _, err = table.getNode(NodeIDWithPrefix(5, 4)); err != nodeNotFoundError {
+		t.Errorf("Expected the furthest node to be pushed out, got %v.", err)
+	}
+	// a replacement that can't be inserted leaves the old node in place
+	existed, err = table.replace(NodeIDWithPrefix(5, 2), *self)
+	if _, ok := err.(IdentityError); !ok || existed {
+		t.Errorf("Expected IdentityError replacing a node with the current Node, got %v (%v).", existed, err)
+	}
+	if _, err = table.getNode(NodeIDWithPrefix(5, 2)); err != nil {
+		t.Errorf("Expected %s to still be in the routing table, got %v.", NodeIDWithPrefix(5, 2), err)
+	}
+}
@@ -0,0 +1,29 @@
+package wendy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Transport is an interface that can be fulfilled to change how Nodes connect to each other, e.g., to run Clusters over a MemoryNetwork in tests. Messages are exchanged the same way over whatever connections the Transport provides.
+//
+// Listen is called by Cluster.Listen with the address the current Node should accept connections on: a colon followed by its Port. If the Port is 0, the Transport should choose one; the Cluster reads it back from the address of the Listener that is returned.
+//
+// Dial is called to connect to the address of another Node, as returned by Node.Addr. It must give up and return an error once the context is done or the timeout has passed.
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error)
+}
+
+// tcpTransport is the Transport used until Cluster.SetTransport is called. It connects Nodes over TCP.
+type tcpTransport struct{}
+
+func (t tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (t tcpTransport) Dial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", address)
+}
@@ -3,10 +3,13 @@ package wendy
 import (
 	"errors"
 	"fmt"
+	"log"
+	"time"
 )
 
 const (
 	LogLevelDebug = iota
+	LogLevelInfo
 	LogLevelWarn
 	LogLevelError
 )
@@ -19,7 +22,7 @@ const (
 //
 // OnForward is called immediately before a Message is forwarded to the next Node in its route through the Cluster. The function receives a pointer to the Message, which can be modified before it is sent, and the ID of the next step in the Message's route. The function must return a boolean; true if the Message should continue its way through the Cluster, false if the Message should be prematurely terminated instead of forwarded.
 //
-// OnNewLeaves is called when the current Node's leafSet is updated. The function receives a dump of the leafSet.
+// OnNewLeaves is called when the current Node's leafSet is updated. The function receives a dump of the leafSet. Updates that happen in quick succession are reported in a single call; see Cluster.SetNewLeavesDelay.
 //
 // OnNodeJoin is called when the current Node learns of a new Node in the Cluster. It receives the Node that just joined.
 //
@@ -36,12 +39,75 @@ type Application interface {
 	OnHeartbeat(node Node)
 }
 
+// RequestHandler is an interface that an Application can also fulfill to respond to requests made with Cluster.Request.
+//
+// OnRequest is called instead of OnDeliver when the current Node is the destination of a request. It receives the request, and returns the value to respond with. Only the first Application registered that fulfills RequestHandler is asked; if none do, the request isn't answered, and times out.
+type RequestHandler interface {
+	OnRequest(msg Message) []byte
+}
+
+// LeaveHandler is an interface that an Application can also fulfill to be warned before the current Node leaves the Cluster with Cluster.Stop.
+//
+// PreLeave is called before the other Nodes are told the current Node is leaving, while Messages can still be sent, e.g., to hand the data the current Node is responsible for off to the Nodes that will be. Stop waits for PreLeave to return, up to the drain timeout; see Cluster.SetDrainTimeout.
+type LeaveHandler interface {
+	PreLeave()
+}
+
 // Credentials is an interface that can be fulfilled to limit access to the Cluster.
 type Credentials interface {
 	Valid([]byte) bool
 	Marshal() []byte
 }
 
+// ProximityMeasurer is an interface that can be fulfilled to change how the proximity of other Nodes is measured, e.g., to use geographic distance instead of network latency.
+//
+// Measure is called when the current Node learns of a Node whose proximity it doesn't know yet. It must return the proximity score of the Node passed to it; lower scores mean closer Nodes. Scores are adjusted for Regions after they are returned. If an error is returned, the Node's proximity is left unknown.
+type ProximityMeasurer interface {
+	Measure(node Node) (int64, error)
+}
+
+// Logger is an interface that can be fulfilled to send Wendy's log output somewhere other than a *log.Logger, e.g., to a structured logging package. Each line of output is passed to the method for its level; which lines are written is controlled by Cluster.SetLogLevel. Use NewLogger to write to a *log.Logger.
+//
+// Debugf is called with details that are only useful when debugging Wendy itself.
+//
+// Infof is called on Node lifecycle events, like a Node joining or leaving the Cluster, or a state table being repaired.
+//
+// Warnf is called on events that may, but do not necessarily, indicate an error.
+//
+// Errorf is called on events that are undoubtedly errors.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// NewLogger returns a Logger that writes every line, whatever its level, to the *log.Logger.
+func NewLogger(l *log.Logger) Logger {
+	return stdLogger{l}
+}
+
+// stdLogger is the Logger returned by NewLogger.
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s stdLogger) Debugf(format string, v ...interface{}) {
+	s.l.Printf(format, v...)
+}
+
+func (s stdLogger) Infof(format string, v ...interface{}) {
+	s.l.Printf(format, v...)
+}
+
+func (s stdLogger) Warnf(format string, v ...interface{}) {
+	s.l.Printf(format, v...)
+}
+
+func (s stdLogger) Errorf(format string, v ...interface{}) {
+	s.l.Printf(format, v...)
+}
+
 // Passphrase is an implementation of Credentials that grants access to the Cluster if the Node has the same Passphrase set
 type Passphrase string
 
@@ -53,10 +119,21 @@ func (p Passphrase) Marshal() []byte {
 	return []byte(p)
 }
 
+// Errors that can be checked for with errors.Is, whichever more specific error they are wrapped in.
+var (
+	ErrUnreachable     = errors.New("Node is unreachable")      // A Node couldn't be contacted, or has no IP the current Node can use
+	ErrInvalidNodeID   = errors.New("Invalid NodeID")           // A NodeID couldn't be created from its encoding
+	ErrTableFull       = errors.New("State table is full")      // A Node wasn't inserted into a state table, because it was further than every Node already there
+	ErrNotFound        = errors.New("Node not found.")          // A Node isn't in the state table it was looked up in
+	ErrNodeIDCollision = errors.New("NodeID is already in use") // A Node tried to join a Cluster that already has a Node with its ID; it should get a new ID and try again
+)
+
 // Errors!
-var deadNodeError = errors.New("Node did not respond to heartbeat.")
-var nodeNotFoundError = errors.New("Node not found.")
+var deadNodeError = fmt.Errorf("%w: Node did not respond to heartbeat.", ErrUnreachable)
+var nodeNotFoundError = ErrNotFound
 var impossibleError = errors.New("This error should never be reached. It's logically impossible.")
+var noProgressError = errors.New("Message couldn't make any progress towards its key.")
+var noReachBackError = fmt.Errorf("%w: Node couldn't reach the current Node back.", ErrUnreachable)
 
 // IdentityError represents an error that was raised when a Node attempted to perform actions on its state tables using its own ID, which is problematic. It is its own type for the purposes of handling the error.
 type IdentityError struct {
@@ -78,13 +155,85 @@ func throwIdentityError(action, prep, container string) IdentityError {
 	}
 }
 
+// TimeoutError represents an error that was raised when a call has taken too long. It is its own type for the purposes of handling the error.
+type TimeoutError struct {
+	Action  string
+	Timeout time.Duration // How long the call was waited on before giving up
+	Node    *Node         // The Node that didn't respond in time, if the call was to a known Node; nil otherwise
+	Key     NodeID        // The key of the Message that was being sent to the Node; only set if Node is
+	Err     error         // The error from the last attempt, if the action was retried until the RetryPolicy ran out of attempts; nil otherwise
+}
+
+// Error returns the TimeoutError as a string and fulfills the error interface.
+func (t TimeoutError) Error() string {
+	msg := fmt.Sprintf("TimeoutError: %s timed out after %s.", t.Action, t.Timeout)
+	if t.Node != nil {
+		msg = fmt.Sprintf("TimeoutError: %s timed out after %s, waiting on Node %s for Message %s.", t.Action, t.Timeout, t.Node, t.Key)
+	}
+	if t.Err != nil {
+		msg += " Last error: " + t.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the error from the last attempt, if the action was retried until the RetryPolicy ran out of attempts, so errors.Is and errors.As can see through the TimeoutError.
+func (t TimeoutError) Unwrap() error {
+	return t.Err
+}
+
+func throwTimeout(action string, timeout time.Duration) TimeoutError {
+	return TimeoutError{
+		Action:  action,
+		Timeout: timeout,
+	}
+}
+
+// UnreachableError represents an error that is raised when a Node has no IP that can be used from another Region, i.e., it has no GlobalIP. It is its own type for the purposes of handling the error.
+type UnreachableError struct {
+	Node   NodeID
+	Region string
+}
+
+// Error returns the UnreachableError as a string and fulfills the error interface.
+func (e UnreachableError) Error() string {
+	return fmt.Sprintf("UnreachableError: Node %s has no IP that can be reached from the %s region.", e.Node, e.Region)
+}
+
+// Is allows errors.Is to match an UnreachableError to ErrUnreachable.
+func (e UnreachableError) Is(target error) bool {
+	return target == ErrUnreachable
+}
+
+func throwUnreachableError(node NodeID, region string) UnreachableError {
+	return UnreachableError{
+		Node:   node,
+		Region: region,
+	}
+}
+
 // InvalidArgumentError represents an error that is raised when arguments that are invalid are passed to a function that depends on those arguments. It is its own type for the purposes of handling the error.
 type InvalidArgumentError string
 
 func (e InvalidArgumentError) Error() string {
-	return fmt.Sprintf("InvalidArgumentError: %s", e)
+	return "InvalidArgumentError: " + string(e)
 }
 
 func throwInvalidArgumentError(msg string) InvalidArgumentError {
 	return InvalidArgumentError(msg)
 }
+
+// NodeIDError represents an error that is raised when a NodeID can't be decoded from its string or binary encoding. It wraps ErrInvalidNodeID.
+type NodeIDError string
+
+func (e NodeIDError) Error() string {
+	return "NodeIDError: " + string(e)
+}
+
+// Unwrap returns ErrInvalidNodeID, so errors.Is matches a NodeIDError to it.
+func (e NodeIDError) Unwrap() error {
+	return ErrInvalidNodeID
+}
+
+func throwNodeIDError(msg string) NodeIDError {
+	return NodeIDError(msg)
+}